@@ -0,0 +1,312 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	helper "shive/helpers"
+	"shive/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ChangePassword sets a new password for the signed in user. Every other session
+// is signed out and the caller gets a fresh token pair.
+func ChangePassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var body struct {
+			Current_password *string `json:"current_password" validate:"required"`
+			New_password     *string `json:"new_password" validate:"required"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		user, ok := confirmCurrentPassword(c, *body.Current_password)
+		if !ok {
+			return
+		}
+
+		if !respondToPasswordPolicy(c, *body.New_password, *user.Email, *user.Username) {
+			return
+		}
+
+		// Only replace the hash that was just checked
+		result, err := userCollection.UpdateOne(
+			ctx,
+			bson.M{"user_id": user.User_id, "password": *user.Password},
+			bson.M{"$set": bson.M{
+				"password":   MaskPassword(*body.New_password),
+				"updated_at": time.Now(),
+			}},
+		)
+
+		if err == nil && result.MatchedCount < 1 {
+			err = mongo.ErrNoDocuments
+		}
+		helper.Audit(c, helper.AuditPasswordChange, user.User_id, err)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while updating password",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err := helper.RevokeAllUserTokens(user.User_id); err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Password updated but existing sessions could not be revoked",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		err = helper.AppMailer.Send(helper.MailMessage{
+			To:      *user.Email,
+			Subject: "Your Shive password was changed",
+			Body: fmt.Sprintf(
+				"Hi %s,\n\nThe password of your Shive account was just changed and your other devices were signed out.\n\nIf this wasn't you, reset your password right away at %s/forgot-password.",
+				*user.Name,
+				helper.APP_URL,
+			),
+		})
+
+		if err != nil {
+			log.Printf("Error sending password change notice to user %s: %v", user.User_id, err)
+		}
+
+		// Revoking bumped the token version, so sign against the stored user
+		err = userCollection.FindOne(ctx, bson.M{"user_id": user.User_id}).Decode(user)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while finding user",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		respondWithLoginTokens(c, user, c.GetBool("mfa"))
+	}
+}
+
+// ChangeEmail starts moving the signed in user to a new email address. The new
+// address has to be verified before it is used, and the current one is notified.
+func ChangeEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			New_email *string `json:"new_email" validate:"required,email"`
+			Password  *string `json:"password" validate:"required"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		user, ok := confirmCurrentPassword(c, *body.Password)
+		if !ok {
+			return
+		}
+
+		if strings.EqualFold(*body.New_email, *user.Email) {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "This is already your email address",
+				},
+			)
+			return
+		}
+
+		retryAfter, err := helper.VerificationRetryAfter(user.User_id)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while checking recent verification emails",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(
+				http.StatusTooManyRequests,
+				gin.H{
+					"status":  http.StatusTooManyRequests,
+					"message": "error",
+					"error":   helper.ErrVerificationThrottled.Error(),
+				},
+			)
+			return
+		}
+
+		err = helper.RequestEmailChange(user, *body.New_email)
+		helper.Audit(c, helper.AuditEmailChange, *body.New_email, err)
+
+		if err == helper.ErrEmailTaken {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Looks like this email already exists"})
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while changing email",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusAccepted,
+			gin.H{
+				"status":  http.StatusAccepted,
+				"message": "Check " + *body.New_email + " for a link to confirm your new email address",
+				"data": map[string]string{
+					"email":         *user.Email,
+					"pending_email": *body.New_email,
+				},
+			},
+		)
+	}
+}
+
+// confirmCurrentPassword loads the signed in user and checks their password. Wrong
+// guesses count towards the login limits. It answers the request itself when it fails.
+func confirmCurrentPassword(c *gin.Context, password string) (*models.User, bool) {
+	user, ok := loadSignedInUser(c)
+	if !ok {
+		return nil, false
+	}
+
+	if user.Password == nil {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "This account signs in with single sign-on, use forgot password to set a password first",
+			},
+		)
+		return nil, false
+	}
+
+	if !verifyCurrentPassword(c, user, password) {
+		return nil, false
+	}
+	return user, true
+}
+
+// loadSignedInUser loads the account of the signed in user, answering the request when it can't.
+func loadSignedInUser(c *gin.Context) (*models.User, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.M{"user_id": c.GetString("uid")}).Decode(&user)
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(
+			http.StatusNotFound,
+			gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Oops account not found",
+			},
+		)
+		return nil, false
+	}
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while finding user",
+				"error":   err.Error(),
+			},
+		)
+		return nil, false
+	}
+
+	return &user, true
+}
+
+// verifyCurrentPassword checks password against the user's, who must have one. Wrong
+// guesses count towards the login limits. It answers the request itself when it fails.
+func verifyCurrentPassword(c *gin.Context, user *models.User, password string) bool {
+	clientIP := c.ClientIP()
+	retryAfter, err := helper.LoginRetryAfter(*user.Email, clientIP)
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while checking login attempts",
+				"error":   err.Error(),
+			},
+		)
+		return false
+	}
+
+	if retryAfter > 0 {
+		helper.Audit(c, helper.AuditPasswordConfirm, *user.Email, errTooManyAttempts)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(
+			http.StatusTooManyRequests,
+			gin.H{
+				"message": "Too many failed login attempts, please try again later",
+				"error":   "too_many_attempts",
+			},
+		)
+		return false
+	}
+
+	if passwordIsValid, msg := ConfirmPassword(password, *user.Password); !passwordIsValid {
+		recordLoginFailure(c, helper.AuditPasswordConfirm, *user.Email, errWrongPassword)
+
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{
+				"status":  http.StatusBadRequest,
+				"message": msg,
+				"error":   "invalid credentials",
+			},
+		)
+		return false
+	}
+
+	return true
+}
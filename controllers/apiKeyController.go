@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"net/http"
+	helper "shive/helpers"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CreateApiKey issues a key for a service account. The key is only shown in this response.
+func CreateApiKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !verifyNotApiKey(c) {
+			return
+		}
+
+		var body struct {
+			Name       *string    `json:"name" validate:"required,min=3,max=100"`
+			User_type  *string    `json:"user_type" validate:"omitempty,min=2,max=32"`
+			Scopes     []string   `json:"scopes" validate:"required,min=1,dive,eq=read|eq=write"`
+			Expires_at *time.Time `json:"expires_at"`
+		}
+
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Error occurred while binding JSON",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if validationError := validate.Struct(&body); validationError != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   validationError.Error(),
+				},
+			)
+			return
+		}
+
+		userType := helper.DefaultSignupRole
+		if body.User_type != nil {
+			userType = *body.User_type
+		}
+
+		if err := helper.AuthorizeRoleGrant(c, userType); err != nil {
+			status := helper.AuthorizeStatus(err)
+			c.JSON(status, gin.H{"status": status, "error": err.Error()})
+			return
+		}
+
+		if !verifyRoleExists(c, userType) {
+			return
+		}
+
+		expiresAt := time.Now().Add(helper.API_KEY_DEFAULT_TTL)
+		if body.Expires_at != nil {
+			expiresAt = *body.Expires_at
+		}
+
+		if !expiresAt.After(time.Now()) {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   "expires_at must be in the future",
+				},
+			)
+			return
+		}
+
+		key, plainKey, err := helper.CreateApiKey(*body.Name, userType, body.Scopes, expiresAt, c.GetString("uid"))
+
+		if err != nil {
+			helper.Audit(c, helper.AuditApiKeyCreate, *body.Name, err)
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while creating the API key",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		helper.Audit(c, helper.AuditApiKeyCreate, key.Key_id, nil)
+
+		c.JSON(
+			http.StatusCreated,
+			gin.H{
+				"status":  http.StatusCreated,
+				"message": "API key created! Copy it now, it will not be shown again",
+				"data": gin.H{
+					"api_key":  plainKey,
+					"key_info": key,
+				},
+			},
+		)
+	}
+}
+
+// GetApiKeys lists every API key without the keys themselves.
+func GetApiKeys() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !verifyNotApiKey(c) {
+			return
+		}
+
+		keys, err := helper.ListApiKeys()
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while listing API keys",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "success",
+				"data":    keys,
+			},
+		)
+	}
+}
+
+// RevokeApiKey stops a key from working immediately.
+func RevokeApiKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !verifyNotApiKey(c) {
+			return
+		}
+
+		err := helper.RevokeApiKey(c.Param("key_id"))
+		helper.Audit(c, helper.AuditApiKeyRevoke, c.Param("key_id"), err)
+
+		if err == mongo.ErrNoDocuments {
+			c.JSON(
+				http.StatusNotFound,
+				gin.H{
+					"status":  http.StatusNotFound,
+					"message": "No active API key with this id",
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while revoking the API key",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "API key revoked",
+			},
+		)
+	}
+}
+
+// verifyNotApiKey only lets users signed in as themselves manage keys and
+// permissions, so a leaked key can not be used to grant more access.
+func verifyNotApiKey(c *gin.Context) bool {
+	if c.GetString("auth_method") == "api_key" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API keys can not be used to manage API keys or permissions"})
+		return false
+	}
+	return true
+}
+
+// verifyRoleExists answers with a 400 when no policy exists for role.
+func verifyRoleExists(c *gin.Context, role string) bool {
+	exists, err := helper.RoleExists(role)
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while checking the role",
+				"error":   err.Error(),
+			},
+		)
+		return false
+	}
+
+	if !exists {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "error",
+				"error":   helper.ErrUnknownRole.Error() + ": " + role,
+			},
+		)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"net/http"
+	helper "shive/helpers"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAuditEvents lists the newest audit events. They can be narrowed down with
+// the `actor`, `action`, `target` and `outcome` query parameters and a time
+// range with `since` and `until` (RFC 3339). `limit` caps how many are returned.
+func GetAuditEvents() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := helper.AuditEventFilter{
+			Actor:   c.Query("actor"),
+			Action:  c.Query("action"),
+			Target:  c.Query("target"),
+			Outcome: c.Query("outcome"),
+			Limit:   50,
+		}
+
+		var ok bool
+		if filter.Since, ok = timeQuery(c, "since"); !ok {
+			return
+		}
+		if filter.Until, ok = timeQuery(c, "until"); !ok {
+			return
+		}
+
+		if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 {
+			filter.Limit = int64(limit)
+			if filter.Limit > 500 {
+				filter.Limit = 500
+			}
+		}
+
+		events, err := helper.ListAuditEvents(filter)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while listing audit events",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "success",
+				"data":    events,
+			},
+		)
+	}
+}
+
+// timeQuery parses an optional RFC 3339 query parameter. It answers with a 400
+// when the value can't be parsed, and reports whether it could.
+func timeQuery(c *gin.Context, name string) (time.Time, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return time.Time{}, true
+	}
+
+	parsed, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "error",
+				"error":   name + " must be an RFC 3339 timestamp",
+			},
+		)
+		return time.Time{}, false
+	}
+	return parsed, true
+}
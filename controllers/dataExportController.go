@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	helper "shive/helpers"
+	"shive/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ExportMyData hands the signed in user a zip archive of their personal data.
+// Small archives are sent right away. Big ones, or any with `async=true`, are
+// built in the background and answered with a 202 pointing at the status endpoint.
+func ExportMyData() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := c.GetString("uid")
+
+		needsJob, err := helper.DataExportNeedsJob(userId)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while preparing the export",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if needsJob || c.Query("async") == "true" {
+			export, _, err := helper.RequestDataExport(userId)
+
+			if err != nil {
+				c.JSON(
+					http.StatusInternalServerError,
+					gin.H{
+						"status":  http.StatusInternalServerError,
+						"message": "Error occurred while requesting the export",
+						"error":   err.Error(),
+					},
+				)
+				return
+			}
+
+			c.Header("Location", dataExportPath(export))
+			c.JSON(
+				http.StatusAccepted,
+				gin.H{
+					"status":  http.StatusAccepted,
+					"message": "Your export is being prepared, check its status for the download link",
+					"data":    dataExportStatus(export),
+				},
+			)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		// Built in memory so a failure can still be answered with a 500
+		var archive bytes.Buffer
+		err = helper.WriteDataExport(ctx, &archive, userId)
+
+		if err == mongo.ErrNoDocuments {
+			c.JSON(
+				http.StatusNotFound,
+				gin.H{
+					"status":  http.StatusNotFound,
+					"message": "Oops account not found",
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while building the export",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.Header("Content-Disposition", `attachment; filename="`+dataExportFilename(time.Now())+`"`)
+		c.Data(http.StatusOK, "application/zip", archive.Bytes())
+	}
+}
+
+// GetMyDataExport reports the status of one of the signed in user's background exports.
+func GetMyDataExport() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		export, ok := findMyDataExport(c)
+		if !ok {
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "success",
+				"data":    dataExportStatus(export),
+			},
+		)
+	}
+}
+
+// DownloadMyDataExport sends a finished background export.
+func DownloadMyDataExport() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		export, ok := findMyDataExport(c)
+		if !ok {
+			return
+		}
+
+		file, err := helper.OpenDataExport(export)
+
+		switch err {
+		case nil:
+		case helper.ErrDataExportNotReady:
+			c.JSON(
+				http.StatusConflict,
+				gin.H{
+					"status":  http.StatusConflict,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		case helper.ErrDataExportExpired:
+			c.JSON(
+				http.StatusGone,
+				gin.H{
+					"status":  http.StatusGone,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		default:
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while opening the export",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+		defer file.Close()
+
+		c.Header("Content-Disposition", `attachment; filename="`+dataExportFilename(*export.Completed_at)+`"`)
+		c.Header("Content-Length", strconv.FormatInt(export.Size, 10))
+		c.Header("Content-Type", "application/zip")
+		c.Status(http.StatusOK)
+
+		if _, err := io.Copy(c.Writer, file); err != nil {
+			log.Printf("Error sending data export %s: %v", export.Export_id, err)
+		}
+	}
+}
+
+func findMyDataExport(c *gin.Context) (*models.DataExport, bool) {
+	export, err := helper.GetDataExport(c.GetString("uid"), c.Param("export_id"))
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(
+			http.StatusNotFound,
+			gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Export not found, it may have expired",
+			},
+		)
+		return nil, false
+	}
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while finding the export",
+				"error":   err.Error(),
+			},
+		)
+		return nil, false
+	}
+	return export, true
+}
+
+func dataExportStatus(export *models.DataExport) gin.H {
+	status := gin.H{
+		"export":     export,
+		"status_url": dataExportPath(export),
+	}
+	if export.Status == helper.DataExportReady {
+		status["download_url"] = dataExportPath(export) + "/download"
+	}
+	return status
+}
+
+func dataExportPath(export *models.DataExport) string {
+	return "/users/me/exports/" + export.Export_id
+}
+
+func dataExportFilename(generatedAt time.Time) string {
+	return "shive-export-" + generatedAt.UTC().Format("2006-01-02") + ".zip"
+}
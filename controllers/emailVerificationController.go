@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"context"
+	"math"
+	"net/http"
+	helper "shive/helpers"
+	"shive/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// VerifyEmail confirms the address a verification link was sent to.
+func VerifyEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Token *string `json:"token" validate:"required"`
+		}
+
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Error occurred while binding JSON",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if validationError := validate.Struct(&body); validationError != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   validationError.Error(),
+				},
+			)
+			return
+		}
+
+		user, err := helper.VerifyEmail(*body.Token)
+
+		if err == helper.ErrEmailTaken {
+			c.JSON(
+				http.StatusConflict,
+				gin.H{
+					"status":  http.StatusConflict,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err == helper.ErrInvalidVerificationToken {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while verifying email",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Email verified successfully!",
+				"data": map[string]interface{}{
+					"user_id":        user.User_id,
+					"email":          *user.Email,
+					"email_verified": user.Email_verified,
+				},
+			},
+		)
+	}
+}
+
+// ResendVerificationEmail sends a new verification link to the signed in user.
+// Requests are throttled per user.
+func ResendVerificationEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var user models.User
+		err := userCollection.FindOne(ctx, bson.M{"user_id": c.GetString("uid")}).Decode(&user)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while finding user",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if user.Email_verified {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "This email address is already verified",
+				},
+			)
+			return
+		}
+
+		retryAfter, err := helper.VerificationRetryAfter(user.User_id)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while checking recent verification emails",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(
+				http.StatusTooManyRequests,
+				gin.H{
+					"status":  http.StatusTooManyRequests,
+					"message": "error",
+					"error":   helper.ErrVerificationThrottled.Error(),
+				},
+			)
+			return
+		}
+
+		if err := helper.SendVerificationEmail(user.User_id, *user.Name, *user.Email); err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while sending verification email",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusAccepted,
+			gin.H{
+				"status":  http.StatusAccepted,
+				"message": "A new verification link has been sent to " + *user.Email,
+			},
+		)
+	}
+}
@@ -2,12 +2,10 @@ package controllers
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"shive/database"
-	"shive/helpers"
+	helper "shive/helpers"
 	"shive/models"
-	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -21,13 +19,6 @@ var genreCollection *mongo.Collection = database.OpenCollection(database.Client,
 func CreateGenre() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		if err := helpers.VerifyUserType(c, "ADMIN"); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error":   err.Error(),
-				"message": "Error Validating Admin user",
-			})
-			return
-		}
 		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
 		var genre models.Genre
 		defer cancel()
@@ -160,103 +151,21 @@ func GetGenre() gin.HandlerFunc {
 	}
 }
 
+// GetAllGenres lists a page of genres, oldest first. See pageQuery for the
+// paging parameters.
 func GetAllGenres() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userTypeValidationErr := helpers.VerifyUserType(c, "ADMIN")
-		if userTypeValidationErr != nil {
-			c.JSON(
-				http.StatusBadRequest,
-				gin.H{
-					"status": http.StatusBadRequest,
-					"error":  userTypeValidationErr.Error(),
-				},
-			)
+		page, ok := pageQuery(c)
+		if !ok {
 			return
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
-
-		defer cancel()
-
-		recordPerPage, err := strconv.Atoi(c.Query("recordPerPage"))
-
-		if err != nil || recordPerPage < 1 {
-			recordPerPage = 10
-		}
-
-		page, err1 := strconv.Atoi("pages")
-		if err1 != nil || page < 1 {
-			page = 1
-		}
 
-		startIndex := (page - 1) * recordPerPage
-		startIndex, err = strconv.Atoi(c.Query("startIndex"))
+		genres, total, next, err := helper.ListGenres(page)
 
-		matchStage := bson.D{
-			{
-				Key:   "$match",
-				Value: bson.D{{}},
-			},
+		if respondInvalidCursor(c, err) {
+			return
 		}
-		// groupStage documents by a specified key and performs aggregate operations like counting, summing, etc.
-		groupStage := bson.D{
-			{
-				Key: "$group",
-				Value: bson.D{
-					{
-						Key: "_id",
-						Value: bson.D{{
-							Key:   "_id",
-							Value: "null",
-						}},
-					},
-					{
-						Key: "total_count",
-						Value: bson.D{{
-							Key:   "$sum",
-							Value: 1,
-						}},
-					},
-					{
-						Key: "data",
-						Value: bson.D{{
-							Key:   "$push",
-							Value: "$$ROOT",
-						}},
-					},
-				},
-			}}
-		// This stage reshapes the documents by including or excluding fields and performing transformations.
-		projectStage := bson.D{
-			{
-				Key: "$project",
-				Value: bson.D{
-					{
-						Key:   "_id",
-						Value: 0,
-					},
-					{
-						Key:   "total_count",
-						Value: 1,
-					},
-					{
-						Key: "genre_items",
-						Value: bson.D{{
-							Key: "$slice",
-							Value: []interface{}{
-								"$data",
-								startIndex,
-								recordPerPage,
-							},
-						}},
-					}},
-			}}
-		result, err := genreCollection.Aggregate(ctx, mongo.Pipeline{
-			matchStage,
-			groupStage,
-			projectStage,
-		})
 
-		defer cancel()
 		if err != nil {
 			c.JSON(
 				http.StatusInternalServerError,
@@ -269,32 +178,21 @@ func GetAllGenres() gin.HandlerFunc {
 			return
 		}
 
-		var allGenres []bson.M
-
-		err = result.All(ctx, &allGenres)
-		if err != nil {
-			log.Fatal(err)
-		}
+		setPageLinks(c, page, next)
 
-		c.JSON(http.StatusOK, allGenres[0])
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"total_count": total,
+				"genre_items": genres,
+				"next_cursor": next,
+			},
+		)
 	}
-
 }
 
 func UpdateGenre() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userAuthErr := helpers.VerifyUserType(c, "ADMIN")
-
-		if userAuthErr != nil {
-			c.JSON(http.StatusUnauthorized,
-				gin.H{
-					"status":  http.StatusUnauthorized,
-					"error":   userAuthErr,
-					"message": "Unauthorized",
-				})
-			return
-		}
-
 		genreId := c.Param("genre_id")
 		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
 
@@ -373,20 +271,6 @@ func UpdateGenre() gin.HandlerFunc {
 
 func DeleteGenre() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userAuthErr := helpers.VerifyUserType(c, "ADMIN")
-
-		if userAuthErr != nil {
-			c.JSON(
-				http.StatusUnauthorized,
-				gin.H{
-					"status":  http.StatusUnauthorized,
-					"message": "Unauthorized",
-					"error":   userAuthErr.Error(),
-				},
-			)
-			return
-		}
-
 		genreId := c.Param("genre_id")
 
 		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
@@ -401,6 +285,7 @@ func DeleteGenre() gin.HandlerFunc {
 		)
 
 		if err != nil {
+			helper.Audit(c, helper.AuditGenreDelete, genreId, err)
 			c.JSON(
 				http.StatusBadRequest,
 				gin.H{
@@ -425,13 +310,29 @@ func DeleteGenre() gin.HandlerFunc {
 			return
 		}
 
+		// Movies may only point at genres that exist
+		moviesUpdated, err := helper.RemoveGenreFromMovies(genreId)
+		helper.Audit(c, helper.AuditGenreDelete, genreId, err)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"error":   err.Error(),
+					"message": "Genre deleted, but removing it from movies failed",
+				})
+			return
+		}
+
 		c.JSON(
 			http.StatusOK,
 			gin.H{
 				"status":  http.StatusOK,
 				"message": "success",
 				"data": map[string]interface{}{
-					"data": "Genre successfully deleted!",
+					"data":           "Genre successfully deleted!",
+					"movies_updated": moviesUpdated,
 				},
 			},
 		)
@@ -0,0 +1,301 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	helper "shive/helpers"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CreateInvite emails someone a link to sign up with the given role, USER when
+// none is sent. Inviting into any other role also needs the user:role permission,
+// and the role can't grant permissions the caller's own role lacks.
+func CreateInvite() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !verifyNotApiKey(c) {
+			return
+		}
+
+		var body struct {
+			Email     *string `json:"email" validate:"required,email"`
+			User_type string  `json:"user_type" validate:"omitempty,min=2,max=32"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		role := body.User_type
+		if role == "" {
+			role = helper.DefaultSignupRole
+		}
+
+		if err := helper.AuthorizeRoleGrant(c, role); err != nil {
+			status := helper.AuthorizeStatus(err)
+			c.JSON(status, gin.H{"status": status, "error": err.Error()})
+			return
+		}
+
+		invite, err := helper.CreateInvite(*body.Email, role, c.GetString("uid"))
+		helper.Audit(c, helper.AuditInviteCreate, *body.Email, err)
+
+		if err == helper.ErrUnknownRole {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   err.Error() + ": " + role,
+				},
+			)
+			return
+		}
+
+		if err == helper.ErrEmailTaken {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Looks like this email already exists"})
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while sending the invite",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusCreated,
+			gin.H{
+				"status":  http.StatusCreated,
+				"message": "Invite sent",
+				"data":    invite,
+			},
+		)
+	}
+}
+
+// GetInvites lists the invites that have not expired yet.
+func GetInvites() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invites, err := helper.ListInvites()
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while listing invites",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "success",
+				"data":    invites,
+			},
+		)
+	}
+}
+
+// RevokeInvite stops a pending invite from being accepted.
+func RevokeInvite() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := helper.RevokeInvite(c.Param("invite_id"))
+		helper.Audit(c, helper.AuditInviteRevoke, c.Param("invite_id"), err)
+
+		switch err {
+		case nil:
+		case mongo.ErrNoDocuments:
+			c.JSON(
+				http.StatusNotFound,
+				gin.H{
+					"status":  http.StatusNotFound,
+					"message": "Oops invite not found",
+				},
+			)
+			return
+		case helper.ErrInviteNotPending:
+			c.JSON(
+				http.StatusConflict,
+				gin.H{
+					"status":  http.StatusConflict,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		default:
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while revoking the invite",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Invite revoked",
+			},
+		)
+	}
+}
+
+// AcceptInvite creates the account an invite was sent for and signs it in.
+func AcceptInvite() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Token    *string `json:"token" validate:"required"`
+			Name     *string `json:"name" validate:"required,min=4,max=100"`
+			Username *string `json:"username" validate:"required,min=4,max=100"`
+			Password *string `json:"password" validate:"required,min=8"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		// The email is only known from the invite, so check the password against it too
+		claims, msg := helper.ValidateToken(*body.Token)
+		if msg != "" || claims.Token_type != helper.InviteTokenType {
+			respondInvalidInvite(c)
+			return
+		}
+
+		if !respondToPasswordPolicy(c, *body.Password, claims.Email, *body.Username) {
+			return
+		}
+
+		user, err := helper.AcceptInvite(*body.Token, *body.Name, *body.Username, MaskPassword(*body.Password))
+		if err != nil {
+			helper.Audit(c, helper.AuditInviteAccept, claims.Id, err)
+		} else {
+			helper.AuditAs(c, user.User_id, helper.AuditInviteAccept, claims.Id, nil)
+		}
+
+		if err == helper.ErrInvalidInvite {
+			respondInvalidInvite(c)
+			return
+		}
+
+		if !respondToNewAccountError(c, err) {
+			return
+		}
+
+		respondWithLoginTokens(c, user, false)
+	}
+}
+
+// SetupAdmin creates the first admin account with the setup token printed at
+// startup. It stops working once any admin exists.
+func SetupAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Setup_token *string `json:"setup_token" validate:"required"`
+			Name        *string `json:"name" validate:"required,min=4,max=100"`
+			Username    *string `json:"username" validate:"required,min=4,max=100"`
+			Email       *string `json:"email" validate:"required,email"`
+			Password    *string `json:"password" validate:"required,min=8"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		if !respondToPasswordPolicy(c, *body.Password, *body.Email, *body.Username) {
+			return
+		}
+
+		user, err := helper.BootstrapAdmin(*body.Setup_token, *body.Name, *body.Username, *body.Email, MaskPassword(*body.Password))
+		if err != nil {
+			helper.Audit(c, helper.AuditAdminSetup, *body.Email, err)
+		} else {
+			helper.AuditAs(c, user.User_id, helper.AuditAdminSetup, user.User_id, nil)
+		}
+
+		if err == helper.ErrInvalidSetupToken {
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{
+					"status":  http.StatusUnauthorized,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err == helper.ErrAdminAlreadyExists {
+			c.JSON(
+				http.StatusConflict,
+				gin.H{
+					"status":  http.StatusConflict,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if !respondToNewAccountError(c, err) {
+			return
+		}
+
+		if err := helper.SendVerificationEmail(user.User_id, *user.Name, *user.Email); err != nil {
+			log.Printf("Error sending verification email to user %s: %v", user.User_id, err)
+		}
+
+		respondWithLoginTokens(c, user, false)
+	}
+}
+
+func respondInvalidInvite(c *gin.Context) {
+	c.JSON(
+		http.StatusBadRequest,
+		gin.H{
+			"status":  http.StatusBadRequest,
+			"message": "error",
+			"error":   helper.ErrInvalidInvite.Error(),
+		},
+	)
+}
+
+// respondToNewAccountError answers for an error from creating an account, and
+// reports whether there was none.
+func respondToNewAccountError(c *gin.Context, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case helper.ErrEmailTaken:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Looks like this email already exists"})
+	case helper.ErrUsernameTaken:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Looks like this username already exists"})
+	default:
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while creating the account",
+				"error":   err.Error(),
+			},
+		)
+	}
+	return false
+}
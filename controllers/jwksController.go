@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"net/http"
+	"shive/helpers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetJWKS publishes the public keys other services use to verify Shive tokens.
+func GetJWKS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := helpers.PublicJWKS()
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while loading signing keys",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"keys": keys,
+			},
+		)
+	}
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"net/http"
+	helper "shive/helpers"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetLoginLocks lists the emails and IPs with recent failed logins. Pass
+// `blocked=true` to only list the ones that are currently backed off or locked.
+func GetLoginLocks() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		attempts, err := helper.ListLoginAttempts(c.Query("blocked") == "true")
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while listing login attempts",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		now := time.Now()
+		items := make([]gin.H, 0, len(attempts))
+		for _, attempt := range attempts {
+			retryAfter, _ := helper.LoginRetryAfterAttempt(attempt, now)
+			items = append(items, gin.H{
+				"key":                 attempt.Key,
+				"kind":                attempt.Kind,
+				"value":               attempt.Value,
+				"failures":            attempt.Failures,
+				"last_failure_at":     attempt.Last_failure_at,
+				"locked_until":        attempt.Locked_until,
+				"retry_after_seconds": int(retryAfter.Seconds()),
+			})
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "success",
+				"data":    items,
+			},
+		)
+	}
+}
+
+// ClearLoginLock resets the failed login counter of an `email` or `ip` given as a query parameter.
+func ClearLoginLock() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		kind, value := helper.LoginAttemptEmail, c.Query("email")
+		if value == "" {
+			kind, value = helper.LoginAttemptIP, c.Query("ip")
+		}
+
+		if value == "" {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Please provide an email or ip query parameter",
+				},
+			)
+			return
+		}
+
+		cleared, err := helper.ClearLoginAttempt(kind, value)
+		helper.Audit(c, helper.AuditLoginLockClear, value, err)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while clearing login attempts",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if !cleared {
+			c.JSON(
+				http.StatusNotFound,
+				gin.H{
+					"status":  http.StatusNotFound,
+					"message": "No failed logins recorded for this " + kind,
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Failed logins cleared for " + kind + " " + value,
+			},
+		)
+	}
+}
@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	helper "shive/helpers"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RequestMagicLink emails a one-time sign-in link to an existing account. It
+// always answers 202 so the response does not reveal whether the account exists.
+func RequestMagicLink() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Email *string `json:"email" validate:"required,email"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		accepted := gin.H{
+			"status":  http.StatusAccepted,
+			"message": "If a verified account exists for this email, a sign-in link has been sent",
+		}
+
+		user, err := helper.FindUserByEmail(*body.Email)
+
+		if err == mongo.ErrNoDocuments {
+			helper.Audit(c, helper.AuditMagicLinkSend, *body.Email, errors.New("no account with this email"))
+			c.JSON(http.StatusAccepted, accepted)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while finding user",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		// Links are only sent to addresses the user has proven they own, to accounts
+		// that could sign in with a password right now
+		var refused error
+		switch {
+		case user.Password == nil:
+			refused = errors.New("the account signs in with single sign-on")
+		case !user.Email_verified:
+			refused = errors.New("the email address is not verified")
+		default:
+			refused = helper.AccountRestriction(user, time.Now())
+		}
+
+		if refused == nil {
+			retryAfter, err := helper.MagicLinkRetryAfter(*user.Email)
+			if err != nil {
+				c.JSON(
+					http.StatusInternalServerError,
+					gin.H{
+						"status":  http.StatusInternalServerError,
+						"message": "Error occurred while checking recent sign-in links",
+						"error":   err.Error(),
+					},
+				)
+				return
+			}
+			// Answering 429 would tell who has an account
+			if retryAfter > 0 {
+				refused = errors.New("a sign-in link was sent recently")
+			}
+		}
+
+		if refused != nil {
+			helper.AuditAs(c, user.User_id, helper.AuditMagicLinkSend, *body.Email, refused)
+			c.JSON(http.StatusAccepted, accepted)
+			return
+		}
+
+		err = helper.SendMagicLink(user)
+		helper.AuditAs(c, user.User_id, helper.AuditMagicLinkSend, *body.Email, err)
+
+		if err != nil {
+			log.Printf("Error sending sign-in link to user %s: %v", user.User_id, err)
+		}
+
+		c.JSON(http.StatusAccepted, accepted)
+	}
+}
+
+// RedeemMagicLink exchanges a sign-in link for a token pair, or for a two-factor
+// challenge when the user has two-factor authentication enabled.
+func RedeemMagicLink() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Token *string `json:"token" validate:"required"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		user, err := helper.RedeemMagicLink(*body.Token)
+
+		if err == helper.ErrInvalidMagicLink {
+			helper.Audit(c, helper.AuditMagicLinkLogin, "", err)
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while checking the sign-in link",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		helper.AuditAs(c, user.User_id, helper.AuditMagicLinkLogin, *user.Email, nil)
+
+		if user.Totp_enabled {
+			respondWithMfaChallenge(c, user)
+			return
+		}
+
+		respondWithLoginTokens(c, user, false)
+	}
+}
@@ -2,18 +2,19 @@ package controllers
 
 import (
 	"context"
-	"log"
+	"errors"
 	"net/http"
 	"shive/database"
-	"shive/helpers"
+	helper "shive/helpers"
 	"shive/models"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var movieCollection = database.OpenCollection(database.Client, "movie")
@@ -21,23 +22,12 @@ var movieCollection = database.OpenCollection(database.Client, "movie")
 func CreateMovie() gin.HandlerFunc {
 
 	return func(c *gin.Context) {
-		err := helpers.VerifyUserType(c, "ADMIN")
-		if err != nil {
-			c.JSON(
-				http.StatusInternalServerError, gin.H{
-					"status":  http.StatusInternalServerError,
-					"message": "Error verifying user that is trying to create a movie",
-					"error":   err.Error(),
-				})
-			return
-		}
-
 		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
 		var movie models.Movie
 
 		defer cancel()
 
-		err = c.BindJSON(&movie)
+		err := c.BindJSON(&movie)
 
 		if err != nil {
 			c.JSON(
@@ -84,6 +74,8 @@ func CreateMovie() gin.HandlerFunc {
 			return
 		}
 
+		normalizeMovieMetadata(&movie)
+
 		validationError := validate.Struct(&movie)
 		if validationError != nil {
 
@@ -98,17 +90,32 @@ func CreateMovie() gin.HandlerFunc {
 			return
 		}
 
+		if !verifyGenresExist(c, movie.Genre_ids) {
+			return
+		}
+
 		movie.Id = primitive.NewObjectID()
 		movie.Movie_id = movie.Id.Hex()
 		currentTime := time.Now()
 
 		newMovie := models.Movie{
-			Id:         movie.Id,
-			Name:       movie.Name,
-			Topic:      movie.Topic,
-			Movie_id:   movie.Movie_id,
-			Movie_URL:  movie.Movie_URL,
-			Genre_id:   movie.Genre_id,
+			Id:        movie.Id,
+			Name:      movie.Name,
+			Topic:     movie.Topic,
+			Movie_id:  movie.Movie_id,
+			Movie_URL: movie.Movie_URL,
+			Genre_ids: movie.Genre_ids,
+
+			Release_date:         movie.Release_date,
+			Runtime:              movie.Runtime,
+			Original_language:    movie.Original_language,
+			Spoken_languages:     movie.Spoken_languages,
+			Countries:            movie.Countries,
+			Synopsis:             movie.Synopsis,
+			Tagline:              movie.Tagline,
+			Certification:        movie.Certification,
+			Production_companies: movie.Production_companies,
+
 			Created_at: currentTime,
 			Updated_at: currentTime,
 		}
@@ -175,111 +182,65 @@ func GetMovie() gin.HandlerFunc {
 	}
 }
 
+// GetAllMovies lists a page of movies with facet counts per genre, decade and
+// language over every movie that matched. The query parameters are described
+// in the README under "Listing movies".
 func GetAllMovies() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
-
-		defer cancel()
-
-		// Get the record per page query
-		recordPerPageQueryKey := c.Query("recordPerPage")
-		recordPerPage, err := strconv.Atoi(recordPerPageQueryKey)
-
-		// If the record per page query is not a number or is less than 1, set it to 10
-		if err != nil || recordPerPage < 1 {
-			recordPerPage = 10
+		filter := helper.MovieListFilter{
+			GenreIds:   queryList(c.Query("genre_ids")),
+			GenreMatch: strings.ToLower(c.Query("genre_match")),
+			Languages:  queryList(c.Query("language")),
+			Sort:       c.Query("sort"),
 		}
 
-		// Get the page query
-		pageQueryKey := c.Query("page")
-		page, pageErr := strconv.Atoi(pageQueryKey)
-
-		// If the page query is not a number or is less than 1, set it to 1
-		if pageErr != nil || page < 1 {
-			page = 1
+		var ok bool
+		if filter.Page, ok = pageQuery(c); !ok {
+			return
+		}
+		if filter.YearFrom, ok = yearQuery(c, "year_from"); !ok {
+			return
+		}
+		if filter.YearTo, ok = yearQuery(c, "year_to"); !ok {
+			return
+		}
+		if filter.RatingMin, ok = ratingQuery(c, "rating_min"); !ok {
+			return
+		}
+		if filter.RatingMax, ok = ratingQuery(c, "rating_max"); !ok {
+			return
+		}
+		if filter.CreatedSince, ok = timeQuery(c, "created_since"); !ok {
+			return
+		}
+		if filter.CreatedUntil, ok = timeQuery(c, "created_until"); !ok {
+			return
+		}
+		if filter.UpdatedSince, ok = timeQuery(c, "updated_since"); !ok {
+			return
+		}
+		if filter.UpdatedUntil, ok = timeQuery(c, "updated_until"); !ok {
+			return
 		}
 
-		// Calculate the start index
-		startIndex := (page - 1) * recordPerPage
+		listing, err := helper.ListMovies(filter)
 
-		// Match stage - Match the movie by id
-		matchStage := bson.D{
-			{
-				Key:   "$match",
-				Value: bson.D{{}},
-			},
+		if respondInvalidCursor(c, err) {
+			return
 		}
 
-		// Group stage - Group the movies by id
-		groupStage := bson.D{
-			{
-				Key: "$group",
-				Value: bson.D{
-					// _id stage - Set the _id to null
-					{
-						Key: "_id",
-						Value: bson.D{
-							{
-								Key:   "_id",
-								Value: "null",
-							},
-						},
-					},
-					{
-						// Total count stage - Count the total number of movies
-						Key: "total_count",
-						Value: bson.D{{
-							Key:   "$sum",
-							Value: 1,
-						}},
-					},
-					{
-						// Data stage - Push the movies to the data array
-						Key: "data",
-						Value: bson.D{{
-							Key:   "$push",
-							Value: "$$ROOT",
-						}},
-					},
-				},
-			}}
-
-		// Project stage - Project the movies
-		projectStage := bson.D{
-			{
-				// Project stage - Project the movies
-				Key: "$project",
-				Value: bson.D{
-					{
-						// _id stage - Set the _id to 0
-						Key:   "_id",
-						Value: 0,
-					}, {
-						// Total count stage - Count the total number of movies
-						Key:   "total_count",
-						Value: 1,
-					}, {
-						// Movie items stage - Slice the movies
-						Key: "movie_items",
-						Value: bson.D{{
-							// Slice stage - Slice the movies from the data array when we have pagination
-							Key: "$slice",
-							Value: []interface{}{
-								"$data", startIndex, recordPerPage,
-							}},
-						},
-					},
+		if err == helper.ErrInvalidGenreMatch || errors.Is(err, helper.ErrUnknownSortField) {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   err.Error(),
 				},
-			},
+			)
+			return
 		}
 
-		// Aggregate the movies
-		result, err := movieCollection.Aggregate(ctx, mongo.Pipeline{
-			matchStage,
-			groupStage,
-			projectStage,
-		})
-
 		if err != nil {
 			c.JSON(
 				http.StatusInternalServerError,
@@ -292,19 +253,13 @@ func GetAllMovies() gin.HandlerFunc {
 			return
 		}
 
-		var allMovies []bson.M
-
-		err = result.All(ctx, &allMovies)
-
-		if err != nil {
-			log.Fatal(err)
-		}
+		setPageLinks(c, filter.Page, listing.Next_cursor)
 
 		c.JSON(http.StatusOK,
 			gin.H{
 				"status":  http.StatusOK,
 				"message": "Ok",
-				"data":    allMovies[0],
+				"data":    listing,
 			})
 	}
 }
@@ -320,8 +275,6 @@ func UpdateMovie() gin.HandlerFunc {
 
 		defer cancel()
 
-		objId, _ := primitive.ObjectIDFromHex(movieId)
-
 		if err := c.BindJSON(&movie); err != nil {
 
 			c.JSON(http.StatusBadRequest, gin.H{
@@ -333,6 +286,8 @@ func UpdateMovie() gin.HandlerFunc {
 			return
 		}
 
+		normalizeMovieMetadata(&movie)
+
 		validationError := validate.Struct(&movie)
 		if validationError != nil {
 
@@ -347,15 +302,31 @@ func UpdateMovie() gin.HandlerFunc {
 			return
 		}
 
+		if !verifyGenresExist(c, movie.Genre_ids) {
+			return
+		}
+
+		// The whole movie is replaced, metadata left out of the body is cleared
 		update := bson.M{
 			"name":       movie.Name,
 			"topic":      movie.Topic,
-			"genre_id":   movie.Genre_id,
+			"genre_ids":  movie.Genre_ids,
 			"movie_url":  movie.Movie_URL,
 			"updated_at": time.Now(),
+
+			"release_date":         movie.Release_date,
+			"runtime":              movie.Runtime,
+			"original_language":    movie.Original_language,
+			"spoken_languages":     movie.Spoken_languages,
+			"countries":            movie.Countries,
+			"synopsis":             movie.Synopsis,
+			"tagline":              movie.Tagline,
+			"certification":        movie.Certification,
+			"production_companies": movie.Production_companies,
 		}
 
-		filterByID := bson.M{"_id": bson.M{"$eq": objId}}
+		// Movies are stored with a generated _id, their own ID is movie_id
+		filterByID := bson.M{"movie_id": movieId}
 
 		count, _ := movieCollection.CountDocuments(ctx, filterByID)
 
@@ -410,81 +381,61 @@ func UpdateMovie() gin.HandlerFunc {
 	}
 }
 
+// SearchMovieByQuery runs a full text search over the movie name, topic,
+// tagline and synopsis, best match first. The query is taken literally. See
+// pageQuery for the paging parameters.
 func SearchMovieByQuery() gin.HandlerFunc {
 	return func(c *gin.Context) {
-
-		var searchedMovies []models.Movie
-
-		movieName := c.Param("movieName")
-
-		if movieName == "" {
-			log.Println("movie name is empty")
-			c.Header("Content-Type", "application/json")
-
-			c.JSON(
-				http.StatusNotFound,
-				gin.H{
-					"error": "Invalid search parameter" + movieName,
-				},
-			)
-			c.Abort()
+		page, ok := pageQuery(c)
+		if !ok {
 			return
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
-		defer cancel()
 
-		filter := bson.M{
-			"name": bson.M{
-				"$regex": primitive.Regex{
-					Pattern: movieName,
-					Options: "i",
-				},
-			},
+		movies, total, next, err := helper.SearchMovies(c.Param("movieName"), page)
+
+		if respondInvalidCursor(c, err) {
+			return
 		}
-		searchQuery, err := movieCollection.Find(ctx, filter)
 
-		if err != nil {
+		if err == helper.ErrEmptySearch || err == helper.ErrSearchTooLong {
 			c.JSON(
-				http.StatusInternalServerError,
+				http.StatusBadRequest,
 				gin.H{
-					"status":  http.StatusInternalServerError,
+					"status":  http.StatusBadRequest,
+					"message": "Invalid search parameter",
 					"error":   err.Error(),
-					"message": "error occurred while searching for movie in db",
 				},
 			)
 			return
 		}
 
-		err = searchQuery.All(ctx, &searchedMovies)
-
 		if err != nil {
 			c.JSON(
 				http.StatusInternalServerError,
 				gin.H{
 					"status":  http.StatusInternalServerError,
 					"error":   err.Error(),
-					"message": "error occurred while decoding for movie in db",
+					"message": "error occurred while searching for movie in db",
 				},
 			)
 			return
 		}
 
-		defer searchQuery.Close(ctx)
-		err = searchQuery.Err()
-		if err != nil {
-			log.Println(err)
-			c.IndentedJSON(
-				http.StatusBadRequest,
-				gin.H{
-					"message": "invalid request",
-					"status":  http.StatusBadRequest,
-					"error":   err.Error(),
+		setPageLinks(c, page, next)
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Ok",
+				"data": gin.H{
+					"total_count":   total,
+					"recordPerPage": page.Limit,
+					"movie_items":   movies,
+					"next_cursor":   next,
 				},
-			)
-			return
-		}
-		defer cancel()
-		c.IndentedJSON(200, searchedMovies)
+			},
+		)
 	}
 }
 
@@ -508,13 +459,18 @@ func SearchMovieByGenreId() gin.HandlerFunc {
 			return
 		}
 
-		filter := bson.M{
-			"genre_id": bson.M{
-				"$regex": primitive.Regex{
-					Pattern: genreId,
-					Options: "i",
-				},
-			},
+		// The path takes one genre ID or several separated by commas
+		filter, err := genreQuery(genreId, c.Query("match"))
+
+		if err != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   err.Error(),
+				})
+			return
 		}
 
 		searchDB, err := movieCollection.Find(ctx, filter)
@@ -552,20 +508,6 @@ func SearchMovieByGenreId() gin.HandlerFunc {
 
 func DeleteMovieByMovieId() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		err := helpers.VerifyUserType(c, "ADMIN")
-
-		if err != nil {
-			c.JSON(
-				http.StatusUnauthorized,
-				gin.H{
-					"status":  http.StatusUnauthorized,
-					"error":   err.Error(),
-					"message": "User must be an admin to delete a movie",
-				},
-			)
-			return
-		}
-
 		movieId := c.Param("movie_id")
 
 		if movieId == "" {
@@ -590,6 +532,7 @@ func DeleteMovieByMovieId() gin.HandlerFunc {
 		result, err := movieCollection.DeleteOne(ctx, filter)
 
 		if err != nil {
+			helper.Audit(c, helper.AuditMovieDelete, movieId, err)
 			c.JSON(
 				http.StatusInternalServerError,
 				gin.H{
@@ -612,6 +555,8 @@ func DeleteMovieByMovieId() gin.HandlerFunc {
 			return
 		}
 
+		helper.Audit(c, helper.AuditMovieDelete, movieId, nil)
+
 		c.JSON(
 			http.StatusOK,
 			gin.H{
@@ -622,3 +567,124 @@ func DeleteMovieByMovieId() gin.HandlerFunc {
 		)
 	}
 }
+
+// normalizeMovieMetadata tidies the metadata sent by clients before it is
+// validated. Lists are never stored as null, so they can always be filtered on.
+func normalizeMovieMetadata(movie *models.Movie) {
+	movie.Release_date = strings.TrimSpace(movie.Release_date)
+	movie.Original_language = strings.TrimSpace(movie.Original_language)
+	movie.Synopsis = strings.TrimSpace(movie.Synopsis)
+	movie.Tagline = strings.TrimSpace(movie.Tagline)
+	movie.Certification = strings.TrimSpace(movie.Certification)
+
+	movie.Spoken_languages = tidyList(movie.Spoken_languages, strings.TrimSpace)
+	movie.Countries = tidyList(movie.Countries, func(code string) string {
+		return strings.ToUpper(strings.TrimSpace(code))
+	})
+	movie.Production_companies = tidyList(movie.Production_companies, strings.TrimSpace)
+	movie.Genre_ids = tidyList(movie.Genre_ids, strings.TrimSpace)
+}
+
+// verifyGenresExist answers 400 when any of genreIds is not an existing genre,
+// and reports whether they all exist.
+func verifyGenresExist(c *gin.Context, genreIds []string) bool {
+	unknown, err := helper.UnknownGenres(genreIds)
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while checking the movie genres",
+				"error":   err.Error(),
+			},
+		)
+		return false
+	}
+
+	if len(unknown) > 0 {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "error",
+				"error":   "Unknown genre ids: " + strings.Join(unknown, ", "),
+			},
+		)
+		return false
+	}
+	return true
+}
+
+// genreQuery builds the filter for a comma separated list of genre IDs, where
+// match is any (the default) or all.
+func genreQuery(genreIds string, match string) (bson.M, error) {
+	return helper.GenreFilter(queryList(genreIds), strings.ToLower(strings.TrimSpace(match)))
+}
+
+// queryList splits a comma separated query value, dropping blanks and duplicates.
+func queryList(raw string) []string {
+	items := tidyList(strings.Split(raw, ","), strings.TrimSpace)
+	return slices.DeleteFunc(items, func(item string) bool { return item == "" })
+}
+
+// yearQuery parses an optional year query parameter. It answers with a 400
+// when the value isn't a year, and reports whether it is.
+func yearQuery(c *gin.Context, name string) (int, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return 0, true
+	}
+
+	year, err := strconv.Atoi(raw)
+	if err != nil || year < 1 || year > 9999 {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "error",
+				"error":   name + " must be a year",
+			},
+		)
+		return 0, false
+	}
+	return year, true
+}
+
+// ratingQuery parses an optional rating query parameter, nil when it is not
+// sent. It answers with a 400 when the value isn't a rating, and reports
+// whether it is.
+func ratingQuery(c *gin.Context, name string) (*float64, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil, true
+	}
+
+	rating, err := strconv.ParseFloat(raw, 64)
+	if err != nil || rating < 0 || rating > 10 {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "error",
+				"error":   name + " must be a number from 0 to 10",
+			},
+		)
+		return nil, false
+	}
+	return &rating, true
+}
+
+// tidyList applies clean to every item and drops duplicates. It never returns nil.
+func tidyList(items []string, clean func(string) string) []string {
+	tidied := []string{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		item = clean(item)
+		if !seen[item] {
+			seen[item] = true
+			tidied = append(tidied, item)
+		}
+	}
+	return tidied
+}
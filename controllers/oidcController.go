@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	helper "shive/helpers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OidcLogin sends the user to the identity provider to sign in.
+func OidcLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authURL, err := helper.StartOidcLogin()
+
+		if err == helper.ErrOidcNotConfigured {
+			c.JSON(
+				http.StatusNotFound,
+				gin.H{
+					"status":  http.StatusNotFound,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusBadGateway,
+				gin.H{
+					"status":  http.StatusBadGateway,
+					"message": "Error occurred while contacting the identity provider",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.Redirect(http.StatusFound, authURL)
+	}
+}
+
+// OidcCallback is where the identity provider sends the user back to. It answers
+// like Login: with a token pair, or with a challenge when local two-factor
+// authentication is on and the provider did not check a second factor.
+func OidcCallback() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if providerError := c.Query("error"); providerError != "" {
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{
+					"status":  http.StatusUnauthorized,
+					"message": helper.ErrOidcLoginFailed.Error(),
+					"error":   providerError + " " + c.Query("error_description"),
+				},
+			)
+			return
+		}
+
+		state, code := c.Query("state"), c.Query("code")
+
+		if state == "" || code == "" {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   "state and code are required",
+				},
+			)
+			return
+		}
+
+		user, mfa, err := helper.FinishOidcLogin(state, code)
+
+		if err != nil {
+			helper.Audit(c, helper.AuditOidcLogin, "", err)
+			status := http.StatusInternalServerError
+
+			switch {
+			case err == helper.ErrOidcNotConfigured:
+				status = http.StatusNotFound
+			case err == helper.ErrInvalidOidcState:
+				status = http.StatusBadRequest
+			case errors.Is(err, helper.ErrOidcLoginFailed):
+				status = http.StatusUnauthorized
+			case err == helper.ErrOidcEmailRequired:
+				status = http.StatusForbidden
+			case err == helper.ErrOidcAccountConflict, err == helper.ErrOidcUnverifiedAccount:
+				status = http.StatusConflict
+			}
+
+			c.JSON(
+				status,
+				gin.H{
+					"status":  status,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		helper.AuditAs(c, user.User_id, helper.AuditOidcLogin, *user.Email, nil)
+
+		if user.Totp_enabled && !mfa {
+			respondWithMfaChallenge(c, user)
+			return
+		}
+
+		respondWithLoginTokens(c, user, mfa)
+	}
+}
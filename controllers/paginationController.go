@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	helper "shive/helpers"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A list can be asked for at most this many items at once.
+const maxPageSize = 100
+
+// Pages by number or startIndex can skip at most this many items, deeper pages
+// have to follow next_cursor.
+const maxPageOffset = 10000
+
+// pageQuery reads which page of a list to return. Clients pass the next_cursor
+// of the previous page as `after` and the page size as `limit`. Clients that
+// page by number send `page` and `recordPerPage` instead, or a `startIndex`.
+// It answers with a 400 when more than one of `after`, `page` and `startIndex`
+// is sent or `page` or `startIndex` skip more than maxPageOffset items, and
+// reports whether it didn't.
+func pageQuery(c *gin.Context) (helper.Page, bool) {
+	positions := []string{}
+	for _, name := range []string{"after", "page", "startIndex"} {
+		if c.Query(name) != "" {
+			positions = append(positions, name)
+		}
+	}
+	if len(positions) > 1 {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "error",
+				"error":   "Send only one of " + strings.Join(positions, ", "),
+			},
+		)
+		return helper.Page{}, false
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit < 1 {
+		limit, err = strconv.Atoi(c.Query("recordPerPage"))
+	}
+	if err != nil || limit < 1 {
+		limit = 10
+	}
+	limit = min(limit, maxPageSize)
+
+	page := helper.Page{After: c.Query("after"), Limit: int64(limit)}
+	if page.After != "" {
+		return page, true
+	}
+
+	number, err := strconv.Atoi(c.Query("page"))
+	if err != nil || number < 1 {
+		number = 1
+	}
+	// Checked before multiplying, so a huge page can't overflow the offset
+	if number-1 > maxPageOffset/limit {
+		respondPageTooDeep(c)
+		return helper.Page{}, false
+	}
+	page.Offset = int64((number - 1) * limit)
+
+	if startIndex, err := strconv.Atoi(c.Query("startIndex")); err == nil && startIndex >= 0 {
+		if startIndex > maxPageOffset {
+			respondPageTooDeep(c)
+			return helper.Page{}, false
+		}
+		page.Offset = int64(startIndex)
+	}
+	return page, true
+}
+
+// respondPageTooDeep answers 400 for a page by number that skips too many items.
+func respondPageTooDeep(c *gin.Context) {
+	c.JSON(
+		http.StatusBadRequest,
+		gin.H{
+			"status":  http.StatusBadRequest,
+			"message": "error",
+			"error":   fmt.Sprintf("Pages by number can't start past item %d, follow next_cursor with after instead", maxPageOffset),
+		},
+	)
+}
+
+// respondInvalidCursor answers 400 for a cursor the list can't continue from,
+// and reports whether it did.
+func respondInvalidCursor(c *gin.Context, err error) bool {
+	if !errors.Is(err, helper.ErrInvalidCursor) {
+		return false
+	}
+	c.JSON(
+		http.StatusBadRequest,
+		gin.H{
+			"status":  http.StatusBadRequest,
+			"message": "error",
+			"error":   err.Error(),
+		},
+	)
+	return true
+}
+
+// setPageLinks sets an RFC 8288 Link header pointing at the first page of the
+// list and, unless this is the last page, at the next one.
+func setPageLinks(c *gin.Context, page helper.Page, next string) {
+	links := []string{pageLink(c, page, "", "first")}
+	if next != "" {
+		links = append(links, pageLink(c, page, next, "next"))
+	}
+	c.Header("Link", strings.Join(links, ", "))
+}
+
+func pageLink(c *gin.Context, page helper.Page, after string, rel string) string {
+	query := c.Request.URL.Query()
+	for _, name := range []string{"after", "limit", "page", "recordPerPage", "startIndex"} {
+		query.Del(name)
+	}
+	if after != "" {
+		query.Set("after", after)
+	}
+	query.Set("limit", strconv.FormatInt(page.Limit, 10))
+
+	link := url.URL{Path: c.Request.URL.Path, RawQuery: query.Encode()}
+	return fmt.Sprintf(`<%s>; rel="%s"`, link.String(), rel)
+}
@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	helper "shive/helpers"
+	"shive/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ForgotPassword emails a password reset link. It answers the same way whether or not
+// the email belongs to an account so it can't be used to discover users.
+func ForgotPassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Email *string `json:"email" validate:"required,email"`
+		}
+
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Error occurred while binding JSON",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if validationError := validate.Struct(&body); validationError != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   validationError.Error(),
+				},
+			)
+			return
+		}
+
+		accepted := gin.H{
+			"status":  http.StatusAccepted,
+			"message": "If an account exists for this email, a password reset link has been sent",
+		}
+
+		user, err := helper.FindUserByEmail(*body.Email)
+
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusAccepted, accepted)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while finding user",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		retryAfter, err := helper.PasswordResetRetryAfter(user.User_id, c.ClientIP())
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while checking recent password resets",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		// Answering 429 would tell who has an account
+		if retryAfter > 0 {
+			c.JSON(http.StatusAccepted, accepted)
+			return
+		}
+
+		token, err := helper.CreatePasswordResetToken(user.User_id, c.ClientIP())
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while creating a password reset token",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		err = helper.AppMailer.Send(helper.MailMessage{
+			To:      *user.Email,
+			Subject: "Reset your Shive password",
+			Body: fmt.Sprintf(
+				"Hi %s,\n\nUse the link below to choose a new password. It expires in %s and can only be used once.\n\n%s/reset-password?token=%s\n\nIf you did not ask for this, you can ignore this email.",
+				*user.Name,
+				helper.PASSWORD_RESET_TTL,
+				helper.APP_URL,
+				token,
+			),
+		})
+
+		if err != nil {
+			log.Printf("Error sending password reset email to user %s: %v", user.User_id, err)
+		}
+
+		c.JSON(http.StatusAccepted, accepted)
+	}
+}
+
+// ResetPassword sets a new password using a reset token and signs the user out everywhere.
+func ResetPassword() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var body struct {
+			Token    *string `json:"token" validate:"required"`
+			Password *string `json:"password" validate:"required"`
+		}
+
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Error occurred while binding JSON",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if validationError := validate.Struct(&body); validationError != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   validationError.Error(),
+				},
+			)
+			return
+		}
+
+		userId, err := helper.LookupPasswordResetToken(*body.Token)
+
+		if err == nil {
+			var user models.User
+			err = userCollection.FindOne(ctx, bson.M{"user_id": userId}).Decode(&user)
+
+			if err == mongo.ErrNoDocuments {
+				err = helper.ErrInvalidResetToken
+			} else if err == nil && !respondToPasswordPolicy(c, *body.Password, stringValue(user.Email), stringValue(user.Username)) {
+				return
+			}
+		}
+
+		if err == nil {
+			userId, err = helper.RedeemPasswordResetToken(*body.Token)
+		}
+
+		if err == helper.ErrInvalidResetToken {
+			helper.Audit(c, helper.AuditPasswordReset, "", err)
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while checking the password reset token",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		_, err = userCollection.UpdateOne(
+			ctx,
+			bson.M{"user_id": userId},
+			bson.M{"$set": bson.M{
+				"password":   MaskPassword(*body.Password),
+				"updated_at": time.Now(),
+			}},
+		)
+		helper.AuditAs(c, userId, helper.AuditPasswordReset, userId, err)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while updating password",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		// Whoever knew the old password should not stay signed in
+		if err := helper.RevokeAllUserTokens(userId); err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Password updated but existing sessions could not be revoked",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Password reset successfully! Please login with your new password",
+			},
+		)
+	}
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	helper "shive/helpers"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetPermissions lists every permission a role can be granted.
+func GetPermissions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		names := make([]string, 0, len(helper.Permissions))
+		for name := range helper.Permissions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		items := make([]gin.H, 0, len(names))
+		for _, name := range names {
+			items = append(items, gin.H{"permission": name, "description": helper.Permissions[name]})
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "success",
+				"data":    items,
+			},
+		)
+	}
+}
+
+// GetRoles lists every role with its permissions.
+func GetRoles() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policies, err := helper.ListRolePolicies()
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while listing roles",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "success",
+				"data":    policies,
+			},
+		)
+	}
+}
+
+// SaveRole creates the role in the path or replaces its permissions.
+func SaveRole() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !verifyNotApiKey(c) {
+			return
+		}
+
+		var body struct {
+			Description string   `json:"description" validate:"max=200"`
+			Permissions []string `json:"permissions" validate:"required"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		policy, created, err := helper.SaveRolePolicy(c.Param("role"), body.Description, body.Permissions, c.GetString("uid"), c.GetString("user_type"))
+		helper.Audit(c, helper.AuditRoleSave, c.Param("role"), err)
+
+		if err == helper.ErrInvalidRoleName || err == helper.ErrPolicyLockout || errors.Is(err, helper.ErrUnknownPermission) {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err == helper.ErrOutranked {
+			c.JSON(
+				http.StatusForbidden,
+				gin.H{
+					"status":  http.StatusForbidden,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while saving the role",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+
+		c.JSON(
+			status,
+			gin.H{
+				"status":  status,
+				"message": "Role saved, other instances pick it up within " + helper.ROLE_POLICY_CACHE_TTL.String(),
+				"data":    policy,
+			},
+		)
+	}
+}
+
+// DeleteRole removes a custom role that is no longer assigned to anyone.
+func DeleteRole() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !verifyNotApiKey(c) {
+			return
+		}
+
+		err := helper.DeleteRolePolicy(c.Param("role"))
+		helper.Audit(c, helper.AuditRoleDelete, c.Param("role"), err)
+
+		switch err {
+		case nil:
+		case helper.ErrUnknownRole:
+			c.JSON(
+				http.StatusNotFound,
+				gin.H{
+					"status":  http.StatusNotFound,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		case helper.ErrBuiltInRole, helper.ErrRoleInUse:
+			c.JSON(
+				http.StatusConflict,
+				gin.H{
+					"status":  http.StatusConflict,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		default:
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while deleting the role",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Role deleted",
+			},
+		)
+	}
+}
+
+// GetPermissionDecisions lists the newest permission decisions. They can be
+// narrowed down with the `uid`, `permission`, `allowed` and `since` (RFC 3339)
+// query parameters, and `limit` caps how many are returned.
+func GetPermissionDecisions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := helper.PermissionDecisionFilter{
+			Uid:        c.Query("uid"),
+			Permission: c.Query("permission"),
+			Limit:      50,
+		}
+
+		if allowed, err := strconv.ParseBool(c.Query("allowed")); err == nil {
+			filter.Allowed = &allowed
+		}
+
+		if since := c.Query("since"); since != "" {
+			parsed, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				c.JSON(
+					http.StatusBadRequest,
+					gin.H{
+						"status":  http.StatusBadRequest,
+						"message": "error",
+						"error":   "since must be an RFC 3339 timestamp",
+					},
+				)
+				return
+			}
+			filter.Since = parsed
+		}
+
+		if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 {
+			filter.Limit = int64(limit)
+			if filter.Limit > 500 {
+				filter.Limit = 500
+			}
+		}
+
+		decisions, err := helper.ListPermissionDecisions(filter)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while listing permission decisions",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "success",
+				"data":    decisions,
+			},
+		)
+	}
+}
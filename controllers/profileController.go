@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"net/http"
+	helper "shive/helpers"
+	"shive/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetMe returns the signed in user's own account.
+func GetMe() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := loadSignedInUser(c)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, profileOf(user))
+	}
+}
+
+// UpdateMe changes the signed in user's name or username.
+func UpdateMe() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Name     *string `json:"name" validate:"omitempty,min=4,max=100"`
+			Username *string `json:"username" validate:"omitempty,min=4,max=100"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		if body.Name == nil && body.Username == nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   "Send a name or a username to change",
+				},
+			)
+			return
+		}
+
+		user, err := helper.UpdateProfile(c.GetString("uid"), body.Name, body.Username)
+
+		if err == helper.ErrUsernameTaken {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Looks like this username already exists"})
+			return
+		}
+
+		if err == mongo.ErrNoDocuments {
+			c.JSON(
+				http.StatusNotFound,
+				gin.H{
+					"status":  http.StatusNotFound,
+					"message": "Oops account not found",
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while updating profile",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(http.StatusOK, profileOf(user))
+	}
+}
+
+// DeleteMe schedules the signed in user's account for deletion. Accounts with a
+// password have to confirm it.
+func DeleteMe() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Password *string `json:"password"`
+		}
+
+		// Single sign-on accounts have nothing to send
+		if c.Request.ContentLength != 0 && !bindBody(c, &body) {
+			return
+		}
+
+		user, ok := loadSignedInUser(c)
+		if !ok {
+			return
+		}
+
+		if user.Password != nil {
+			if body.Password == nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "password is required"})
+				return
+			}
+			if !verifyCurrentPassword(c, user, *body.Password) {
+				return
+			}
+		}
+
+		scheduleDeletion(c, user.User_id)
+	}
+}
+
+// CancelMyDeletion keeps the signed in user's account, unless an admin scheduled its deletion.
+func CancelMyDeletion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := loadSignedInUser(c)
+		if !ok {
+			return
+		}
+
+		if user.Deletion_requested_by != nil && *user.Deletion_requested_by != user.User_id {
+			c.JSON(
+				http.StatusForbidden,
+				gin.H{
+					"status": http.StatusForbidden,
+					"error":  "An admin scheduled this account for deletion, contact support to keep it",
+				},
+			)
+			return
+		}
+
+		cancelDeletion(c, user.User_id)
+	}
+}
+
+// DeleteUser schedules any user's account for deletion and signs them out.
+func DeleteUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheduleDeletion(c, c.Param("user_id"))
+	}
+}
+
+// CancelUserDeletion keeps any user's account that is still in its grace period.
+func CancelUserDeletion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cancelDeletion(c, c.Param("user_id"))
+	}
+}
+
+func scheduleDeletion(c *gin.Context, userId string) {
+	user, err := helper.ScheduleAccountDeletion(userId, c.GetString("uid"), c.GetString("user_type"))
+	helper.Audit(c, helper.AuditUserDelete, userId, err)
+
+	if err == helper.ErrOutranked {
+		c.JSON(
+			http.StatusForbidden,
+			gin.H{
+				"status":  http.StatusForbidden,
+				"message": "error",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	if err == helper.ErrDeletionAlreadyScheduled || err == helper.ErrLastAdmin {
+		c.JSON(
+			http.StatusConflict,
+			gin.H{
+				"status":  http.StatusConflict,
+				"message": "error",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(
+			http.StatusNotFound,
+			gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Oops account not found",
+			},
+		)
+		return
+	}
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while scheduling account deletion",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	c.JSON(
+		http.StatusAccepted,
+		gin.H{
+			"status":  http.StatusAccepted,
+			"message": "The account will be deleted once the grace period is over",
+			"data": gin.H{
+				"user_id":               user.User_id,
+				"deletion_scheduled_at": user.Deletion_scheduled_at,
+			},
+		},
+	)
+}
+
+func cancelDeletion(c *gin.Context, userId string) {
+	err := helper.CancelAccountDeletion(userId)
+	helper.Audit(c, helper.AuditUserRestore, userId, err)
+
+	if err == helper.ErrDeletionNotScheduled {
+		c.JSON(
+			http.StatusConflict,
+			gin.H{
+				"status":  http.StatusConflict,
+				"message": "error",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while cancelling account deletion",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"status":  http.StatusOK,
+			"message": "Account deletion cancelled",
+		},
+	)
+}
+
+// profileOf leaves the password hash out of a user returned to its owner.
+func profileOf(user *models.User) *models.User {
+	user.Password = nil
+	return user
+}
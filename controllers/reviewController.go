@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"log"
 	"net/http"
 	"shive/database"
 	"shive/helpers"
@@ -11,33 +12,20 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var reviewCollection = database.OpenCollection(database.Client, "review")
 
 func AddReview() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		err := helpers.VerifyUserType(c, "USER")
-
-		if err != nil {
-			c.JSON(
-				http.StatusUnauthorized,
-				gin.H{
-					"status":  http.StatusUnauthorized,
-					"error":   err.Error(),
-					"message": "Only users can add reviews",
-				},
-			)
-			return
-		}
-
 		var review models.Review
 		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
 
 		defer cancel()
 
 		//validate the request body
-		err = c.BindJSON(&review)
+		err := c.BindJSON(&review)
 
 		if err != nil {
 			c.JSON(
@@ -77,6 +65,7 @@ func AddReview() gin.HandlerFunc {
 			Review:      review.Review,
 			Review_id:   review.Review_id,
 			Reviewer_id: reviewId,
+			Rating:      review.Rating,
 			Updated_at:  currentTime,
 		}
 
@@ -94,6 +83,8 @@ func AddReview() gin.HandlerFunc {
 			return
 		}
 
+		refreshMovieRating(newReview.Movie_id)
+
 		c.JSON(
 			http.StatusCreated,
 			gin.H{
@@ -167,24 +158,10 @@ func GetAllMovieReviews() gin.HandlerFunc {
 func DeleteReviewByReviewId() gin.HandlerFunc {
 
 	return func(c *gin.Context) {
-		err := helpers.VerifyUserType(c, "USER")
-
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*100)
 
 		defer cancel()
 
-		if err != nil {
-			c.JSON(
-				http.StatusUnauthorized,
-				gin.H{
-					"status":  http.StatusUnauthorized,
-					"error":   err.Error(),
-					"message": "Only users can delete reviews",
-				},
-			)
-			return
-		}
-
 		reviewId := c.Param("review_id")
 
 		if reviewId == "" {
@@ -198,16 +175,35 @@ func DeleteReviewByReviewId() gin.HandlerFunc {
 			return
 		}
 
-		reviewerId := c.GetString("uid")
-
 		filter := bson.M{
 			"review_id":   reviewId,
-			"reviewer_id": reviewerId,
+			"reviewer_id": c.GetString("uid"),
 		}
 
-		result, err := reviewCollection.DeleteOne(ctx, filter)
+		// Moderators can delete anyone's review
+		canModerate, err := helpers.HasPermission(c.GetString("user_type"), helpers.PermReviewModerate)
 
 		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"error":   err.Error(),
+					"message": "Error occurred while checking permissions",
+				},
+			)
+			return
+		}
+
+		if canModerate {
+			delete(filter, "reviewer_id")
+		}
+
+		var deletedReview models.Review
+		err = reviewCollection.FindOneAndDelete(ctx, filter).Decode(&deletedReview)
+
+		if err != nil && err != mongo.ErrNoDocuments {
+			helpers.Audit(c, helpers.AuditReviewDelete, reviewId, err)
 			c.JSON(
 				http.StatusInternalServerError,
 				gin.H{
@@ -219,7 +215,7 @@ func DeleteReviewByReviewId() gin.HandlerFunc {
 			return
 		}
 
-		if result.DeletedCount < 1 {
+		if err == mongo.ErrNoDocuments {
 			c.JSON(
 				http.StatusNotFound,
 				gin.H{
@@ -231,6 +227,9 @@ func DeleteReviewByReviewId() gin.HandlerFunc {
 			return
 		}
 
+		helpers.Audit(c, helpers.AuditReviewDelete, reviewId, nil)
+		refreshMovieRating(deletedReview.Movie_id)
+
 		c.JSON(http.StatusOK,
 			gin.H{
 				"status":  http.StatusOK,
@@ -303,33 +302,30 @@ func AllUserReviews() gin.HandlerFunc {
 func EditReviews() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-		var review models.Review
 		defer cancel()
 
-		err := c.BindJSON(&review)
-		if err != nil {
+		// Fields left out keep their value, so editing the text keeps the rating
+		var body struct {
+			Review *string `json:"review"`
+			Rating *int    `json:"rating" validate:"omitnil,min=1,max=10"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		if body.Review == nil && body.Rating == nil {
 			c.JSON(
 				http.StatusBadRequest,
 				gin.H{
 					"status":  http.StatusBadRequest,
-					"message": "Error",
-					"error":   err.Error(),
+					"message": "error",
+					"error":   "Send a review, a rating or both",
 				},
 			)
 			return
 		}
 
-		if validationError := validate.Struct(&review); validationError != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"status":  http.StatusBadRequest,
-				"message": "Validator error: error with request body",
-				"error":   validationError.Error(),
-			},
-			)
-			return
-		}
-
 		// Write your code here
 		reviewId := c.Param("review_id")
 		reviewerId := c.GetString("uid")
@@ -351,13 +347,7 @@ func EditReviews() gin.HandlerFunc {
 			"reviewer_id": reviewerId,
 		}
 
-		result, err := reviewCollection.UpdateOne(ctx, filter,
-			bson.M{
-				"$set": bson.M{
-					"review":     review.Review,
-					"updated_at": time.Now(),
-				},
-			})
+		result, err := reviewCollection.UpdateOne(ctx, filter, helpers.ReviewEditUpdate(body.Review, body.Rating, time.Now()))
 
 		if err != nil {
 			c.JSON(
@@ -398,6 +388,8 @@ func EditReviews() gin.HandlerFunc {
 				return
 			}
 
+			refreshMovieRating(updatedReview.Movie_id)
+
 			c.JSON(http.StatusOK, gin.H{
 				"status":  http.StatusOK,
 				"message": "Review updated successfully!",
@@ -406,3 +398,11 @@ func EditReviews() gin.HandlerFunc {
 		}
 	}
 }
+
+// refreshMovieRating brings the average rating of a movie up to date after one
+// of its reviews changed. The review change stands even when this fails.
+func refreshMovieRating(movieId string) {
+	if err := helpers.RefreshMovieRating(movieId); err != nil {
+		log.Printf("Error refreshing the rating of movie %s: %v", movieId, err)
+	}
+}
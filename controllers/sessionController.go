@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"net/http"
+	helper "shive/helpers"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetMySessions lists the devices the signed in user is logged in on.
+func GetMySessions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		respondWithSessions(c, c.GetString("uid"))
+	}
+}
+
+// RevokeMySession signs one of the signed in user's devices out.
+func RevokeMySession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revokeSession(c, c.GetString("uid"))
+	}
+}
+
+// GetUserSessions lists the sessions of any user.
+func GetUserSessions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		respondWithSessions(c, c.Param("user_id"))
+	}
+}
+
+// RevokeUserSession signs any user out of one session.
+func RevokeUserSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revokeSession(c, c.Param("user_id"))
+	}
+}
+
+func respondWithSessions(c *gin.Context, userId string) {
+	sessions, err := helper.ListSessions(userId)
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while listing sessions",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	items := make([]gin.H, 0, len(sessions))
+	for _, session := range sessions {
+		items = append(items, gin.H{
+			"session_id":   session.Session_id,
+			"user_agent":   session.User_agent,
+			"ip":           session.Ip,
+			"created_at":   session.Created_at,
+			"last_seen_at": session.Last_seen_at,
+			"expires_at":   session.Expires_at,
+			"current":      session.Session_id == c.GetString("family_id"),
+		})
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"status":  http.StatusOK,
+			"message": "success",
+			"data":    items,
+		},
+	)
+}
+
+func revokeSession(c *gin.Context, userId string) {
+	err := helper.RevokeSession(userId, c.Param("session_id"))
+	helper.Audit(c, helper.AuditSessionRevoke, c.Param("session_id"), err)
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(
+			http.StatusNotFound,
+			gin.H{
+				"status":  http.StatusNotFound,
+				"message": "No active session with this id",
+			},
+		)
+		return
+	}
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while revoking the session",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"status":  http.StatusOK,
+			"message": "Session revoked",
+		},
+	)
+}
+
+// sessionClient describes the device the request came from.
+func sessionClient(c *gin.Context) helper.SessionClient {
+	return helper.SessionClient{User_agent: c.Request.UserAgent(), Ip: c.ClientIP()}
+}
@@ -0,0 +1,363 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	helper "shive/helpers"
+	"shive/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// EnrollTwoFactor starts TOTP enrollment for the signed in user. The returned
+// provisioning URI can be rendered as a QR code for an authenticator app.
+func EnrollTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret, provisioningURI, err := helper.EnrollTotp(c.GetString("uid"), c.GetString("email"))
+
+		if err == helper.ErrTotpAlreadyEnabled {
+			c.JSON(
+				http.StatusConflict,
+				gin.H{
+					"status":  http.StatusConflict,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while starting two-factor enrollment",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Scan the QR code with your authenticator app, then confirm with a code",
+				"data": map[string]string{
+					"secret":           secret,
+					"provisioning_uri": provisioningURI,
+				},
+			},
+		)
+	}
+}
+
+// ConfirmTwoFactor turns two-factor authentication on with a code from the
+// authenticator app and hands out the recovery codes.
+func ConfirmTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Code *string `json:"code" validate:"required"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		recoveryCodes, err := helper.ConfirmTotp(c.GetString("uid"), *body.Code)
+		helper.Audit(c, helper.AuditTwoFactorEnable, c.GetString("uid"), err)
+
+		switch err {
+		case nil:
+		case helper.ErrTotpAlreadyEnabled:
+			c.JSON(
+				http.StatusConflict,
+				gin.H{
+					"status":  http.StatusConflict,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		case helper.ErrTotpNotEnrolled, helper.ErrInvalidTotpCode:
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		default:
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while confirming two-factor authentication",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Two-factor authentication enabled! Store these recovery codes somewhere safe, they will not be shown again",
+				"data": map[string]interface{}{
+					"recovery_codes": recoveryCodes,
+				},
+			},
+		)
+	}
+}
+
+// DisableTwoFactor turns two-factor authentication off. It needs a current code
+// or a recovery code so a stolen session alone can not remove the second factor.
+func DisableTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var body struct {
+			Code *string `json:"code" validate:"required"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		var user models.User
+		err := userCollection.FindOne(ctx, bson.M{"user_id": c.GetString("uid")}).Decode(&user)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while finding user",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		err = helper.VerifySecondFactor(&user, *body.Code)
+
+		if err == helper.ErrTotpNotEnabled || err == helper.ErrInvalidTotpCode {
+			helper.Audit(c, helper.AuditTwoFactorOff, user.User_id, err)
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err == nil {
+			err = helper.DisableTotp(user.User_id)
+			helper.Audit(c, helper.AuditTwoFactorOff, user.User_id, err)
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while disabling two-factor authentication",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Two-factor authentication disabled",
+			},
+		)
+	}
+}
+
+// LoginTwoFactor finishes a login for users with two-factor authentication by
+// exchanging the challenge from Login and a TOTP or recovery code for a token pair.
+func LoginTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Challenge_token *string `json:"challenge_token" validate:"required"`
+			Code            *string `json:"code" validate:"required"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		claims, user, err := helper.ValidateMfaChallenge(*body.Challenge_token)
+
+		if err == helper.ErrInvalidMfaChallenge {
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"message": "Error occurred while checking the login challenge",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		// Wrong codes count towards the same limits as wrong passwords
+		clientIP := c.ClientIP()
+		retryAfter, err := helper.LoginRetryAfter(*user.Email, clientIP)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"message": "Error occurred while checking login attempts",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if retryAfter > 0 {
+			helper.AuditAs(c, user.User_id, helper.AuditLoginTwoFactor, *user.Email, errTooManyAttempts)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(
+				http.StatusTooManyRequests,
+				gin.H{
+					"message": "Too many failed login attempts, please try again later",
+					"error":   "too_many_attempts",
+				},
+			)
+			return
+		}
+
+		err = helper.VerifySecondFactor(user, *body.Code)
+
+		if err == helper.ErrInvalidTotpCode {
+			recordLoginFailure(c, helper.AuditLoginTwoFactor, *user.Email, err)
+
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"message": "Error occurred while checking the two-factor code",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		// A challenge can only be exchanged once
+		if err := helper.RevokeToken(claims.Id, "", user.User_id, claims.ExpiresAt); err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"message": "Error occurred while closing the login challenge",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err := helper.ClearLoginFailures(*user.Email); err != nil {
+			log.Printf("Error clearing failed logins: %v", err)
+		}
+
+		helper.AuditAs(c, user.User_id, helper.AuditLoginTwoFactor, *user.Email, nil)
+		respondWithLoginTokens(c, user, true)
+	}
+}
+
+// respondWithMfaChallenge answers a login for a user with two-factor authentication
+// with a challenge that has to be exchanged at /users/login/2fa.
+func respondWithMfaChallenge(c *gin.Context, user *models.User) {
+	challenge, err := helper.GenerateMfaChallenge(user)
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"message": "Error occurred while creating the login challenge",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"status":  http.StatusOK,
+			"message": "Enter the code from your authenticator app to finish signing in",
+			"data": gin.H{
+				"mfa_required":    true,
+				"challenge_token": challenge,
+				"expires_in":      int(helper.MFA_CHALLENGE_TTL.Seconds()),
+			},
+		},
+	)
+}
+
+// bindBody binds and validates the JSON body, answering with a 400 when it is not usable.
+func bindBody(c *gin.Context, body interface{}) bool {
+	if err := c.BindJSON(body); err != nil {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "Error occurred while binding JSON",
+				"error":   err.Error(),
+			},
+		)
+		return false
+	}
+
+	if validationError := validate.Struct(body); validationError != nil {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{
+				"status":  http.StatusBadRequest,
+				"message": "error",
+				"error":   validationError.Error(),
+			},
+		)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"net/http"
+	helper "shive/helpers"
+	"shive/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ChangeUserRole gives a user another role. The user is signed out so the new
+// role applies from their next login.
+func ChangeUserRole() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !verifyNotApiKey(c) {
+			return
+		}
+
+		var body struct {
+			User_type *string `json:"user_type" validate:"required,min=2,max=32"`
+			Reason    string  `json:"reason" validate:"max=500"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		user, err := helper.ChangeUserRole(c.Param("user_id"), *body.User_type, c.GetString("uid"), c.GetString("user_type"), body.Reason)
+		helper.Audit(c, helper.AuditUserRoleChange, c.Param("user_id"), err)
+
+		if err == helper.ErrUnknownRole {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   err.Error() + ": " + *body.User_type,
+				},
+			)
+			return
+		}
+
+		respondWithAdministeredUser(c, user, err, "Role changed")
+	}
+}
+
+// SuspendUser blocks a user until `until`, or for `duration` such as `72h`.
+// Tokens they already hold stop working straight away.
+func SuspendUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !verifyNotApiKey(c) {
+			return
+		}
+
+		var body struct {
+			Reason   *string    `json:"reason" validate:"required,min=3,max=500"`
+			Until    *time.Time `json:"until"`
+			Duration *string    `json:"duration"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		var until time.Time
+		switch {
+		case body.Until != nil && body.Duration == nil:
+			until = *body.Until
+		case body.Duration != nil && body.Until == nil:
+			duration, err := time.ParseDuration(*body.Duration)
+			if err != nil {
+				c.JSON(
+					http.StatusBadRequest,
+					gin.H{
+						"status":  http.StatusBadRequest,
+						"message": "error",
+						"error":   "duration must look like 72h or 30m",
+					},
+				)
+				return
+			}
+			until = time.Now().Add(duration)
+		default:
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   "Send either until or duration, or ban the user instead",
+				},
+			)
+			return
+		}
+
+		if !until.After(time.Now()) {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   "The suspension must end in the future",
+				},
+			)
+			return
+		}
+
+		user, err := helper.SuspendUser(c.Param("user_id"), &until, c.GetString("uid"), c.GetString("user_type"), *body.Reason)
+		helper.Audit(c, helper.AuditUserSuspend, c.Param("user_id"), err)
+		respondWithAdministeredUser(c, user, err, "User suspended")
+	}
+}
+
+// BanUser blocks a user until they are reinstated.
+func BanUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !verifyNotApiKey(c) {
+			return
+		}
+
+		var body struct {
+			Reason *string `json:"reason" validate:"required,min=3,max=500"`
+		}
+
+		if !bindBody(c, &body) {
+			return
+		}
+
+		user, err := helper.SuspendUser(c.Param("user_id"), nil, c.GetString("uid"), c.GetString("user_type"), *body.Reason)
+		helper.Audit(c, helper.AuditUserBan, c.Param("user_id"), err)
+		respondWithAdministeredUser(c, user, err, "User banned")
+	}
+}
+
+// ReinstateUser lifts a suspension or ban.
+func ReinstateUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Reason string `json:"reason" validate:"max=500"`
+		}
+
+		// The reason is optional, so is the body
+		if c.Request.ContentLength != 0 && !bindBody(c, &body) {
+			return
+		}
+
+		user, err := helper.ReinstateUser(c.Param("user_id"), c.GetString("uid"), c.GetString("user_type"), body.Reason)
+		helper.Audit(c, helper.AuditUserReinstate, c.Param("user_id"), err)
+
+		if err == helper.ErrNotSuspended {
+			c.JSON(
+				http.StatusConflict,
+				gin.H{
+					"status":  http.StatusConflict,
+					"message": "error",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		respondWithAdministeredUser(c, user, err, "User reinstated")
+	}
+}
+
+// GetUserAdminActions lists the role changes, suspensions, bans and reinstatements of a user.
+func GetUserAdminActions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		actions, err := helper.ListUserAdminActions(c.Param("user_id"))
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while listing admin actions",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "success",
+				"data":    actions,
+			},
+		)
+	}
+}
+
+func respondWithAdministeredUser(c *gin.Context, user *models.User, err error, message string) {
+	if err == helper.ErrSelfAdminAction || err == helper.ErrOutranked {
+		c.JSON(
+			http.StatusForbidden,
+			gin.H{
+				"status":  http.StatusForbidden,
+				"message": "error",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	if err == helper.ErrLastAdmin {
+		c.JSON(
+			http.StatusConflict,
+			gin.H{
+				"status":  http.StatusConflict,
+				"message": "error",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	if err == mongo.ErrNoDocuments {
+		c.JSON(
+			http.StatusNotFound,
+			gin.H{
+				"status":  http.StatusNotFound,
+				"message": "Oops account not found",
+			},
+		)
+		return
+	}
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"status":  http.StatusInternalServerError,
+				"message": "Error occurred while updating user",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	c.JSON(
+		http.StatusOK,
+		gin.H{
+			"status":  http.StatusOK,
+			"message": message,
+			"data":    profileOf(user),
+		},
+	)
+}
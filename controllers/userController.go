@@ -2,8 +2,10 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"shive/database"
 	helper "shive/helpers"
@@ -22,13 +24,44 @@ import (
 var userCollection *mongo.Collection = database.OpenCollection(database.Client, "user")
 var validate = validator.New()
 
-// The function `MaskPassword` generates a bcrypt hash from a given password.
+// Reasons written to the audit log for failed sign ins
+var (
+	errTooManyAttempts = errors.New("too many failed attempts")
+	errWrongPassword   = errors.New("wrong password")
+)
+
+// The function `MaskPassword` generates a bcrypt hash from a given password using the configured `BCRYPT_COST`.
 func MaskPassword(password string) string {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	hash, err := helper.HashPassword(password)
 	if err != nil {
 		log.Panic(err)
 	}
-	return string(bytes)
+	return hash
+}
+
+// respondToPasswordPolicy answers with a 400 listing the broken rules when the password
+// does not meet the policy, and reports whether it did.
+func respondToPasswordPolicy(c *gin.Context, password string, email string, username string) bool {
+	err := helper.CheckPasswordPolicy(password, email, username)
+	if err == nil {
+		return true
+	}
+
+	var policyError *helper.PasswordPolicyError
+	if !errors.As(err, &policyError) {
+		policyError = &helper.PasswordPolicyError{Problems: []string{err.Error()}}
+	}
+
+	c.JSON(
+		http.StatusBadRequest,
+		gin.H{
+			"status":   http.StatusBadRequest,
+			"message":  "This password does not meet the password policy",
+			"error":    policyError.Error(),
+			"problems": policyError.Problems,
+		},
+	)
+	return false
 }
 
 func Signup() gin.HandlerFunc {
@@ -47,27 +80,49 @@ func Signup() gin.HandlerFunc {
 			return
 		}
 
-		//Check to see if name exists
-		regexMatch := bson.M{"$regex": primitive.Regex{Pattern: *user.Email, Options: "i"}}
-		emailCount, emailErr := userCollection.CountDocuments(ctx, bson.M{"email": regexMatch})
-		usernameMatch := bson.M{"$regex": primitive.Regex{Pattern: *user.Username, Options: "i"}}
-		usernameCount, usernameErr := userCollection.CountDocuments(ctx, bson.M{"username": usernameMatch})
+		// Anyone can sign up, so nobody picks their own role. Other roles are
+		// given through invites or by an admin.
+		userType := helper.DefaultSignupRole
+		user.User_type = &userType
 
-		defer cancel()
-		if emailErr != nil {
-			log.Panic(emailErr)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "error occurred while checking for this email"})
+		//Check to see if data being passed meets the requirements. The password
+		// policy checks the password itself below.
+		if validationError := validate.StructExcept(&user, "Password"); validationError != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"Status":  http.StatusBadRequest,
+				"Message": "error",
+				"Data":    map[string]interface{}{"data": validationError.Error()}})
+			return
 		}
-		if emailCount > 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Looks like this email already exists", "count": emailCount})
+
+		// Check to see if the email or username is taken, the same check the account
+		// change endpoints use
+		emailTaken, err := helper.EmailInUse(*user.Email, "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occurred while checking for this email"})
+			return
+		}
+		if emailTaken {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Looks like this email already exists"})
+			return
+		}
+
+		usernameTaken, err := helper.UsernameInUse(*user.Username, "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "error occurred while checking for this username"})
+			return
+		}
+		if usernameTaken {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Looks like this username already exists"})
 			return
 		}
-		if usernameErr != nil {
-			log.Panic(usernameErr)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "error occurred while checking for this email / username"})
+
+		if user.Password == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "password is required"})
+			return
 		}
-		if usernameCount > 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Looks like this username already exists", "count": usernameCount})
+
+		if !respondToPasswordPolicy(c, *user.Password, *user.Email, *user.Username) {
 			return
 		}
 
@@ -80,48 +135,40 @@ func Signup() gin.HandlerFunc {
 		user.User_id = user.ID.Hex()
 
 		//Sign details to token
-		token, refreshToken, _ := helper.GenerateAllTokens(
+		token, refreshToken, err := helper.GenerateAllTokens(
 			*user.Email,
 			*user.Name,
 			*user.Username,
 			*user.User_type,
-			*&user.User_id)
-		user.Token = &token
-		user.Refresh_token = &refreshToken
-
-		//Check to see if data being passed meets the requirements
-		if validationError := validate.Struct(&user); validationError != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"Status":  http.StatusBadRequest,
-				"Message": "error",
-				"Data":    map[string]interface{}{"data": validationError.Error()}})
-			return
-		}
-
-		if validationError := validate.Struct(&user); validationError != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"Status":  http.StatusBadRequest,
-				"Message": "error",
-				"Data":    map[string]interface{}{"data": validationError.Error()}})
+			*&user.User_id,
+			user.Token_version,
+			false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"Status":  http.StatusInternalServerError,
+				"Message": "Error occurred while signing tokens",
+				"Data":    map[string]interface{}{"data": err.Error()}})
 			return
 		}
+		user.Token = &token
+		user.Refresh_token = &refreshToken
 
 		//To add a new user to the database
 		newUser := models.User{
-			ID:            user.ID,
-			User_id:       user.ID.Hex(),
-			Name:          user.Name,
-			Username:      user.Username,
-			Email:         user.Email,
-			Password:      user.Password,
-			Created_at:    user.Created_at,
-			Updated_at:    user.Updated_at,
-			Token:         user.Token,
-			User_type:     user.User_type,
-			Refresh_token: user.Refresh_token,
+			ID:         user.ID,
+			User_id:    user.ID.Hex(),
+			Name:       user.Name,
+			Username:   user.Username,
+			Email:      user.Email,
+			Password:   user.Password,
+			Created_at: user.Created_at,
+			Updated_at: user.Updated_at,
+			User_type:  user.User_type,
+			// New accounts have to prove they own their email
+			Email_verified: false,
 		}
 
-		_, err := userCollection.InsertOne(ctx, newUser)
+		_, err = userCollection.InsertOne(ctx, newUser)
 
 		//Error messages
 		if err != nil {
@@ -132,13 +179,28 @@ func Signup() gin.HandlerFunc {
 			return
 		}
 
+		// Register the refresh token and the session it starts
+		if _, err := helper.UpdateTokens(token, refreshToken, newUser.User_id, sessionClient(c)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"Status":  http.StatusInternalServerError,
+				"Message": "error",
+				"Data":    map[string]interface{}{"data": err.Error()}})
+			return
+		}
+
+		helper.AuditAs(c, newUser.User_id, helper.AuditSignup, newUser.User_id, nil)
+
+		if err := helper.SendVerificationEmail(newUser.User_id, *newUser.Name, *newUser.Email); err != nil {
+			log.Printf("Error sending verification email to user %s: %v", newUser.User_id, err)
+		}
+
 		c.JSON(http.StatusCreated, gin.H{
 			"status":  http.StatusCreated,
-			"message": "User created successfully!",
+			"message": "User created successfully! Please check your inbox to verify your email",
 			"data": map[string]string{
 				"user_id":       newUser.User_id,
-				"token":         *newUser.Token,
-				"refresh_token": *newUser.Refresh_token,
+				"token":         token,
+				"refresh_token": refreshToken,
 				"name":          *newUser.Name,
 				"username":      *newUser.Username,
 				"email":         *newUser.Email,
@@ -184,17 +246,61 @@ func Login() gin.HandlerFunc {
 					"error":   err.Error(),
 				},
 			)
+			return
+		}
+
+		if user.Email == nil || user.Password == nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"message": "Email and password are required",
+					"error":   "invalid credentials",
+				},
+			)
+			return
+		}
+
+		// Slow down and then lock out repeated failures for this account or client
+		clientIP := c.ClientIP()
+		retryAfter, err := helper.LoginRetryAfter(*user.Email, clientIP)
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"message": "Error occurred while checking login attempts",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if retryAfter > 0 {
+			helper.AuditAs(c, "", helper.AuditLogin, *user.Email, errTooManyAttempts)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(
+				http.StatusTooManyRequests,
+				gin.H{
+					"message": "Too many failed login attempts, please try again later",
+					"error":   "too_many_attempts",
+				},
+			)
+			return
 		}
 
 		// This line of code is querying the `userCollection` (which is a MongoDB collection) to find a
 		// document that matches the specified filter criteria. In this case, it is looking for a document
 		// where the value of the "email" field matches the email provided in the `user` struct.
-		err := userCollection.FindOne(ctx, bson.M{
+		err = userCollection.FindOne(ctx, bson.M{
 			"email": user.Email,
 		}).Decode(
 			&retrievedUser,
 		)
 
+		if err == mongo.ErrNoDocuments {
+			recordLoginFailure(c, helper.AuditLogin, *user.Email, errors.New("no account with this email"))
+		}
+
 		if err != nil {
 			c.JSON(
 				http.StatusBadRequest,
@@ -206,17 +312,34 @@ func Login() gin.HandlerFunc {
 			return
 		}
 
+		// Accounts created through single sign-on have no password to check
+		if retrievedUser.Password == nil {
+			recordLoginFailure(c, helper.AuditLogin, *user.Email, errors.New("the account signs in with single sign-on"))
+
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"message": "This account signs in with single sign-on",
+					"error":   "invalid credentials",
+				},
+			)
+			return
+		}
+
 		passwordIsValid, msg := ConfirmPassword(*user.Password, *retrievedUser.Password)
 
 		defer cancel()
 		if !passwordIsValid {
+			recordLoginFailure(c, helper.AuditLogin, *user.Email, errWrongPassword)
+
 			c.JSON(
 				http.StatusBadRequest,
 				gin.H{
 					"message": msg,
-					"error":   err.Error(),
+					"error":   "invalid credentials",
 				},
 			)
+			return
 		}
 
 		if retrievedUser.Email == nil {
@@ -224,34 +347,243 @@ func Login() gin.HandlerFunc {
 				http.StatusBadRequest,
 				gin.H{
 					"message": "Oops account not found",
+					"error":   "invalid credentials",
+				},
+			)
+			return
+		}
+
+		// Upgrade hashes made with an older cost while the plain password is at hand
+		if helper.PasswordNeedsRehash(*retrievedUser.Password) {
+			if hash, err := helper.HashPassword(*user.Password); err != nil {
+				log.Printf("Error rehashing password for user %s: %v", retrievedUser.User_id, err)
+			} else if _, err := userCollection.UpdateOne(
+				ctx,
+				bson.M{"user_id": retrievedUser.User_id, "password": *retrievedUser.Password},
+				bson.M{"$set": bson.M{"password": hash}},
+			); err != nil {
+				log.Printf("Error storing rehashed password for user %s: %v", retrievedUser.User_id, err)
+			}
+		}
+
+		helper.AuditAs(c, retrievedUser.User_id, helper.AuditLogin, *user.Email, nil)
+
+		// With two-factor authentication on, the password only earns a challenge that
+		// has to be exchanged together with a code at /users/login/2fa
+		if retrievedUser.Totp_enabled {
+			respondWithMfaChallenge(c, &retrievedUser)
+			return
+		}
+
+		if err := helper.ClearLoginFailures(*user.Email); err != nil {
+			log.Printf("Error clearing failed logins: %v", err)
+		}
+
+		respondWithLoginTokens(c, &retrievedUser, false)
+	}
+}
+
+// recordLoginFailure counts a failed sign in against the email and client IP
+// and writes it to the audit log.
+func recordLoginFailure(c *gin.Context, action string, email string, reason error) {
+	if err := helper.RecordLoginFailure(email, c.ClientIP()); err != nil {
+		log.Printf("Error recording failed login: %v", err)
+	}
+	// Signed in callers confirming their password are recorded as the actor
+	helper.Audit(c, action, email, reason)
+}
+
+// respondWithLoginTokens signs a new token pair for the user and answers with the updated user.
+// Suspended and banned users are refused.
+func respondWithLoginTokens(c *gin.Context, user *models.User, mfa bool) {
+	if !verifyAccountUsable(c, user) {
+		return
+	}
+
+	// Sign the stored details, never the ones sent with the login request
+	token, refreshedToken, err := helper.GenerateAllTokens(
+		*user.Email,
+		*user.Name,
+		*user.Username,
+		*user.User_type,
+		user.User_id,
+		user.Token_version,
+		mfa,
+	)
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"message": "Error occurred while signing tokens",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	updatedUser, err := helper.UpdateTokens(token, refreshedToken, user.User_id, sessionClient(c))
+
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"message": "Error occurred while updating tokens",
+				"error":   err.Error(),
+			},
+		)
+		return
+	}
+
+	c.JSON(
+		http.StatusOK,
+		profileOf(updatedUser),
+	)
+}
+
+// RefreshToken exchanges a valid refresh token for a new access and refresh token pair.
+// The refresh token that was sent is rotated out and can not be used again.
+func RefreshToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Refresh_token *string `json:"refresh_token" validate:"required"`
+		}
+
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "Error occurred while binding JSON",
 					"error":   err.Error(),
 				},
 			)
+			return
 		}
 
-		token, refreshedToken, _ := helper.GenerateAllTokens(
-			*user.Email,
-			*user.Name,
-			*retrievedUser.Username,
-			*user.User_type,
-			retrievedUser.User_id,
+		if validationError := validate.Struct(&body); validationError != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{
+					"status":  http.StatusBadRequest,
+					"message": "error",
+					"error":   validationError.Error(),
+				},
+			)
+			return
+		}
+
+		token, refreshToken, err := helper.RotateRefreshToken(*body.Refresh_token, sessionClient(c))
+
+		if err == helper.ErrAccountSuspended || err == helper.ErrAccountBanned {
+			c.JSON(
+				http.StatusForbidden,
+				gin.H{
+					"status":  http.StatusForbidden,
+					"message": "Unable to refresh token",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if errors.Is(err, helper.ErrInvalidRefreshToken) || errors.Is(err, helper.ErrRefreshTokenReused) {
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{
+					"status":  http.StatusUnauthorized,
+					"message": "Unable to refresh token",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while refreshing tokens",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Token refreshed successfully!",
+				"data": map[string]string{
+					"token":         token,
+					"refresh_token": refreshToken,
+				},
+			},
 		)
+	}
+}
 
-		updatedUser, err := helper.UpdateTokens(token, refreshedToken, user.User_id)
-		// TODO: get the details from updateTokens method
-		updatedUser.Email = retrievedUser.Email
-		updatedUser.Name = retrievedUser.Name
-		updatedUser.Username = retrievedUser.Username
-		updatedUser.User_id = retrievedUser.User_id
-		updatedUser.User_type = retrievedUser.User_type
+// Logout revokes the access token used for the request together with the
+// refresh tokens that were issued from the same login.
+func Logout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := helper.RevokeToken(
+			c.GetString("token_id"),
+			c.GetString("family_id"),
+			c.GetString("uid"),
+			c.GetInt64("token_expires_at"),
+		)
+		helper.Audit(c, helper.AuditLogout, c.GetString("family_id"), err)
 
-		defer cancel()
+		if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while logging out",
+					"error":   err.Error(),
+				},
+			)
+			return
+		}
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "Logged out successfully!",
+			},
+		)
+	}
+}
+
+// RevokeUserSessions lets an admin invalidate every token a user currently holds.
+func RevokeUserSessions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := c.Param("user_id")
+
+		err := helper.RevokeAllUserTokens(userId)
+		helper.Audit(c, helper.AuditSessionRevoke, userId, err)
+
+		if err == mongo.ErrNoDocuments {
+			c.JSON(
+				http.StatusNotFound,
+				gin.H{
+					"status":  http.StatusNotFound,
+					"message": "User with specified ID not found!",
+				},
+			)
+			return
+		}
 
 		if err != nil {
 			c.JSON(
 				http.StatusInternalServerError,
 				gin.H{
-					"message": "Error occurred while updating tokens",
+					"status":  http.StatusInternalServerError,
+					"message": "Error occurred while revoking sessions",
 					"error":   err.Error(),
 				},
 			)
@@ -260,7 +592,10 @@ func Login() gin.HandlerFunc {
 
 		c.JSON(
 			http.StatusOK,
-			updatedUser,
+			gin.H{
+				"status":  http.StatusOK,
+				"message": "All sessions for this user have been revoked",
+			},
 		)
 	}
 }
@@ -269,6 +604,12 @@ func GetUser() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userId := c.Param("user_id")
 
+		if err := helper.MatchToUid(c, userId, helper.PermUserRead); err != nil {
+			status := helper.AuthorizeStatus(err)
+			c.JSON(status, gin.H{"status": status, "error": err.Error()})
+			return
+		}
+
 		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
 
 		var user models.User
@@ -279,6 +620,17 @@ func GetUser() gin.HandlerFunc {
 
 		defer cancel()
 
+		if err == mongo.ErrNoDocuments {
+			c.JSON(
+				http.StatusNotFound,
+				gin.H{
+					"status":  http.StatusNotFound,
+					"message": "Oops account not found",
+				},
+			)
+			return
+		}
+
 		if err != nil {
 			c.JSON(
 				http.StatusInternalServerError,
@@ -286,92 +638,31 @@ func GetUser() gin.HandlerFunc {
 					"error": err.Error(),
 				},
 			)
+			return
 		}
 
 		c.JSON(
 			http.StatusOK,
-			user,
+			profileOf(&user),
 		)
 	}
 }
 
+// GetUsers lists a page of users in the order they signed up. See pageQuery
+// for the paging parameters.
 func GetUsers() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if err := helper.VerifyUserType(c, "ADMIN"); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		page, ok := pageQuery(c)
+		if !ok {
 			return
 		}
 
-		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-		recordPerPage, err := strconv.Atoi(c.Query("recordPerPage"))
-
-		if err != nil || recordPerPage < 1 {
-			recordPerPage = 10
-		}
-
-		page, err1 := strconv.Atoi(c.Query("page"))
-
-		if err1 != nil || page < 1 {
-			page = 1
-		}
-
-		startIndex := (page - 1) * recordPerPage
-		startIndex, err = strconv.Atoi(c.Query("startIndex"))
-
-		matchStage := bson.D{{Key: "$match", Value: bson.D{{}}}}
-		groupStage := bson.D{
-			{
-				Key: "$group", Value: bson.D{
-					{
-						Key: "_id", Value: bson.D{
-							{
-								Key: "_id", Value: "null",
-							},
-						},
-					},
-					{
-						Key: "total_count",
-						Value: bson.D{
-							{
-								Key: "$sum", Value: 1,
-							},
-						},
-					},
-					{
-						Key: "data", Value: bson.D{
-							{
-								Key:   "$push",
-								Value: "$$ROOT",
-							},
-						},
-					},
-				},
-			},
-		}
-		projectStage := bson.D{
-			{
-				Key: "$project", Value: bson.D{
-					{
-						Key: "_id", Value: 0,
-					},
-					{
-						Key: "total_count", Value: 1,
-					},
-					{
-						Key: "user_items", Value: bson.D{
-							{
-								Key:   "$slice",
-								Value: []interface{}{"$data", startIndex, recordPerPage},
-							},
-						},
-					},
-				},
-			},
+		users, total, next, err := helper.ListUsers(page)
+
+		if respondInvalidCursor(c, err) {
+			return
 		}
-		result, err := userCollection.Aggregate(ctx, mongo.Pipeline{
-			matchStage, groupStage, projectStage})
 
-		defer cancel()
 		if err != nil {
 			c.JSON(
 				http.StatusInternalServerError,
@@ -379,12 +670,23 @@ func GetUsers() gin.HandlerFunc {
 					"error": "error occurred while listing user items",
 				},
 			)
+			return
 		}
-		var allusers []bson.M
-		if err = result.All(ctx, &allusers); err != nil {
-			log.Fatal(err)
+
+		for i := range users {
+			profileOf(&users[i])
 		}
-		c.JSON(http.StatusOK, allusers[0])
+
+		setPageLinks(c, page, next)
+
+		c.JSON(
+			http.StatusOK,
+			gin.H{
+				"total_count": total,
+				"user_items":  users,
+				"next_cursor": next,
+			},
+		)
 	}
 }
 
@@ -483,3 +785,21 @@ func CreateUser() gin.HandlerFunc {
 		)
 	}
 }
+
+// verifyAccountUsable answers with a 403 when the user is suspended or banned.
+func verifyAccountUsable(c *gin.Context, user *models.User) bool {
+	if err := helper.AccountRestriction(user, time.Now()); err != nil {
+		helper.AuditAs(c, user.User_id, helper.AuditTokenIssue, user.User_id, err)
+		c.JSON(
+			http.StatusForbidden,
+			gin.H{
+				"status":          http.StatusForbidden,
+				"error":           err.Error(),
+				"reason":          user.Suspension_reason,
+				"suspended_until": user.Suspended_until,
+			},
+		)
+		return false
+	}
+	return true
+}
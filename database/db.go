@@ -13,12 +13,15 @@ import (
 )
 
 func StartDB() *mongo.Client {
-	err := godotenv.Load(".env")
-	if err != nil {
+	// The environment can also come from the process, as in tests and containers
+	if err := godotenv.Load(".env"); err != nil && !os.IsNotExist(err) {
 		log.Fatal("Error Loading the .env file")
 	}
 
 	MongoDB := os.Getenv("MONGOURI")
+	if MongoDB == "" {
+		MongoDB = "mongodb://localhost:27017"
+	}
 
 	client, err := mongo.NewClient(options.Client().ApplyURI(MongoDB))
 	if err != nil {
@@ -49,3 +52,28 @@ func OpenCollection(client *mongo.Client, collectionName string) *mongo.Collecti
 	var collection *mongo.Collection = client.Database(MONGO_DB_NAME).Collection(collectionName)
 	return collection
 }
+
+var pendingIndexes []collectionIndexes
+
+type collectionIndexes struct {
+	collection *mongo.Collection
+	indexes    []mongo.IndexModel
+}
+
+// EnsureIndexes registers indexes for CreateIndexes to create on startup.
+// Packages call it from init, which has to work without a database.
+func EnsureIndexes(collection *mongo.Collection, indexes []mongo.IndexModel) {
+	pendingIndexes = append(pendingIndexes, collectionIndexes{collection, indexes})
+}
+
+// CreateIndexes creates the indexes registered with EnsureIndexes. Failures are
+// logged rather than fatal so the API can still start against a read-only replica.
+func CreateIndexes() {
+	for _, pending := range pendingIndexes {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if _, err := pending.collection.Indexes().CreateMany(ctx, pending.indexes); err != nil {
+			log.Printf("Error creating indexes on %s: %v", pending.collection.Name(), err)
+		}
+		cancel()
+	}
+}
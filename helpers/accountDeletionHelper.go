@@ -0,0 +1,281 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrDeletionAlreadyScheduled = errors.New("this account is already scheduled for deletion")
+	ErrDeletionNotScheduled     = errors.New("this account is not scheduled for deletion")
+)
+
+// What happens to a deleted user's reviews.
+const (
+	DeletedReviewsAnonymize = "anonymize"
+	DeletedReviewsDelete    = "delete"
+)
+
+// AnonymousReviewerId replaces the reviewer of anonymised reviews.
+const AnonymousReviewerId = "deleted-user"
+
+// ACCOUNT_DELETION_GRACE is how long a deletion can be cancelled before the account is removed.
+var ACCOUNT_DELETION_GRACE time.Duration = durationOrDefault("ACCOUNT_DELETION_GRACE", 14*24*time.Hour)
+
+// ACCOUNT_DELETION_REVIEWS decides whether a deleted user's reviews are anonymised or deleted.
+var ACCOUNT_DELETION_REVIEWS string = deletedReviewsPolicyOrDefault("ACCOUNT_DELETION_REVIEWS", DeletedReviewsAnonymize)
+
+// ACCOUNT_DELETION_SWEEP_INTERVAL is how often accounts past their grace period are looked for.
+var ACCOUNT_DELETION_SWEEP_INTERVAL time.Duration = durationOrDefault("ACCOUNT_DELETION_SWEEP_INTERVAL", time.Hour)
+
+// An instance has this long to finish removing an account before another may retry it.
+const accountDeletionLease = 10 * time.Minute
+
+var reviewCollection *mongo.Collection = database.OpenCollection(database.Client, "review")
+
+// ScheduleAccountDeletion starts the grace period after which the account is removed.
+// Deletions requested by someone else also sign the user out everywhere. The
+// requester's role has to cover the user's, and the last ADMIN can't be deleted.
+func ScheduleAccountDeletion(userId string, requestedBy string, requesterRole string) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	target, err := administeredUser(ctx, userId, requesterRole)
+	if err != nil {
+		return nil, err
+	}
+	if target.Deletion_scheduled_at != nil {
+		return nil, ErrDeletionAlreadyScheduled
+	}
+	if target.User_type != nil && *target.User_type == AdminRole {
+		if err := verifyNotLastAdmin(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	returnDocument := options.After
+	var user models.User
+	err = userCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"user_id": userId, "deletion_scheduled_at": nil},
+		bson.M{"$set": bson.M{
+			"deletion_requested_at": now,
+			"deletion_requested_by": requestedBy,
+			"deletion_scheduled_at": now.Add(ACCOUNT_DELETION_GRACE),
+			"updated_at":            now,
+		}},
+		&options.FindOneAndUpdateOptions{ReturnDocument: &returnDocument},
+	).Decode(&user)
+
+	if err == mongo.ErrNoDocuments {
+		count, countErr := userCollection.CountDocuments(ctx, bson.M{"user_id": userId})
+		if countErr != nil {
+			return nil, countErr
+		}
+		if count > 0 {
+			return nil, ErrDeletionAlreadyScheduled
+		}
+		return nil, mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if requestedBy != userId {
+		if err := RevokeAllUserTokens(userId); err != nil {
+			return nil, err
+		}
+	}
+
+	cancelHint := "If this wasn't you, sign in and cancel the deletion before then."
+	if requestedBy != userId {
+		cancelHint = "Contact support if you think this is a mistake."
+	}
+
+	err = AppMailer.Send(MailMessage{
+		To:      *user.Email,
+		Subject: "Your Shive account will be deleted",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nYour Shive account is scheduled for deletion on %s. %s",
+			*user.Name,
+			user.Deletion_scheduled_at.Format("2 January 2006 at 15:04 MST"),
+			cancelHint,
+		),
+	})
+	if err != nil {
+		log.Printf("Error sending deletion notice to user %s: %v", userId, err)
+	}
+
+	return &user, nil
+}
+
+// CancelAccountDeletion keeps an account that is still in its grace period.
+func CancelAccountDeletion(userId string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := userCollection.UpdateOne(
+		ctx,
+		bson.M{
+			"user_id":               userId,
+			"deletion_scheduled_at": bson.M{"$ne": nil},
+			// Too late once removal has started
+			"deletion_locked_until": nil,
+		},
+		bson.M{
+			"$unset": bson.M{
+				"deletion_requested_at": "",
+				"deletion_requested_by": "",
+				"deletion_scheduled_at": "",
+			},
+			"$set": bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount < 1 {
+		return ErrDeletionNotScheduled
+	}
+	return nil
+}
+
+// StartAccountDeletionWorker removes accounts past their grace period every
+// ACCOUNT_DELETION_SWEEP_INTERVAL for as long as the process runs.
+func StartAccountDeletionWorker() {
+	go func() {
+		for {
+			if removed, err := PurgeDueAccounts(); err != nil {
+				log.Printf("Error removing accounts scheduled for deletion: %v", err)
+			} else if removed > 0 {
+				log.Printf("Removed %d accounts scheduled for deletion", removed)
+			}
+			time.Sleep(ACCOUNT_DELETION_SWEEP_INTERVAL)
+		}
+	}()
+}
+
+// PurgeDueAccounts removes every account whose grace period is over and returns how many were removed.
+func PurgeDueAccounts() (int, error) {
+	removed := 0
+	for {
+		user, err := claimDueAccount()
+		if err == mongo.ErrNoDocuments {
+			return removed, nil
+		}
+		if err != nil {
+			return removed, err
+		}
+
+		if err := purgeAccount(user); err != nil {
+			return removed, fmt.Errorf("removing user %s: %w", user.User_id, err)
+		}
+		removed++
+	}
+}
+
+// claimDueAccount leases one due account to this instance so others skip it.
+func claimDueAccount() (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var user models.User
+	err := userCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"deletion_scheduled_at": bson.M{"$lte": now},
+			"$or": []bson.M{
+				{"deletion_locked_until": nil},
+				{"deletion_locked_until": bson.M{"$lte": now}},
+			},
+		},
+		bson.M{"$set": bson.M{"deletion_locked_until": now.Add(accountDeletionLease)}},
+	).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// purgeAccount removes the user and everything tied to them. Reviews are kept
+// anonymised or deleted according to ACCOUNT_DELETION_REVIEWS. Each step can be
+// repeated, so an interrupted removal is finished by the next sweep.
+func purgeAccount(user *models.User) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), accountDeletionLease)
+	defer cancel()
+
+	byUser := bson.M{"user_id": user.User_id}
+
+	if ACCOUNT_DELETION_REVIEWS == DeletedReviewsDelete {
+		movieIds, err := reviewCollection.Distinct(ctx, "movie_id", bson.M{"reviewer_id": user.User_id})
+		if err != nil {
+			return err
+		}
+		if _, err := reviewCollection.DeleteMany(ctx, bson.M{"reviewer_id": user.User_id}); err != nil {
+			return err
+		}
+		// Their ratings no longer count
+		for _, movieId := range movieIds {
+			if movieId, ok := movieId.(string); ok {
+				if err := RefreshMovieRating(movieId); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		_, err := reviewCollection.UpdateMany(
+			ctx,
+			bson.M{"reviewer_id": user.User_id},
+			bson.M{"$set": bson.M{"reviewer_id": AnonymousReviewerId}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, collection := range []*mongo.Collection{
+		refreshTokenCollection,
+		sessionCollection,
+		emailVerificationCollection,
+		passwordResetCollection,
+		magicLinkCollection,
+	} {
+		if _, err := collection.DeleteMany(ctx, byUser); err != nil {
+			return err
+		}
+	}
+
+	if err := removeDataExports(byUser); err != nil {
+		return err
+	}
+
+	if user.Email != nil {
+		if _, err := loginAttemptCollection.DeleteOne(ctx, bson.M{"key": loginAttemptKey(LoginAttemptEmail, *user.Email)}); err != nil {
+			return err
+		}
+	}
+
+	// Access tokens of a missing user are refused, and the username is free again
+	_, err := userCollection.DeleteOne(ctx, byUser)
+	return err
+}
+
+func deletedReviewsPolicyOrDefault(key string, fallback string) string {
+	policy := envOrDefault(key, fallback)
+	if policy != DeletedReviewsAnonymize && policy != DeletedReviewsDelete {
+		log.Printf("Invalid %s %q, using %s", key, policy, fallback)
+		return fallback
+	}
+	return policy
+}
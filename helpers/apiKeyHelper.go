@@ -0,0 +1,156 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ApiKeyPrefix starts every API key so they can be told apart from JWTs and found by secret scanners.
+const ApiKeyPrefix = "shive_"
+
+// Scopes an API key can carry. Read-only keys may only make safe requests.
+const (
+	ApiKeyScopeRead  = "read"
+	ApiKeyScopeWrite = "write"
+)
+
+var ApiKeyScopes = []string{ApiKeyScopeRead, ApiKeyScopeWrite}
+
+var ErrInvalidApiKey = errors.New("this API key is invalid, expired or revoked")
+
+var apiKeyCollection *mongo.Collection = database.OpenCollection(database.Client, "api_key")
+
+// API_KEY_DEFAULT_TTL is how long a key is valid when no expiry is given.
+var API_KEY_DEFAULT_TTL time.Duration = durationOrDefault("API_KEY_DEFAULT_TTL", 90*24*time.Hour)
+
+// Last use is only written once per interval so busy jobs don't write on every request.
+const apiKeyLastUsedInterval = time.Minute
+
+func init() {
+	database.EnsureIndexes(apiKeyCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "key_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+}
+
+// CreateApiKey stores a new key and returns it along with the plain key, which
+// is not kept anywhere.
+func CreateApiKey(name string, userType string, scopes []string, expiresAt time.Time, createdBy string) (*models.ApiKey, string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	secret, err := GenerateRandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	plainKey := ApiKeyPrefix + secret
+
+	key := models.ApiKey{
+		ID:         primitive.NewObjectID(),
+		Name:       name,
+		Prefix:     plainKey[:len(ApiKeyPrefix)+6],
+		Key_hash:   HashToken(plainKey),
+		User_type:  userType,
+		Scopes:     scopes,
+		Created_by: createdBy,
+		Created_at: time.Now(),
+		Expires_at: expiresAt,
+	}
+	key.Key_id = key.ID.Hex()
+
+	if _, err := apiKeyCollection.InsertOne(ctx, key); err != nil {
+		return nil, "", err
+	}
+	return &key, plainKey, nil
+}
+
+// ListApiKeys returns every key, newest first.
+func ListApiKeys() ([]models.ApiKey, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := apiKeyCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []models.ApiKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeApiKey stops a key from working. It returns mongo.ErrNoDocuments when
+// there is no such key that is still active.
+func RevokeApiKey(keyId string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := apiKeyCollection.UpdateOne(
+		ctx,
+		bson.M{"key_id": keyId, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount < 1 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// AuthenticateApiKey returns the active key matching plainKey and records that it was used.
+func AuthenticateApiKey(plainKey string) (*models.ApiKey, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var key models.ApiKey
+	err := apiKeyCollection.FindOne(
+		ctx,
+		bson.M{
+			"key_hash":   HashToken(plainKey),
+			"revoked_at": nil,
+			"expires_at": bson.M{"$gt": now},
+		},
+	).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidApiKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if key.Last_used_at == nil || now.Sub(*key.Last_used_at) >= apiKeyLastUsedInterval {
+		_, err = apiKeyCollection.UpdateOne(
+			ctx,
+			bson.M{"key_id": key.Key_id},
+			bson.M{"$set": bson.M{"last_used_at": now}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		key.Last_used_at = &now
+	}
+
+	return &key, nil
+}
+
+// ApiKeyAllows reports whether a key's scopes cover a request with the given HTTP method.
+func ApiKeyAllows(key *models.ApiKey, method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return containsString(key.Scopes, ApiKeyScopeRead) || containsString(key.Scopes, ApiKeyScopeWrite)
+	}
+	return containsString(key.Scopes, ApiKeyScopeWrite)
+}
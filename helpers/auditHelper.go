@@ -0,0 +1,186 @@
+package helpers
+
+import (
+	"context"
+	"log"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audited actions.
+const (
+	AuditSignup          = "auth.signup"
+	AuditLogin           = "auth.login"
+	AuditLoginTwoFactor  = "auth.login_2fa"
+	AuditOidcLogin       = "auth.oidc_login"
+	AuditMagicLinkSend   = "auth.magic_link_send"
+	AuditMagicLinkLogin  = "auth.magic_link_login"
+	AuditTokenIssue      = "auth.token_issue"
+	AuditTokenRefresh    = "auth.token_refresh"
+	AuditLogout          = "auth.logout"
+	AuditPasswordConfirm = "account.password_confirm"
+	AuditPasswordChange  = "account.password_change"
+	AuditPasswordReset   = "account.password_reset"
+	AuditEmailChange     = "account.email_change"
+	AuditTwoFactorEnable = "account.2fa_enable"
+	AuditTwoFactorOff    = "account.2fa_disable"
+	AuditSessionRevoke   = "session.revoke"
+	AuditUserDelete      = "user.delete"
+	AuditUserRestore     = "user.cancel_deletion"
+	AuditUserRoleChange  = "user.role_change"
+	AuditUserSuspend     = "user.suspend"
+	AuditUserBan         = "user.ban"
+	AuditUserReinstate   = "user.reinstate"
+	AuditInviteCreate    = "invite.create"
+	AuditInviteRevoke    = "invite.revoke"
+	AuditInviteAccept    = "invite.accept"
+	AuditAdminSetup      = "setup.admin"
+	AuditLoginLockClear  = "login_lock.clear"
+	AuditApiKeyCreate    = "api_key.create"
+	AuditApiKeyRevoke    = "api_key.revoke"
+	AuditRoleSave        = "role.save"
+	AuditRoleDelete      = "role.delete"
+	AuditMovieDelete     = "movie.delete"
+	AuditGenreDelete     = "genre.delete"
+	AuditReviewDelete    = "review.delete"
+)
+
+// Audit outcomes.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+var auditEventCollection *mongo.Collection = database.OpenCollection(database.Client, "audit_event")
+
+// AUDIT_LOG_RETENTION is how long audit events are kept.
+var AUDIT_LOG_RETENTION time.Duration = durationOrDefault("AUDIT_LOG_RETENTION", 90*24*time.Hour)
+
+func init() {
+	database.EnsureIndexes(auditEventCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// Audit records that the signed in caller did action to target. A nil err is
+// recorded as a success, anything else as a failure with err as the reason.
+func Audit(c *gin.Context, action string, target string, err error) {
+	AuditAs(c, c.GetString("uid"), action, target, err)
+}
+
+// AuditAs is Audit for requests where the actor is not signed in yet, such as logins.
+func AuditAs(c *gin.Context, actor string, action string, target string, err error) {
+	event := models.AuditEvent{
+		Actor:       actor,
+		Auth_method: c.GetString("auth_method"),
+		Action:      action,
+		Target:      target,
+		Outcome:     AuditSuccess,
+		Ip:          c.ClientIP(),
+		User_agent:  c.Request.UserAgent(),
+	}
+	if err != nil {
+		event.Outcome = AuditFailure
+		event.Reason = err.Error()
+	}
+	recordAuditEvent(event)
+}
+
+// auditClient records an event for helpers that only know the client's session details.
+func auditClient(client SessionClient, actor string, action string, target string, err error) {
+	event := models.AuditEvent{
+		Actor:      actor,
+		Action:     action,
+		Target:     target,
+		Outcome:    AuditSuccess,
+		Ip:         client.Ip,
+		User_agent: client.User_agent,
+	}
+	if err != nil {
+		event.Outcome = AuditFailure
+		event.Reason = err.Error()
+	}
+	recordAuditEvent(event)
+}
+
+// AuditEventFilter narrows ListAuditEvents. Empty fields match everything.
+type AuditEventFilter struct {
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int64
+}
+
+// ListAuditEvents returns the newest events matching filter.
+func ListAuditEvents(filter AuditEventFilter) ([]models.AuditEvent, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := bson.M{}
+	if filter.Actor != "" {
+		query["actor"] = filter.Actor
+	}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if filter.Target != "" {
+		query["target"] = filter.Target
+	}
+	if filter.Outcome != "" {
+		query["outcome"] = filter.Outcome
+	}
+
+	createdAt := bson.M{}
+	if !filter.Since.IsZero() {
+		createdAt["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		createdAt["$lt"] = filter.Until
+	}
+	if len(createdAt) > 0 {
+		query["created_at"] = createdAt
+	}
+
+	cursor, err := auditEventCollection.Find(
+		ctx,
+		query,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(filter.Limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []models.AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func recordAuditEvent(event models.AuditEvent) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	event.ID = primitive.NewObjectID()
+	event.Created_at = now
+	event.Expires_at = now.Add(AUDIT_LOG_RETENTION)
+
+	// A lost audit event shouldn't fail the request
+	if _, err := auditEventCollection.InsertOne(ctx, event); err != nil {
+		log.Printf("Error recording audit event %s: %v", event.Action, err)
+	}
+}
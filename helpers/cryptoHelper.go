@@ -0,0 +1,84 @@
+package helpers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// Sealed secrets are prefixed so values written before SECRET_KEY was set can still be read.
+const sealedSecretPrefix = "sealed:"
+
+var ErrNoSecretKey = errors.New("SECRET_KEY is not set")
+
+// SealSecret encrypts a secret with AES-256-GCM using a key derived from SECRET_KEY
+// before it is written to the database. It fails without a SECRET_KEY rather
+// than store the secret in the clear.
+func SealSecret(plaintext string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenSecret reverses SealSecret.
+func OpenSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedSecretPrefix) {
+		return value, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedSecretPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("sealed secret is too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	if SECRET_KEY == "" {
+		return nil, ErrNoSecretKey
+	}
+
+	key := sha256.Sum256([]byte("shive-sealed-secret:" + SECRET_KEY))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateRandomToken returns a URL safe token built from n random bytes.
+func GenerateRandomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,409 @@
+package helpers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Data export statuses.
+const (
+	DataExportPending    = "pending"
+	DataExportProcessing = "processing"
+	DataExportReady      = "ready"
+	DataExportFailed     = "failed"
+)
+
+var (
+	ErrDataExportNotReady = errors.New("this export is not ready yet")
+	ErrDataExportExpired  = errors.New("this export has expired, please request a new one")
+)
+
+var dataExportCollection *mongo.Collection = database.OpenCollection(database.Client, "data_export")
+
+// DATA_EXPORT_TTL is how long a finished archive can be downloaded.
+var DATA_EXPORT_TTL time.Duration = durationOrDefault("DATA_EXPORT_TTL", 24*time.Hour)
+
+// DATA_EXPORT_SYNC_MAX_RECORDS is the most reviews and sessions an export may
+// hold to be built during the request. Bigger ones are built in the background.
+var DATA_EXPORT_SYNC_MAX_RECORDS int = intOrDefault("DATA_EXPORT_SYNC_MAX_RECORDS", 500)
+
+// DATA_EXPORT_SWEEP_INTERVAL is how often waiting exports are built and expired ones removed.
+var DATA_EXPORT_SWEEP_INTERVAL time.Duration = durationOrDefault("DATA_EXPORT_SWEEP_INTERVAL", time.Minute)
+
+// An instance has this long to build an archive before another may retry it.
+const dataExportLease = 10 * time.Minute
+
+func init() {
+	database.EnsureIndexes(dataExportCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "export_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}},
+	})
+}
+
+// DataExportNeedsJob reports whether the user's data is too big to export during a request.
+func DataExportNeedsJob(userId string) (bool, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	limit := int64(DATA_EXPORT_SYNC_MAX_RECORDS) + 1
+	reviews, err := reviewCollection.CountDocuments(ctx, bson.M{"reviewer_id": userId}, options.Count().SetLimit(limit))
+	if err != nil {
+		return false, err
+	}
+	sessions, err := sessionCollection.CountDocuments(ctx, bson.M{"user_id": userId}, options.Count().SetLimit(limit))
+	if err != nil {
+		return false, err
+	}
+	return reviews+sessions > int64(DATA_EXPORT_SYNC_MAX_RECORDS), nil
+}
+
+// WriteDataExport writes a zip archive of everything stored about the user to w.
+func WriteDataExport(ctx context.Context, w io.Writer, userId string) error {
+	var user models.User
+	if err := userCollection.FindOne(ctx, bson.M{"user_id": userId}).Decode(&user); err != nil {
+		return err
+	}
+	// Credentials are not personal data worth handing out
+	user.Password = nil
+	user.Token = nil
+	user.Refresh_token = nil
+
+	archive := zip.NewWriter(w)
+	generatedAt := time.Now().UTC()
+
+	if err := writeZipJSON(archive, "profile.json", user, generatedAt); err != nil {
+		return err
+	}
+
+	reviews, err := writeZipCursor(ctx, archive, "reviews.json", reviewCollection, bson.M{"reviewer_id": userId}, func() interface{} { return &models.Review{} }, generatedAt)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := writeZipCursor(ctx, archive, "sessions.json", sessionCollection, bson.M{"user_id": userId}, func() interface{} { return &models.Session{} }, generatedAt)
+	if err != nil {
+		return err
+	}
+
+	manifest := map[string]interface{}{
+		"user_id":      userId,
+		"generated_at": generatedAt,
+		"files": map[string]int{
+			"profile.json":  1,
+			"reviews.json":  reviews,
+			"sessions.json": sessions,
+		},
+	}
+	if err := writeZipJSON(archive, "manifest.json", manifest, generatedAt); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func writeZipJSON(archive *zip.Writer, name string, value interface{}, modified time.Time) error {
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// writeZipCursor writes every matching document as a JSON array, one document at
+// a time so big collections don't have to fit in memory. It returns how many were written.
+func writeZipCursor(ctx context.Context, archive *zip.Writer, name string, collection *mongo.Collection, filter bson.M, newItem func() interface{}, modified time.Time) (int, error) {
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return 0, err
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	if _, err := io.WriteString(file, "["); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for cursor.Next(ctx) {
+		item := newItem()
+		if err := cursor.Decode(item); err != nil {
+			return count, err
+		}
+		encoded, err := json.Marshal(item)
+		if err != nil {
+			return count, err
+		}
+
+		separator := "\n  "
+		if count > 0 {
+			separator = ",\n  "
+		}
+		if _, err := io.WriteString(file, separator); err != nil {
+			return count, err
+		}
+		if _, err := file.Write(encoded); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		return count, err
+	}
+
+	_, err = io.WriteString(file, "\n]\n")
+	return count, err
+}
+
+// RequestDataExport queues a background export for the user. An export that is
+// still waiting or being built is returned instead of starting another.
+func RequestDataExport(userId string) (export *models.DataExport, created bool, err error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var existing models.DataExport
+	err = dataExportCollection.FindOne(
+		ctx,
+		bson.M{"user_id": userId, "status": bson.M{"$in": []string{DataExportPending, DataExportProcessing}}},
+	).Decode(&existing)
+	if err == nil {
+		return &existing, false, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, err
+	}
+
+	export = &models.DataExport{
+		ID:         primitive.NewObjectID(),
+		User_id:    userId,
+		Status:     DataExportPending,
+		Created_at: time.Now(),
+	}
+	export.Export_id = export.ID.Hex()
+
+	if _, err := dataExportCollection.InsertOne(ctx, export); err != nil {
+		return nil, false, err
+	}
+
+	// Start right away rather than on the next sweep
+	go processDataExportsAndLog()
+
+	return export, true, nil
+}
+
+// GetDataExport returns one of the user's exports. It returns mongo.ErrNoDocuments
+// when the user has no such export.
+func GetDataExport(userId string, exportId string) (*models.DataExport, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var export models.DataExport
+	err := dataExportCollection.FindOne(ctx, bson.M{"user_id": userId, "export_id": exportId}).Decode(&export)
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// OpenDataExport opens a finished archive for download. The caller has to close it.
+func OpenDataExport(export *models.DataExport) (io.ReadCloser, error) {
+	if export.Status != DataExportReady || export.File_id == nil {
+		return nil, ErrDataExportNotReady
+	}
+	if export.Expires_at != nil && !export.Expires_at.After(time.Now()) {
+		return nil, ErrDataExportExpired
+	}
+
+	bucket, err := dataExportBucket()
+	if err != nil {
+		return nil, err
+	}
+	return bucket.OpenDownloadStream(*export.File_id)
+}
+
+// StartDataExportWorker builds waiting exports and removes expired ones every
+// DATA_EXPORT_SWEEP_INTERVAL for as long as the process runs.
+func StartDataExportWorker() {
+	go func() {
+		for {
+			processDataExportsAndLog()
+			if err := removeDataExports(bson.M{"expires_at": bson.M{"$lte": time.Now()}}); err != nil {
+				log.Printf("Error removing expired data exports: %v", err)
+			}
+			time.Sleep(DATA_EXPORT_SWEEP_INTERVAL)
+		}
+	}()
+}
+
+func processDataExportsAndLog() {
+	if err := ProcessDataExports(); err != nil {
+		log.Printf("Error building data exports: %v", err)
+	}
+}
+
+// ProcessDataExports builds every waiting export, including ones another instance
+// stopped building before its lease ran out.
+func ProcessDataExports() error {
+	for {
+		export, err := claimDataExport()
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		buildDataExport(export)
+	}
+}
+
+func claimDataExport() (*models.DataExport, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var export models.DataExport
+	err := dataExportCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"status": bson.M{"$in": []string{DataExportPending, DataExportProcessing}},
+			"$or": []bson.M{
+				{"locked_until": nil},
+				{"locked_until": bson.M{"$lte": now}},
+			},
+		},
+		bson.M{"$set": bson.M{"status": DataExportProcessing, "locked_until": now.Add(dataExportLease)}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	).Decode(&export)
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// buildDataExport writes the archive to GridFS and marks the export ready, or failed.
+func buildDataExport(export *models.DataExport) {
+	var ctx, cancel = context.WithTimeout(context.Background(), dataExportLease)
+	defer cancel()
+
+	fileId := primitive.NewObjectID()
+	size, buildErr := uploadDataExport(ctx, fileId, export.User_id)
+
+	now := time.Now()
+	expiresAt := now.Add(DATA_EXPORT_TTL)
+	update := bson.M{
+		"status":       DataExportReady,
+		"file_id":      fileId,
+		"size":         size,
+		"completed_at": now,
+		"expires_at":   expiresAt,
+	}
+	if buildErr != nil {
+		log.Printf("Error building data export %s: %v", export.Export_id, buildErr)
+		update = bson.M{
+			"status":       DataExportFailed,
+			"error":        "the export could not be built, please request a new one",
+			"completed_at": now,
+			"expires_at":   expiresAt,
+		}
+	}
+
+	_, err := dataExportCollection.UpdateOne(
+		ctx,
+		bson.M{"export_id": export.Export_id},
+		bson.M{"$set": update, "$unset": bson.M{"locked_until": ""}},
+	)
+	if err != nil {
+		log.Printf("Error saving data export %s: %v", export.Export_id, err)
+	}
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += int64(n)
+	return n, err
+}
+
+func uploadDataExport(ctx context.Context, fileId primitive.ObjectID, userId string) (int64, error) {
+	bucket, err := dataExportBucket()
+	if err != nil {
+		return 0, err
+	}
+
+	upload, err := bucket.OpenUploadStreamWithID(fileId, "shive-export-"+userId+".zip")
+	if err != nil {
+		return 0, err
+	}
+
+	written := &countingWriter{w: upload}
+	if err := WriteDataExport(ctx, written, userId); err != nil {
+		upload.Abort()
+		return 0, err
+	}
+	return written.count, upload.Close()
+}
+
+// removeDataExports deletes the matching exports along with their archives.
+func removeDataExports(filter bson.M) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cursor, err := dataExportCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	var exports []models.DataExport
+	if err := cursor.All(ctx, &exports); err != nil {
+		return err
+	}
+
+	bucket, err := dataExportBucket()
+	if err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if export.File_id != nil {
+			if err := bucket.DeleteContext(ctx, *export.File_id); err != nil && err != gridfs.ErrFileNotFound {
+				return err
+			}
+		}
+		if _, err := dataExportCollection.DeleteOne(ctx, bson.M{"export_id": export.Export_id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dataExportBucket opens the GridFS bucket archives are kept in. Buckets are
+// not safe for concurrent use, so every caller gets its own.
+func dataExportBucket() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(dataExportCollection.Database(), options.GridFSBucket().SetName("data_export_files"))
+}
@@ -0,0 +1,98 @@
+package helpers
+
+import (
+	"context"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of throttled emails recorded in the email_send collection.
+const (
+	EmailSendMagicLink       = "magic_link"
+	EmailSendPasswordReset   = "password_reset"
+	EmailSendPasswordResetIp = "password_reset_ip"
+	EmailSendVerification    = "email_verification"
+)
+
+var emailSendCollection *mongo.Collection = database.OpenCollection(database.Client, "email_send")
+
+func init() {
+	database.EnsureIndexes(emailSendCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "kind", Value: 1}, {Key: "key", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// recordEmailSend remembers an email of kind sent to key at for an hour, however
+// soon the token it carried expires.
+func recordEmailSend(ctx context.Context, kind string, key string, at time.Time) error {
+	_, err := emailSendCollection.InsertOne(ctx, models.EmailSend{
+		ID:         primitive.NewObjectID(),
+		Kind:       kind,
+		Key:        key,
+		Created_at: at,
+		Expires_at: at.Add(time.Hour),
+	})
+	return err
+}
+
+// recentEmailSends returns when the newest emails of kind to key in the last
+// hour were sent, newest first.
+func recentEmailSends(ctx context.Context, kind string, key string, now time.Time, limit int) ([]time.Time, error) {
+	cursor, err := emailSendCollection.Find(
+		ctx,
+		bson.M{"kind": kind, "key": key, "created_at": bson.M{"$gt": now.Add(-time.Hour)}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var recent []models.EmailSend
+	if err := cursor.All(ctx, &recent); err != nil {
+		return nil, err
+	}
+
+	sent := make([]time.Time, len(recent))
+	for i, send := range recent {
+		sent[i] = send.Created_at
+	}
+	return sent, nil
+}
+
+// RetryAfterSends returns how long to wait at now before another email may be
+// sent, given when the earlier ones were sent, newest first. Emails are at
+// least interval apart and at most perHour are sent in any hour.
+func RetryAfterSends(sent []time.Time, now time.Time, interval time.Duration, perHour int) time.Duration {
+	var lastHour []time.Time
+	for _, at := range sent {
+		if at.After(now.Add(-time.Hour)) {
+			lastHour = append(lastHour, at)
+		}
+	}
+
+	if len(lastHour) == 0 {
+		return 0
+	}
+
+	wait := lastHour[0].Add(interval).Sub(now)
+
+	// Once the hour's emails are used up, the next one waits for the oldest to age out
+	if len(lastHour) >= perHour {
+		oldest := lastHour[perHour-1]
+		if hourly := oldest.Add(time.Hour).Sub(now); hourly > wait {
+			wait = hourly
+		}
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
@@ -0,0 +1,243 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidVerificationToken = errors.New("this verification link is invalid or has expired")
+	ErrVerificationThrottled    = errors.New("a verification email was sent recently, please wait before asking for another one")
+)
+
+var emailVerificationCollection *mongo.Collection = database.OpenCollection(database.Client, "email_verification")
+
+// EMAIL_VERIFICATION_TTL is how long a verification link stays valid.
+var EMAIL_VERIFICATION_TTL time.Duration = durationOrDefault("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+
+// EMAIL_VERIFICATION_RESEND_INTERVAL is the minimum time between two verification emails.
+var EMAIL_VERIFICATION_RESEND_INTERVAL time.Duration = durationOrDefault("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute)
+
+// At most this many verification emails are sent to a user per hour.
+const maxVerificationEmailsPerHour = 5
+
+func init() {
+	database.EnsureIndexes(emailVerificationCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// VerificationRetryAfter returns how long the user has to wait before another
+// verification email may be sent to them, zero when one can be sent right away.
+func VerificationRetryAfter(userId string) (time.Duration, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	sent, err := recentEmailSends(ctx, EmailSendVerification, userId, now, maxVerificationEmailsPerHour)
+	if err != nil {
+		return 0, err
+	}
+	return RetryAfterSends(sent, now, EMAIL_VERIFICATION_RESEND_INTERVAL, maxVerificationEmailsPerHour), nil
+}
+
+// SendVerificationEmail issues a verification token for the address and emails a
+// link with it. Earlier tokens for the user stop working.
+func SendVerificationEmail(userId string, name string, email string) error {
+	token, err := issueVerificationToken(userId, email)
+	if err != nil {
+		return err
+	}
+
+	return AppMailer.Send(MailMessage{
+		To:      email,
+		Subject: "Verify your Shive email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease confirm this is your email address by opening the link below. It expires in %s.\n\n%s/verify-email?token=%s\n\nIf you did not create a Shive account, you can ignore this email.",
+			name,
+			EMAIL_VERIFICATION_TTL,
+			APP_URL,
+			token,
+		),
+	})
+}
+
+// RequestEmailChange stores newEmail as the user's pending address and sends
+// it a verification link. The current address keeps working and is told about
+// the change until the new one is verified.
+func RequestEmailChange(user *models.User, newEmail string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	inUse, err := EmailInUse(newEmail, user.User_id)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrEmailTaken
+	}
+
+	_, err = userCollection.UpdateOne(
+		ctx,
+		bson.M{"user_id": user.User_id},
+		bson.M{"$set": bson.M{"pending_email": newEmail, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+
+	token, err := issueVerificationToken(user.User_id, newEmail)
+	if err != nil {
+		return err
+	}
+
+	err = AppMailer.Send(MailMessage{
+		To:      newEmail,
+		Subject: "Confirm your new Shive email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nOpen the link below to use this address for your Shive account. It expires in %s.\n\n%s/verify-email?token=%s\n\nIf you did not ask for this, you can ignore this email.",
+			*user.Name,
+			EMAIL_VERIFICATION_TTL,
+			APP_URL,
+			token,
+		),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Tell the current owner so a hijacked session can't move the account quietly
+	return AppMailer.Send(MailMessage{
+		To:      *user.Email,
+		Subject: "Your Shive email address is being changed",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to change the email address of your Shive account to %s. The change happens once the new address is verified.\n\nIf this wasn't you, reset your password right away at %s/forgot-password.",
+			*user.Name,
+			newEmail,
+			APP_URL,
+		),
+	})
+}
+
+// issueVerificationToken stores a new verification token for the address and
+// retires the user's earlier tokens. The plain token is only returned here.
+func issueVerificationToken(userId string, email string) (string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	token, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = emailVerificationCollection.UpdateMany(
+		ctx,
+		bson.M{"user_id": userId, "used_at": nil},
+		bson.M{"$set": bson.M{"used_at": now}},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = emailVerificationCollection.InsertOne(ctx, models.EmailVerification{
+		ID:         primitive.NewObjectID(),
+		User_id:    userId,
+		Email:      email,
+		Token_hash: HashToken(token),
+		Created_at: now,
+		Expires_at: now.Add(EMAIL_VERIFICATION_TTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// EMAIL_VERIFICATION_TTL may be shorter than the hour the throttle looks back on
+	if err := recordEmailSend(ctx, EmailSendVerification, userId, now); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// VerifyEmail redeems a verification token and marks the address as verified.
+// The token only verifies the address it was sent to.
+func VerifyEmail(token string) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var verification models.EmailVerification
+	err := emailVerificationCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"token_hash": HashToken(token),
+			"used_at":    nil,
+			"expires_at": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"used_at": now}},
+	).Decode(&verification)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"user_id": verification.User_id, "email": verification.Email}
+	update := bson.M{"$set": bson.M{
+		"email_verified":    true,
+		"email_verified_at": now,
+		"updated_at":        now,
+	}}
+
+	// A verified pending address replaces the current one, as long as nobody took it in the meantime
+	pendingCount, err := userCollection.CountDocuments(ctx, bson.M{"user_id": verification.User_id, "pending_email": verification.Email})
+	if err != nil {
+		return nil, err
+	}
+	if pendingCount > 0 {
+		inUse, err := EmailInUse(verification.Email, verification.User_id)
+		if err != nil {
+			return nil, err
+		}
+		if inUse {
+			return nil, ErrEmailTaken
+		}
+
+		filter = bson.M{"user_id": verification.User_id, "pending_email": verification.Email}
+		update["$set"].(bson.M)["email"] = verification.Email
+		update["$unset"] = bson.M{"pending_email": ""}
+	}
+
+	returnDocument := options.After
+	var user models.User
+	err = userCollection.FindOneAndUpdate(
+		ctx,
+		filter,
+		update,
+		&options.FindOneAndUpdateOptions{ReturnDocument: &returnDocument},
+	).Decode(&user)
+
+	if err == mongo.ErrNoDocuments {
+		// The user changed their email after this link was sent
+		return nil, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,47 @@
+package helpers
+
+import (
+	"context"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var genreCollection *mongo.Collection = database.OpenCollection(database.Client, "genre")
+
+// Genres are listed in the order they were created, their IDs being ObjectIDs.
+var genreSort = bson.D{{Key: "genre_id", Value: 1}}
+
+func init() {
+	database.EnsureIndexes(genreCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "genre_id", Value: 1}}},
+	})
+}
+
+// ListGenres returns a page of genres, how many there are in all and the cursor
+// of the next page, empty on the last one.
+func ListGenres(page Page) ([]models.Genre, int64, string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := genreCollection.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	docs, next, err := findPage(ctx, genreCollection, bson.M{}, genreSort, page, true, nil)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	genres := make([]models.Genre, len(docs))
+	for i, doc := range docs {
+		if err := bson.Unmarshal(doc, &genres[i]); err != nil {
+			return nil, 0, "", err
+		}
+	}
+	return genres, total, next, nil
+}
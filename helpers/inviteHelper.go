@@ -0,0 +1,391 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// InviteTokenType is emailed to invited people. It can only be exchanged for an
+// account through AcceptInvite.
+const InviteTokenType = "invite"
+
+const (
+	// AdminRole is the role the bootstrap setup token creates.
+	AdminRole = "ADMIN"
+	// DefaultSignupRole is the only role public signup gives.
+	DefaultSignupRole = "USER"
+)
+
+var (
+	ErrInvalidInvite      = errors.New("this invite is invalid, was revoked or has expired")
+	ErrInviteNotPending   = errors.New("this invite was already accepted or revoked")
+	ErrInvalidSetupToken  = errors.New("this setup token is invalid or has expired")
+	ErrAdminAlreadyExists = errors.New("an admin account already exists, ask an admin for an invite")
+)
+
+var inviteCollection *mongo.Collection = database.OpenCollection(database.Client, "invite")
+var setupTokenCollection *mongo.Collection = database.OpenCollection(database.Client, "setup_token")
+
+// INVITE_TTL is how long an invite link stays valid.
+var INVITE_TTL time.Duration = durationOrDefault("INVITE_TTL", 72*time.Hour)
+
+// SETUP_TOKEN_TTL is how long the setup token printed at startup stays valid.
+var SETUP_TOKEN_TTL time.Duration = durationOrDefault("SETUP_TOKEN_TTL", time.Hour)
+
+func init() {
+	database.EnsureIndexes(inviteCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	database.EnsureIndexes(setupTokenCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// CreateInvite stores an invite for email with the given role, revokes earlier
+// pending invites for the same address and emails a signed link to it.
+func CreateInvite(email string, role string, invitedBy string) (*models.Invite, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	exists, err := RoleExists(role)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUnknownRole
+	}
+
+	inUse, err := EmailInUse(email, "")
+	if err != nil {
+		return nil, err
+	}
+	if inUse {
+		return nil, ErrEmailTaken
+	}
+
+	now := time.Now()
+	_, err = inviteCollection.UpdateMany(
+		ctx,
+		bson.M{"email": caseInsensitiveMatch(email), "accepted_at": nil, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": now}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	invite := models.Invite{
+		ID:         primitive.NewObjectID(),
+		Email:      email,
+		User_type:  role,
+		Invited_by: invitedBy,
+		Created_at: now,
+		Expires_at: now.Add(INVITE_TTL),
+	}
+
+	token, err := signClaims(&JwtSignedDetails{
+		Email:      invite.Email,
+		User_type:  invite.User_type,
+		Token_type: InviteTokenType,
+		StandardClaims: jwt.StandardClaims{
+			Id:        invite.ID.Hex(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: invite.Expires_at.Unix(),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := inviteCollection.InsertOne(ctx, invite); err != nil {
+		return nil, err
+	}
+
+	err = AppMailer.Send(MailMessage{
+		To:      email,
+		Subject: "You are invited to Shive",
+		Body: fmt.Sprintf(
+			"Hi,\n\nYou have been invited to join Shive as %s. Open the link below to choose a username and password. It expires in %s.\n\n%s/signup/invite?token=%s\n\nIf you were not expecting this, you can ignore this email.",
+			role,
+			INVITE_TTL,
+			APP_URL,
+			token,
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &invite, nil
+}
+
+// ListInvites returns the invites that have not expired yet, newest first.
+// Accepted and revoked invites are listed too until they would have expired.
+func ListInvites() ([]models.Invite, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The TTL index only purges expired invites once a minute or so
+	cursor, err := inviteCollection.Find(
+		ctx,
+		bson.M{"expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	invites := []models.Invite{}
+	if err := cursor.All(ctx, &invites); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// RevokeInvite stops a pending invite from being accepted.
+func RevokeInvite(inviteId string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id, err := primitive.ObjectIDFromHex(inviteId)
+	if err != nil {
+		return mongo.ErrNoDocuments
+	}
+
+	result, err := inviteCollection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "accepted_at": nil, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	// Tell a missing invite apart from one that is no longer pending
+	count, err := inviteCollection.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return ErrInviteNotPending
+}
+
+// AcceptInvite creates the invited account with the role and email address of
+// the invite. The address counts as verified since the link was sent to it.
+// passwordHash must already be hashed.
+func AcceptInvite(signedInvite string, name string, username string, passwordHash string) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	claims, msg := ValidateToken(signedInvite)
+	if msg != "" || claims.Token_type != InviteTokenType || claims.Id == "" {
+		return nil, ErrInvalidInvite
+	}
+
+	id, err := primitive.ObjectIDFromHex(claims.Id)
+	if err != nil {
+		return nil, ErrInvalidInvite
+	}
+
+	usernameTaken, err := UsernameInUse(username, "")
+	if err != nil {
+		return nil, err
+	}
+	if usernameTaken {
+		return nil, ErrUsernameTaken
+	}
+
+	emailTaken, err := EmailInUse(claims.Email, "")
+	if err != nil {
+		return nil, err
+	}
+	if emailTaken {
+		return nil, ErrEmailTaken
+	}
+
+	now := time.Now()
+	user := models.User{
+		ID:                primitive.NewObjectID(),
+		Name:              &name,
+		Username:          &username,
+		Password:          &passwordHash,
+		Created_at:        now,
+		Updated_at:        now,
+		Email_verified:    true,
+		Email_verified_at: &now,
+	}
+	user.User_id = user.ID.Hex()
+
+	// Claim the invite first so it can only be used once
+	var invite models.Invite
+	err = inviteCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": id, "accepted_at": nil, "revoked_at": nil, "expires_at": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"accepted_at": now, "accepted_user_id": user.User_id}},
+	).Decode(&invite)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidInvite
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The stored invite is the source of truth, the token only points at it
+	user.Email = &invite.Email
+	user.User_type = &invite.User_type
+
+	if _, err := userCollection.InsertOne(ctx, user); err != nil {
+		// Give the invite back so it can be tried again
+		inviteCollection.UpdateOne(
+			ctx,
+			bson.M{"_id": id},
+			bson.M{"$set": bson.M{"accepted_at": nil, "accepted_user_id": nil}},
+		)
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// AdminExists reports whether any account has the ADMIN role.
+func AdminExists() (bool, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count, err := userCollection.CountDocuments(ctx, bson.M{"user_type": AdminRole}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// PrintSetupTokenIfNeeded issues a setup token and writes it to the log when no
+// admin account exists yet. The token can create the first admin once through
+// POST /setup/admin.
+func PrintSetupTokenIfNeeded() {
+	exists, err := AdminExists()
+	if err != nil {
+		log.Printf("Error checking for an admin account: %v", err)
+		return
+	}
+	if exists {
+		return
+	}
+
+	token, err := issueSetupToken()
+	if err != nil {
+		log.Printf("Error issuing a setup token: %v", err)
+		return
+	}
+
+	log.Printf("No admin account exists yet. Create one within %s by sending this setup token to POST /setup/admin: %s", SETUP_TOKEN_TTL, token)
+}
+
+// issueSetupToken stores a new setup token. The plain token is only returned here.
+func issueSetupToken() (string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	token, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = setupTokenCollection.InsertOne(ctx, models.SetupToken{
+		ID:         primitive.NewObjectID(),
+		Token_hash: HashToken(token),
+		Created_at: now,
+		Expires_at: now.Add(SETUP_TOKEN_TTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// BootstrapAdmin uses up a setup token to create the first admin account. Every
+// other setup token stops working once it succeeds. passwordHash must already be hashed.
+func BootstrapAdmin(setupToken string, name string, username string, email string, passwordHash string) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	exists, err := AdminExists()
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrAdminAlreadyExists
+	}
+
+	usernameTaken, err := UsernameInUse(username, "")
+	if err != nil {
+		return nil, err
+	}
+	if usernameTaken {
+		return nil, ErrUsernameTaken
+	}
+
+	emailTaken, err := EmailInUse(email, "")
+	if err != nil {
+		return nil, err
+	}
+	if emailTaken {
+		return nil, ErrEmailTaken
+	}
+
+	now := time.Now()
+	var stored models.SetupToken
+	err = setupTokenCollection.FindOneAndDelete(
+		ctx,
+		bson.M{"token_hash": HashToken(setupToken), "expires_at": bson.M{"$gt": now}},
+	).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidSetupToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	role := AdminRole
+	user := models.User{
+		ID:         primitive.NewObjectID(),
+		Name:       &name,
+		Username:   &username,
+		Email:      &email,
+		Password:   &passwordHash,
+		User_type:  &role,
+		Created_at: now,
+		Updated_at: now,
+		// The address is verified like any other through the emailed link
+		Email_verified: false,
+	}
+	user.User_id = user.ID.Hex()
+
+	if _, err := userCollection.InsertOne(ctx, user); err != nil {
+		return nil, err
+	}
+
+	if _, err := setupTokenCollection.DeleteMany(ctx, bson.M{}); err != nil {
+		log.Printf("Error removing setup tokens after creating the first admin: %v", err)
+	}
+
+	return &user, nil
+}
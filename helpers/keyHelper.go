@@ -0,0 +1,440 @@
+package helpers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"shive/database"
+	"shive/models"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// JSONWebKey is the public half of a signing key as published in the JWKS document.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+var signingKeyCollection *mongo.Collection = database.OpenCollection(database.Client, "signing_key")
+
+// JWT_SIGNING_ALG selects how new tokens are signed, HS256 keeps using SECRET_KEY.
+var JWT_SIGNING_ALG string = envOrDefault("JWT_SIGNING_ALG", AlgHS256)
+
+// JWT_ACCEPTED_ALGS pins the algorithms ValidateToken accepts. Add the previous
+// algorithm here while migrating so tokens that are already issued keep working.
+var JWT_ACCEPTED_ALGS []string = splitList(envOrDefault("JWT_ACCEPTED_ALGS", JWT_SIGNING_ALG))
+
+// JWT_KEY_ROTATION_INTERVAL is how long an asymmetric key signs new tokens.
+var JWT_KEY_ROTATION_INTERVAL time.Duration = durationOrDefault("JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour)
+
+// A successor key is published this long before it starts signing so verifiers
+// caching the JWKS document pick it up in time.
+const keyPublishLead = 24 * time.Hour
+
+// How long the in-memory key ring is trusted before it is reloaded from mongo.
+const keyRingTTL = time.Minute
+
+type signingKey struct {
+	models.SigningKey
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+var keyRing struct {
+	sync.Mutex
+	keys     []*signingKey
+	loadedAt time.Time
+}
+
+// signingMethodEd25519 implements EdDSA (RFC 8037) for jwt-go, which only ships RSA, ECDSA and HMAC.
+type signingMethodEd25519 struct{}
+
+var SigningMethodEdDSA = &signingMethodEd25519{}
+
+func (m *signingMethodEd25519) Alg() string {
+	return AlgEdDSA
+}
+
+func (m *signingMethodEd25519) Verify(signingString string, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+func (m *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func init() {
+	jwt.RegisterSigningMethod(AlgEdDSA, func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+
+	for _, alg := range append([]string{JWT_SIGNING_ALG}, JWT_ACCEPTED_ALGS...) {
+		if alg != AlgHS256 && alg != AlgRS256 && alg != AlgEdDSA {
+			log.Fatalf("Unsupported JWT algorithm %q, use one of HS256, RS256 or EdDSA", alg)
+		}
+	}
+
+	database.EnsureIndexes(signingKeyCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "kid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "retire_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// signClaims signs the claims with the configured algorithm. Asymmetric tokens carry
+// the `kid` of the key that signed them.
+func signClaims(claims jwt.Claims) (string, error) {
+	if JWT_SIGNING_ALG == AlgHS256 {
+		// Tokens signed with an empty key could be forged by anyone
+		if SECRET_KEY == "" {
+			return "", ErrNoSecretKey
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SECRET_KEY))
+	}
+
+	key, err := currentSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.private)
+}
+
+// verificationKey is the jwt.Keyfunc used by ValidateToken. It only hands out a key
+// when the token's algorithm is pinned and matches the key it names.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if !containsString(JWT_ACCEPTED_ALGS, alg) {
+		return nil, fmt.Errorf("unexpected signing algorithm %s", alg)
+	}
+
+	if alg == AlgHS256 {
+		if SECRET_KEY == "" {
+			return nil, errors.New("HS256 tokens require SECRET_KEY to be set")
+		}
+		return []byte(SECRET_KEY), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token is missing a key id")
+	}
+
+	key, err := findVerificationKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.Alg != alg {
+		return nil, fmt.Errorf("key %s can not verify %s tokens", kid, alg)
+	}
+	return key.public, nil
+}
+
+// PublicJWKS returns every key that can still verify tokens, including the
+// successor of the current signing key.
+func PublicJWKS() ([]JSONWebKey, error) {
+	keys, err := loadKeyRing(false)
+	if err != nil {
+		return nil, err
+	}
+
+	jwks := []JSONWebKey{}
+	for _, key := range keys {
+		jwk := JSONWebKey{Kid: key.Kid, Use: "sig", Alg: key.Alg}
+
+		switch publicKey := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks, nil
+}
+
+// currentSigningKey returns the key that signs new tokens right now, generating it,
+// or its successor once it is close to expiry, when needed.
+func currentSigningKey() (*signingKey, error) {
+	keys, err := loadKeyRing(false)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active, successor := pickSigningKeys(keys, now)
+
+	if active == nil {
+		if active, err = createSigningKey(now); err != nil {
+			return nil, err
+		}
+		loadKeyRing(true)
+	}
+
+	if successor == nil && active.Expires_at.Sub(now) < keyPublishLead {
+		if _, err := createSigningKey(active.Expires_at); err != nil {
+			log.Printf("Error creating successor signing key: %v", err)
+		}
+		loadKeyRing(true)
+	}
+
+	return active, nil
+}
+
+// pickSigningKeys finds the newest key that is signing at `now` and any key already
+// scheduled to take over from it.
+func pickSigningKeys(keys []*signingKey, now time.Time) (active *signingKey, successor *signingKey) {
+	for _, key := range keys {
+		if key.Alg != JWT_SIGNING_ALG {
+			continue
+		}
+		if !key.Not_before.After(now) && key.Expires_at.After(now) {
+			if active == nil || key.Not_before.After(active.Not_before) {
+				active = key
+			}
+		}
+	}
+
+	for _, key := range keys {
+		if key.Alg == JWT_SIGNING_ALG && active != nil && key.Not_before.After(now) {
+			successor = key
+		}
+	}
+	return active, successor
+}
+
+func findVerificationKey(kid string) (*signingKey, error) {
+	keys, err := loadKeyRing(false)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Kid == kid {
+			return key, nil
+		}
+	}
+
+	// Another instance may have rotated in a key we have not seen yet
+	keys, err = loadKeyRing(true)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Kid == kid {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %s", kid)
+}
+
+// loadKeyRing returns the keys that have not been retired, reloading them from mongo
+// when the cache is stale or a reload is forced.
+func loadKeyRing(force bool) ([]*signingKey, error) {
+	keyRing.Lock()
+	defer keyRing.Unlock()
+
+	if !force && keyRing.loadedAt.After(time.Now().Add(-keyRingTTL)) {
+		return keyRing.keys, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := signingKeyCollection.Find(ctx, bson.M{"retire_at": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []models.SigningKey
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*signingKey, 0, len(records))
+	for _, record := range records {
+		key, err := parseSigningKey(record)
+		if err != nil {
+			log.Printf("Skipping signing key %s: %v", record.Kid, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	keyRing.keys = keys
+	keyRing.loadedAt = time.Now()
+	return keys, nil
+}
+
+// createSigningKey generates a key that starts signing at notBefore. Instances that
+// rotate at the same moment may both create one, which is harmless since both are published.
+func createSigningKey(notBefore time.Time) (*signingKey, error) {
+	var private crypto.Signer
+	var err error
+
+	switch JWT_SIGNING_ALG {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("%s does not use signing keys", JWT_SIGNING_ALG)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	sealedPrivateKey, err := SealSecret(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})))
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := notBefore.Add(JWT_KEY_ROTATION_INTERVAL)
+	record := models.SigningKey{
+		ID:          primitive.NewObjectID(),
+		Kid:         primitive.NewObjectID().Hex(),
+		Alg:         JWT_SIGNING_ALG,
+		Private_key: sealedPrivateKey,
+		Public_key:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+		Not_before:  notBefore,
+		Expires_at:  expiresAt,
+		// Keep verifying until the last token this key signed has expired
+		Retire_at:  expiresAt.Add(refreshTokenLifetime),
+		Created_at: time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := signingKeyCollection.InsertOne(ctx, record); err != nil {
+		return nil, err
+	}
+
+	return &signingKey{SigningKey: record, private: private, public: private.Public()}, nil
+}
+
+func parseSigningKey(record models.SigningKey) (*signingKey, error) {
+	privatePEM, err := OpenSecret(record.Private_key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key can not sign")
+	}
+
+	return &signingKey{SigningKey: record, private: private, public: private.Public()}, nil
+}
+
+func envOrDefault(key string, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func durationOrDefault(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Invalid duration %q for %s, using %s", value, key, fallback)
+		return fallback
+	}
+	return duration
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func containsString(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
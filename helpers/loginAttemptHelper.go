@@ -0,0 +1,239 @@
+package helpers
+
+import (
+	"context"
+	"math"
+	"os"
+	"shive/database"
+	"shive/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	LoginAttemptEmail = "email"
+	LoginAttemptIP    = "ip"
+)
+
+// loginThrottle describes when failed logins for one kind of key start to slow down and lock.
+type loginThrottle struct {
+	BackoffAfter int
+	LockAfter    int
+}
+
+var loginAttemptCollection *mongo.Collection = database.OpenCollection(database.Client, "login_attempt")
+
+// An IP is shared by everyone behind the same NAT, so it gets more room than a single account.
+var loginThrottles = map[string]loginThrottle{
+	LoginAttemptEmail: {
+		BackoffAfter: intOrDefault("LOGIN_BACKOFF_AFTER", 3),
+		LockAfter:    intOrDefault("LOGIN_LOCKOUT_AFTER", 10),
+	},
+	LoginAttemptIP: {
+		BackoffAfter: intOrDefault("LOGIN_IP_BACKOFF_AFTER", 20),
+		LockAfter:    intOrDefault("LOGIN_IP_LOCKOUT_AFTER", 100),
+	},
+}
+
+// LOGIN_BACKOFF_BASE is the delay after the first failure past the backoff threshold, it doubles with every failure.
+var LOGIN_BACKOFF_BASE time.Duration = durationOrDefault("LOGIN_BACKOFF_BASE", time.Second)
+
+// LOGIN_BACKOFF_MAX caps the backoff delay.
+var LOGIN_BACKOFF_MAX time.Duration = durationOrDefault("LOGIN_BACKOFF_MAX", 5*time.Minute)
+
+// LOGIN_LOCKOUT_DURATION is how long a key stays locked once it reaches the lockout threshold.
+var LOGIN_LOCKOUT_DURATION time.Duration = durationOrDefault("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+
+// LOGIN_ATTEMPT_WINDOW is how long failures are remembered after the last one.
+var LOGIN_ATTEMPT_WINDOW time.Duration = durationOrDefault("LOGIN_ATTEMPT_WINDOW", time.Hour)
+
+func init() {
+	database.EnsureIndexes(loginAttemptCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+func loginAttemptKey(kind string, value string) string {
+	return kind + ":" + normalizeLoginValue(kind, value)
+}
+
+func normalizeLoginValue(kind string, value string) string {
+	value = strings.TrimSpace(value)
+	if kind == LoginAttemptEmail {
+		value = strings.ToLower(value)
+	}
+	return value
+}
+
+// LoginRetryAfter returns how long a login for the email from the IP has to wait.
+// Zero means the attempt may go ahead.
+func LoginRetryAfter(email string, ip string) (time.Duration, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := loginAttemptCollection.Find(ctx, bson.M{"key": bson.M{"$in": []string{
+		loginAttemptKey(LoginAttemptEmail, email),
+		loginAttemptKey(LoginAttemptIP, ip),
+	}}})
+	if err != nil {
+		return 0, err
+	}
+
+	var attempts []models.LoginAttempt
+	if err := cursor.All(ctx, &attempts); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for _, attempt := range attempts {
+		if retryAfter, blocked := LoginRetryAfterAttempt(attempt, now); blocked && retryAfter > wait {
+			wait = retryAfter
+		}
+	}
+	return wait, nil
+}
+
+// loginAttemptBlockedUntil is the earliest time the next login for this key is allowed.
+func loginAttemptBlockedUntil(attempt models.LoginAttempt) time.Time {
+	if attempt.Locked_until != nil {
+		return *attempt.Locked_until
+	}
+
+	throttle := loginThrottles[attempt.Kind]
+	if attempt.Failures < throttle.BackoffAfter {
+		return time.Time{}
+	}
+
+	exponent := float64(attempt.Failures - throttle.BackoffAfter)
+	delay := time.Duration(float64(LOGIN_BACKOFF_BASE) * math.Pow(2, exponent))
+	if delay > LOGIN_BACKOFF_MAX || delay <= 0 {
+		delay = LOGIN_BACKOFF_MAX
+	}
+	return attempt.Last_failure_at.Add(delay)
+}
+
+// LoginRetryAfterAttempt returns how long after `now` the next login for this
+// counter is allowed and whether it is blocked at all.
+func LoginRetryAfterAttempt(attempt models.LoginAttempt, now time.Time) (time.Duration, bool) {
+	until := loginAttemptBlockedUntil(attempt)
+	if !until.After(now) {
+		return 0, false
+	}
+	return until.Sub(now), true
+}
+
+// RecordLoginFailure counts a failed login against both the email and the IP,
+// locking either one once it reaches its threshold.
+func RecordLoginFailure(email string, ip string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	returnDocument := options.After
+	upsert := true
+
+	for kind, value := range map[string]string{LoginAttemptEmail: email, LoginAttemptIP: ip} {
+		if value == "" {
+			continue
+		}
+		key := loginAttemptKey(kind, value)
+
+		var attempt models.LoginAttempt
+		err := loginAttemptCollection.FindOneAndUpdate(
+			ctx,
+			bson.M{"key": key},
+			bson.M{
+				"$inc": bson.M{"failures": 1},
+				"$set": bson.M{
+					"kind":            kind,
+					"value":           normalizeLoginValue(kind, value),
+					"last_failure_at": now,
+					"expires_at":      now.Add(LOGIN_ATTEMPT_WINDOW + LOGIN_LOCKOUT_DURATION),
+				},
+			},
+			&options.FindOneAndUpdateOptions{Upsert: &upsert, ReturnDocument: &returnDocument},
+		).Decode(&attempt)
+		if err != nil {
+			return err
+		}
+
+		if attempt.Failures >= loginThrottles[kind].LockAfter {
+			_, err = loginAttemptCollection.UpdateOne(
+				ctx,
+				bson.M{"key": key},
+				bson.M{"$set": bson.M{"locked_until": now.Add(LOGIN_LOCKOUT_DURATION)}},
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ClearLoginFailures forgets the failures for an email after a successful login.
+// The IP counter is kept so one valid account can't be used to reset it.
+func ClearLoginFailures(email string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := loginAttemptCollection.DeleteOne(ctx, bson.M{"key": loginAttemptKey(LoginAttemptEmail, email)})
+	return err
+}
+
+// ListLoginAttempts returns the tracked failure counters, only the locked or
+// backed off ones when blockedOnly is set.
+func ListLoginAttempts(blockedOnly bool) ([]models.LoginAttempt, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := loginAttemptCollection.Find(
+		ctx,
+		bson.M{},
+		options.Find().SetSort(bson.D{{Key: "last_failure_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var attempts []models.LoginAttempt
+	if err := cursor.All(ctx, &attempts); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	filtered := []models.LoginAttempt{}
+	for _, attempt := range attempts {
+		if _, blocked := LoginRetryAfterAttempt(attempt, now); !blockedOnly || blocked {
+			filtered = append(filtered, attempt)
+		}
+	}
+	return filtered, nil
+}
+
+// ClearLoginAttempt removes the counter for an email or IP, lifting any lock on it.
+func ClearLoginAttempt(kind string, value string) (bool, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := loginAttemptCollection.DeleteOne(ctx, bson.M{"key": loginAttemptKey(kind, value)})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func intOrDefault(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value < 1 {
+		return fallback
+	}
+	return value
+}
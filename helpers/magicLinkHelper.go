@@ -0,0 +1,148 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidMagicLink = errors.New("this sign-in link is invalid or has expired")
+
+var magicLinkCollection *mongo.Collection = database.OpenCollection(database.Client, "magic_link")
+
+// MAGIC_LINK_TTL is how long an emailed sign-in link stays valid.
+var MAGIC_LINK_TTL time.Duration = durationOrDefault("MAGIC_LINK_TTL", 15*time.Minute)
+
+// MAGIC_LINK_RESEND_INTERVAL is the minimum time between two sign-in links to the same address.
+var MAGIC_LINK_RESEND_INTERVAL time.Duration = durationOrDefault("MAGIC_LINK_RESEND_INTERVAL", time.Minute)
+
+// At most this many sign-in links are sent to an address per hour.
+const maxMagicLinksPerHour = 5
+
+func init() {
+	database.EnsureIndexes(magicLinkCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// MagicLinkRetryAfter returns how long to wait before another sign-in link may
+// be sent to email, zero when one can be sent right away.
+func MagicLinkRetryAfter(email string) (time.Duration, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	sent, err := recentEmailSends(ctx, EmailSendMagicLink, normalizeLoginValue(LoginAttemptEmail, email), now, maxMagicLinksPerHour)
+	if err != nil {
+		return 0, err
+	}
+	return MagicLinkRetryAfterSends(sent, now), nil
+}
+
+// MagicLinkRetryAfterSends returns how long to wait at now before another
+// sign-in link may be sent, given when the earlier ones were sent, newest first.
+func MagicLinkRetryAfterSends(sent []time.Time, now time.Time) time.Duration {
+	return RetryAfterSends(sent, now, MAGIC_LINK_RESEND_INTERVAL, maxMagicLinksPerHour)
+}
+
+// SendMagicLink emails the user a link that signs them in once. Earlier links
+// that were not used yet stop working.
+func SendMagicLink(user *models.User) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	token, err := GenerateRandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = magicLinkCollection.UpdateMany(
+		ctx,
+		bson.M{"user_id": user.User_id, "used_at": nil},
+		bson.M{"$set": bson.M{"used_at": now}},
+	)
+	if err != nil {
+		return err
+	}
+
+	email := normalizeLoginValue(LoginAttemptEmail, *user.Email)
+	_, err = magicLinkCollection.InsertOne(ctx, models.MagicLink{
+		ID:         primitive.NewObjectID(),
+		User_id:    user.User_id,
+		Email:      email,
+		Token_hash: HashToken(token),
+		Created_at: now,
+		Expires_at: now.Add(MAGIC_LINK_TTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Links expire well within the hour the throttle looks back on
+	if err := recordEmailSend(ctx, EmailSendMagicLink, email, now); err != nil {
+		return err
+	}
+
+	return AppMailer.Send(MailMessage{
+		To:      *user.Email,
+		Subject: "Your Shive sign-in link",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nOpen the link below to sign in to Shive. It expires in %s and can only be used once.\n\n%s/login/magic-link?token=%s\n\nIf you did not ask for this, you can ignore this email.",
+			*user.Name,
+			MAGIC_LINK_TTL,
+			APP_URL,
+			token,
+		),
+	})
+}
+
+// RedeemMagicLink uses up a sign-in link and returns the current state of the
+// user it was sent to. Links stop working when the account's email changed since.
+func RedeemMagicLink(token string) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var link models.MagicLink
+	err := magicLinkCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"token_hash": HashToken(token),
+			"used_at":    nil,
+			"expires_at": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"used_at": now}},
+	).Decode(&link)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidMagicLink
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := findUser(ctx, link.User_id)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidMagicLink
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Email == nil || normalizeLoginValue(LoginAttemptEmail, *user.Email) != link.Email || !user.Email_verified {
+		return nil, ErrInvalidMagicLink
+	}
+	return user, nil
+}
@@ -0,0 +1,118 @@
+package helpers
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MailMessage is a plain text email.
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails. Use SMTPMailer in production and OutboxMailer for development and tests.
+type Mailer interface {
+	Send(message MailMessage) error
+}
+
+// SMTPMailer sends mail through an SMTP relay.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(message MailMessage) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	// The envelope sender has to be the bare address
+	sender, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Host+":"+m.Port, auth, sender.Address, []string{message.To}, formatMail(m.From, message))
+}
+
+// OutboxMailer writes every message to Dir as an .eml file, or to stdout when Dir is empty.
+type OutboxMailer struct {
+	Dir  string
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *OutboxMailer) Send(message MailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	content := formatMail(m.From, message)
+
+	if m.Dir == "" {
+		_, err := fmt.Fprintf(os.Stdout, "----- outbox -----\n%s\n------------------\n", content)
+		return err
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), primitive.NewObjectID().Hex())
+	return os.WriteFile(filepath.Join(m.Dir, name), content, 0o600)
+}
+
+// AppMailer is the mailer used by the controllers. It is a variable so tests can swap it out.
+var AppMailer Mailer = NewMailer()
+
+// APP_URL is the public address of the app, used to build links in emails.
+var APP_URL string = strings.TrimSuffix(envOrDefault("APP_URL", "http://localhost:8000"), "/")
+
+// NewMailer builds the mailer selected by MAILER, either "smtp" or "outbox" (the default).
+func NewMailer() Mailer {
+	from := envOrDefault("MAIL_FROM", "Shive <no-reply@shive.local>")
+
+	if os.Getenv("MAILER") == "smtp" {
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			log.Fatal("MAILER is smtp but SMTP_HOST is not set")
+		}
+		return &SMTPMailer{
+			Host:     host,
+			Port:     envOrDefault("SMTP_PORT", "587"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	}
+
+	return &OutboxMailer{Dir: os.Getenv("MAIL_OUTBOX_DIR"), From: from}
+}
+
+func formatMail(from string, message MailMessage) []byte {
+	// Header values must not be able to smuggle in extra headers
+	clean := strings.NewReplacer("\r", "", "\n", "")
+
+	headers := []string{
+		"From: " + clean.Replace(from),
+		"To: " + clean.Replace(message.To),
+		"Subject: " + clean.Replace(message.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + message.Body + "\r\n")
+}
@@ -0,0 +1,188 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var migrationCollection *mongo.Collection = database.OpenCollection(database.Client, "migration")
+
+// An unfinished migration is taken over by another instance after this long,
+// in case the instance that started it died.
+const migrationLease = 10 * time.Minute
+
+var errMigrationRunning = errors.New("another instance is applying this migration")
+
+type migration struct {
+	id          string
+	description string
+	up          func(ctx context.Context) error
+}
+
+// migrations run in this order, each at most once. Append new ones to the end
+// and never change one that was released, write another instead. They have to
+// be safe to run again, since an instance can die halfway through.
+var migrations = []migration{
+	{
+		id:          "001_movie_metadata",
+		description: "Backfill the movie metadata fields",
+		up:          backfillMovieMetadata,
+	},
+	{
+		id:          "002_movie_genre_ids",
+		description: "Move the single movie genre_id into the genre_ids list",
+		up:          convertMovieGenreIds,
+	},
+	{
+		id:          "003_movie_ratings",
+		description: "Backfill the movie average rating",
+		up:          backfillMovieRatings,
+	},
+}
+
+// RunMigrations applies the migrations that haven't been applied yet. Each one
+// is claimed in the migration collection first, so only one instance applies
+// it. Later migrations may depend on earlier ones, so it waits for a migration
+// another instance is applying and stops at the first one that fails.
+func RunMigrations() error {
+	for _, m := range migrations {
+		applied, err := applyMigration(m)
+		for err == errMigrationRunning {
+			log.Printf("Waiting for migration %s: %v", m.id, err)
+			time.Sleep(5 * time.Second)
+			applied, err = applyMigration(m)
+		}
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", m.id, err)
+		}
+		if applied {
+			log.Printf("Applied migration %s: %s", m.id, m.description)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs m unless it was applied already, and reports whether it ran.
+func applyMigration(m migration) (bool, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), migrationLease)
+	defer cancel()
+
+	now := time.Now()
+	upsert := true
+	var claimed models.Migration
+	err := migrationCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": m.id, "finished_at": nil, "started_at": bson.M{"$lt": now.Add(-migrationLease)}},
+		bson.M{"$set": bson.M{"description": m.description, "started_at": now, "finished_at": nil}},
+		&options.FindOneAndUpdateOptions{Upsert: &upsert},
+	).Decode(&claimed)
+
+	// The upsert inserts a document the filter can never match again, so a
+	// duplicate key means the migration is finished or another instance has it
+	if mongo.IsDuplicateKeyError(err) {
+		var existing models.Migration
+		if err := migrationCollection.FindOne(ctx, bson.M{"_id": m.id}).Decode(&existing); err != nil {
+			return false, err
+		}
+		if existing.Finished_at != nil {
+			return false, nil
+		}
+		return false, errMigrationRunning
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return false, err
+	}
+
+	if err := m.up(ctx); err != nil {
+		// Let the next start try again straight away
+		migrationCollection.DeleteOne(context.Background(), bson.M{"_id": m.id, "finished_at": nil})
+		return false, err
+	}
+
+	finished := time.Now()
+	_, err = migrationCollection.UpdateOne(
+		ctx,
+		bson.M{"_id": m.id},
+		bson.M{"$set": bson.M{"finished_at": finished}},
+	)
+	return true, err
+}
+
+// backfillMovieMetadata gives movies created before the metadata fields existed
+// empty values, so they decode and filter like new ones.
+func backfillMovieMetadata(ctx context.Context) error {
+	defaults := bson.D{
+		{Key: "release_date", Value: ""},
+		{Key: "runtime", Value: 0},
+		{Key: "original_language", Value: ""},
+		{Key: "spoken_languages", Value: bson.A{}},
+		{Key: "countries", Value: bson.A{}},
+		{Key: "synopsis", Value: ""},
+		{Key: "tagline", Value: ""},
+		{Key: "certification", Value: ""},
+		{Key: "production_companies", Value: bson.A{}},
+	}
+
+	for _, field := range defaults {
+		// Also covers fields that were stored as null
+		_, err := movieCollection.UpdateMany(
+			ctx,
+			bson.M{field.Key: nil},
+			bson.M{"$set": bson.M{field.Key: field.Value}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertMovieGenreIds turns the genre_id string of older movies into a
+// genre_ids list holding it, or an empty list when it was blank.
+func convertMovieGenreIds(ctx context.Context) error {
+	_, err := movieCollection.UpdateMany(
+		ctx,
+		bson.M{"genre_ids": bson.M{"$exists": false}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"genre_ids": bson.M{"$cond": bson.A{
+					bson.M{"$in": bson.A{bson.M{"$ifNull": bson.A{"$genre_id", ""}}, bson.A{""}}},
+					bson.A{},
+					bson.A{"$genre_id"},
+				}},
+			}}},
+			{{Key: "$unset", Value: "genre_id"}},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Movies that got genre_ids some other way lose the old field too
+	_, err = movieCollection.UpdateMany(
+		ctx,
+		bson.M{"genre_id": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"genre_id": ""}},
+	)
+	return err
+}
+
+// backfillMovieRatings starts movies created before ratings existed unrated.
+// Reviews had no rating then, so there is nothing to average.
+func backfillMovieRatings(ctx context.Context) error {
+	_, err := movieCollection.UpdateMany(
+		ctx,
+		bson.M{"average_rating": nil},
+		bson.M{"$set": bson.M{"average_rating": 0.0, "rating_count": 0}},
+	)
+	return err
+}
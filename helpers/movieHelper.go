@@ -0,0 +1,430 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shive/database"
+	"shive/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How the genres of a movie have to match a genre filter.
+const (
+	GenreMatchAny = "any"
+	GenreMatchAll = "all"
+)
+
+var ErrInvalidGenreMatch = errors.New("genre_match must be any or all")
+var ErrUnknownSortField = errors.New("unknown sort field")
+
+// MovieSortFields are the fields movies can be sorted on, by the name clients
+// use for them.
+var MovieSortFields = map[string]string{
+	"name":         "name",
+	"rating":       "average_rating",
+	"rating_count": "rating_count",
+	"release_date": "release_date",
+	"runtime":      "runtime",
+	"created_at":   "created_at",
+	"updated_at":   "updated_at",
+}
+
+// MovieSortIndexes are the sorts, besides one on each of MovieSortFields, that
+// an index serves, most rated first and then by name for instance.
+var MovieSortIndexes = []bson.D{
+	{{Key: "average_rating", Value: -1}, {Key: "name", Value: 1}},
+	{{Key: "release_date", Value: -1}, {Key: "name", Value: 1}},
+}
+
+// Names and languages sort and match regardless of case.
+var movieCollation = &options.Collation{Locale: "en", Strength: 2}
+
+var movieCollection *mongo.Collection = database.OpenCollection(database.Client, "movie")
+
+func init() {
+	database.EnsureIndexes(movieCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "movie_id", Value: 1}}},
+		{Keys: bson.D{{Key: "genre_ids", Value: 1}}},
+	})
+
+	// Each index ends with movie_id in the direction of its last field, so pages
+	// can walk it in either direction without sorting in memory
+	sortIndexes := []mongo.IndexModel{}
+	for _, keys := range movieSortIndexKeys() {
+		sortIndexes = append(sortIndexes, mongo.IndexModel{
+			Keys:    keys,
+			Options: options.Index().SetCollation(movieCollation),
+		})
+	}
+	database.EnsureIndexes(movieCollection, sortIndexes)
+}
+
+// UnknownGenres returns the IDs in genreIds that no genre has.
+func UnknownGenres(genreIds []string) ([]string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	unknown := []string{}
+	if len(genreIds) == 0 {
+		return unknown, nil
+	}
+
+	found, err := genreCollection.Distinct(ctx, "genre_id", bson.M{"genre_id": bson.M{"$in": genreIds}})
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, id := range found {
+		if id, ok := id.(string); ok {
+			known[id] = true
+		}
+	}
+
+	for _, id := range genreIds {
+		if !known[id] {
+			unknown = append(unknown, id)
+		}
+	}
+	return unknown, nil
+}
+
+// GenreFilter matches movies that have any, or all, of genreIds.
+func GenreFilter(genreIds []string, match string) (bson.M, error) {
+	switch match {
+	case GenreMatchAny, "":
+		return bson.M{"genre_ids": bson.M{"$in": genreIds}}, nil
+	case GenreMatchAll:
+		return bson.M{"genre_ids": bson.M{"$all": genreIds}}, nil
+	default:
+		return nil, ErrInvalidGenreMatch
+	}
+}
+
+// RemoveGenreFromMovies takes a deleted genre off every movie that had it.
+func RemoveGenreFromMovies(genreId string) (int64, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := movieCollection.UpdateMany(
+		ctx,
+		bson.M{"genre_ids": genreId},
+		bson.M{
+			"$pull": bson.M{"genre_ids": genreId},
+			"$set":  bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// MovieListFilter narrows and orders ListMovies. Zero fields match everything.
+type MovieListFilter struct {
+	GenreIds   []string
+	GenreMatch string
+	// Release years, both included
+	YearFrom int
+	YearTo   int
+	// Average rating, both included
+	RatingMin *float64
+	RatingMax *float64
+	// Original languages, any of them matches
+	Languages    []string
+	CreatedSince time.Time
+	CreatedUntil time.Time
+	UpdatedSince time.Time
+	UpdatedUntil time.Time
+	// Comma separated MovieSortFields, descending when prefixed with -
+	Sort string
+	Page Page
+}
+
+// ListMovies returns a page of the movies matching filter, read through the
+// index of its sort. How many match and the facet counts over all of them are
+// computed in one aggregation.
+func ListMovies(filter MovieListFilter) (*models.MovieListing, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	match, err := MovieListMatch(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	sort, err := MovieSort(filter.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, next, err := findPage(ctx, movieCollection, match, sort, filter.Page, MovieSortIndexed(sort), movieCollation)
+	if err != nil {
+		return nil, err
+	}
+
+	movies := make([]models.Movie, len(docs))
+	for i, doc := range docs {
+		if err := bson.Unmarshal(doc, &movies[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	countBy := func(key interface{}) bson.M {
+		return bson.M{"$group": bson.M{"_id": key, "count": bson.M{"$sum": 1}}}
+	}
+
+	cursor, err := movieCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$facet", Value: bson.M{
+			"total": bson.A{
+				bson.M{"$count": "count"},
+			},
+			"genres": bson.A{
+				bson.M{"$unwind": "$genre_ids"},
+				countBy("$genre_ids"),
+				bson.M{"$lookup": bson.M{"from": genreCollection.Name(), "localField": "_id", "foreignField": "genre_id", "as": "genre"}},
+				bson.M{"$project": bson.M{"_id": 0, "genre_id": "$_id", "name": bson.M{"$arrayElemAt": bson.A{"$genre.name", 0}}, "count": 1}},
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "genre_id", Value: 1}}},
+			},
+			"decades": bson.A{
+				bson.M{"$match": bson.M{"release_date": bson.M{"$gt": ""}}},
+				// 1979-05-25 is in the 1970s
+				countBy(bson.M{"$multiply": bson.A{
+					bson.M{"$floor": bson.M{"$divide": bson.A{
+						bson.M{"$toInt": bson.M{"$substrBytes": bson.A{"$release_date", 0, 4}}},
+						10,
+					}}},
+					10,
+				}}),
+				bson.M{"$project": bson.M{"_id": 0, "decade": "$_id", "count": 1}},
+				bson.M{"$sort": bson.M{"decade": 1}},
+			},
+			"languages": bson.A{
+				bson.M{"$match": bson.M{"original_language": bson.M{"$gt": ""}}},
+				countBy("$original_language"),
+				bson.M{"$project": bson.M{"_id": 0, "language": "$_id", "count": 1}},
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "language", Value: 1}}},
+			},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"total_count": bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$total.count", 0}}, 0}},
+			"facets": bson.M{
+				"genres":    "$genres",
+				"decades":   "$decades",
+				"languages": "$languages",
+			},
+		}}},
+	}, options.Aggregate().SetCollation(movieCollation))
+	if err != nil {
+		return nil, err
+	}
+
+	var listings []models.MovieListing
+	if err := cursor.All(ctx, &listings); err != nil {
+		return nil, err
+	}
+
+	listing := &listings[0]
+	listing.Movie_items = movies
+	listing.Next_cursor = next
+	return listing, nil
+}
+
+// MovieListMatch turns filter into the $match of ListMovies.
+func MovieListMatch(filter MovieListFilter) (bson.M, error) {
+	match := bson.M{}
+
+	if len(filter.GenreIds) > 0 {
+		genres, err := GenreFilter(filter.GenreIds, filter.GenreMatch)
+		if err != nil {
+			return nil, err
+		}
+		match["genre_ids"] = genres["genre_ids"]
+	}
+
+	// Release dates are YYYY-MM-DD strings, and movies without one are blank
+	if filter.YearFrom > 0 || filter.YearTo > 0 {
+		released := bson.M{"$gt": ""}
+		if filter.YearFrom > 0 {
+			released["$gte"] = fmt.Sprintf("%04d", filter.YearFrom)
+		}
+		if filter.YearTo > 0 {
+			released["$lte"] = fmt.Sprintf("%04d-12-31", filter.YearTo)
+		}
+		match["release_date"] = released
+	}
+
+	rating := bson.M{}
+	if filter.RatingMin != nil {
+		rating["$gte"] = *filter.RatingMin
+	}
+	if filter.RatingMax != nil {
+		rating["$lte"] = *filter.RatingMax
+	}
+	if len(rating) > 0 {
+		match["average_rating"] = rating
+		// Unrated movies have no rating to compare
+		match["rating_count"] = bson.M{"$gt": 0}
+	}
+
+	if len(filter.Languages) > 0 {
+		match["original_language"] = bson.M{"$in": filter.Languages}
+	}
+
+	for field, window := range map[string][2]time.Time{
+		"created_at": {filter.CreatedSince, filter.CreatedUntil},
+		"updated_at": {filter.UpdatedSince, filter.UpdatedUntil},
+	} {
+		between := bson.M{}
+		if !window[0].IsZero() {
+			between["$gte"] = window[0]
+		}
+		if !window[1].IsZero() {
+			between["$lt"] = window[1]
+		}
+		if len(between) > 0 {
+			match[field] = between
+		}
+	}
+
+	return match, nil
+}
+
+// MovieSort parses a sort such as "-rating,name" into a sort document. Movies
+// that tie on every field are ordered by movie_id, in the direction of the last
+// field. An empty sort is oldest first.
+func MovieSort(sort string) (bson.D, error) {
+	if strings.TrimSpace(sort) == "" {
+		sort = "created_at"
+	}
+
+	order := bson.D{}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(sort, ",") {
+		part = strings.TrimSpace(part)
+		direction := 1
+		if strings.HasPrefix(part, "-") {
+			direction = -1
+			part = part[1:]
+		}
+
+		field, ok := MovieSortFields[part]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownSortField, strconv.Quote(part))
+		}
+		if !seen[field] {
+			seen[field] = true
+			order = append(order, bson.E{Key: field, Value: direction})
+		}
+	}
+
+	return withMovieTiebreaker(order), nil
+}
+
+// MovieSortIndexed reports whether an index serves sort, as MovieSort returns
+// it, either way round. Only those sorts page by keyset.
+func MovieSortIndexed(sort bson.D) bool {
+	for _, keys := range movieSortIndexKeys() {
+		if sortsMatch(sort, keys, 1) || sortsMatch(sort, keys, -1) {
+			return true
+		}
+	}
+	return false
+}
+
+func movieSortIndexKeys() []bson.D {
+	keys := []bson.D{}
+	for _, field := range MovieSortFields {
+		keys = append(keys, withMovieTiebreaker(bson.D{{Key: field, Value: 1}}))
+	}
+	for _, sort := range MovieSortIndexes {
+		keys = append(keys, withMovieTiebreaker(sort))
+	}
+	return keys
+}
+
+// withMovieTiebreaker orders movies that tie on every field of sort by
+// movie_id, in the direction of its last field.
+func withMovieTiebreaker(sort bson.D) bson.D {
+	direction := 1
+	if len(sort) > 0 {
+		direction = sort[len(sort)-1].Value.(int)
+	}
+	order := append(bson.D{}, sort...)
+	return append(order, bson.E{Key: "movie_id", Value: direction})
+}
+
+// sortsMatch reports whether sort is keys with every direction multiplied by
+// direction.
+func sortsMatch(sort, keys bson.D, direction int) bool {
+	if len(sort) != len(keys) {
+		return false
+	}
+	for i := range sort {
+		value, ok := sort[i].Value.(int)
+		if !ok || sort[i].Key != keys[i].Key || value != keys[i].Value.(int)*direction {
+			return false
+		}
+	}
+	return true
+}
+
+// ReviewEditUpdate is the update that edits a review. A nil review or rating
+// keeps the one the review has.
+func ReviewEditUpdate(review *string, rating *int, now time.Time) bson.M {
+	set := bson.M{"updated_at": now}
+	if review != nil {
+		set["review"] = *review
+	}
+	if rating != nil {
+		set["rating"] = *rating
+	}
+	return bson.M{"$set": set}
+}
+
+// RefreshMovieRating recomputes the average rating of a movie from the ratings
+// of its reviews. Reviews without a rating don't count.
+func RefreshMovieRating(movieId string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := reviewCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"movie_id": movieId, "rating": bson.M{"$gte": 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     nil,
+			"average": bson.M{"$round": bson.A{bson.M{"$avg": "$rating"}, 2}},
+			"count":   bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	var ratings []struct {
+		Average float64 `bson:"average"`
+		Count   int     `bson:"count"`
+	}
+	if err := cursor.All(ctx, &ratings); err != nil {
+		return err
+	}
+
+	average, count := 0.0, 0
+	if len(ratings) > 0 {
+		average, count = ratings[0].Average, ratings[0].Count
+	}
+
+	_, err = movieCollection.UpdateOne(
+		ctx,
+		bson.M{"movie_id": movieId},
+		bson.M{"$set": bson.M{"average_rating": average, "rating_count": count}},
+	)
+	return err
+}
@@ -0,0 +1,250 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"html"
+	"shive/database"
+	"shive/models"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Searched movie fields, in the order snippets are taken from them.
+var movieSearchFields = []struct {
+	name   string
+	weight int
+	value  func(*models.Movie) string
+}{
+	{"name", 10, func(m *models.Movie) string { return deref(m.Name) }},
+	{"topic", 5, func(m *models.Movie) string { return deref(m.Topic) }},
+	{"tagline", 3, func(m *models.Movie) string { return m.Tagline }},
+	{"synopsis", 1, func(m *models.Movie) string { return m.Synopsis }},
+}
+
+const (
+	maxSearchQueryLength = 200
+	snippetLength        = 160
+	snippetLead          = 40
+)
+
+var ErrEmptySearch = errors.New("search query has no words")
+var ErrSearchTooLong = errors.New("search query is too long")
+
+func init() {
+	weights := bson.D{}
+	keys := bson.D{}
+	for _, field := range movieSearchFields {
+		keys = append(keys, bson.E{Key: field.name, Value: "text"})
+		weights = append(weights, bson.E{Key: field.name, Value: field.weight})
+	}
+
+	// A collection has only one text index, keep it apart so changing the
+	// weights can't stop the other movie indexes from being created
+	database.EnsureIndexes(movieCollection, []mongo.IndexModel{
+		{Keys: keys, Options: options.Index().SetName("movie_text").SetWeights(weights)},
+	})
+}
+
+// SearchMovies returns a page of the movies matching query, best match first,
+// how many match in total and the cursor of the next page, empty on the last
+// one. query is taken literally, the words in it are ORed and matched on their
+// stems. No index serves the ranking, so pages skip the movies before them.
+func SearchMovies(query string, page Page) ([]models.MovieSearchResult, int64, string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	terms, err := SearchTerms(query)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	filter := bson.M{"$text": bson.M{"$search": strings.Join(terms, " ")}}
+	score := bson.M{"$meta": "textScore"}
+	sort := bson.D{{Key: "score", Value: score}, {Key: "movie_id", Value: 1}}
+
+	offset := page.Offset
+	if page.After != "" {
+		if offset, err = DecodeOffsetCursor(page.After, sort); err != nil {
+			return nil, 0, "", err
+		}
+	}
+
+	total, err := movieCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	cursor, err := movieCollection.Find(
+		ctx,
+		filter,
+		options.Find().
+			SetProjection(bson.M{"score": score}).
+			SetSort(sort).
+			SetSkip(offset).
+			SetLimit(page.Limit),
+	)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	results := []models.MovieSearchResult{}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, 0, "", err
+	}
+
+	for i := range results {
+		results[i].Snippet = movieSnippet(&results[i].Movie, terms)
+	}
+
+	var next string
+	if offset+page.Limit < total {
+		if next, err = EncodeOffsetCursor(sort, offset+page.Limit); err != nil {
+			return nil, 0, "", err
+		}
+	}
+	return results, total, next, nil
+}
+
+// SearchTerms splits query into words, dropping the quotes and leading minus
+// signs $search would read as phrases and negations.
+func SearchTerms(query string) ([]string, error) {
+	if len([]rune(query)) > maxSearchQueryLength {
+		return nil, ErrSearchTooLong
+	}
+
+	terms := []string{}
+	for _, word := range strings.Fields(strings.ReplaceAll(query, `"`, " ")) {
+		word = strings.TrimLeft(word, "-")
+		if word != "" {
+			terms = append(terms, word)
+		}
+	}
+
+	if len(terms) == 0 {
+		return nil, ErrEmptySearch
+	}
+	return terms, nil
+}
+
+// movieSnippet excerpts the first field, by weight, that contains a search term.
+func movieSnippet(movie *models.Movie, terms []string) *models.SearchSnippet {
+	stems := []string{}
+	for _, term := range terms {
+		if stem := SearchStem(term); stem != "" {
+			stems = append(stems, stem)
+		}
+	}
+
+	for _, field := range movieSearchFields {
+		if text, ok := Highlight(field.value(movie), stems); ok {
+			return &models.SearchSnippet{Field: field.name, Text: text}
+		}
+	}
+	return nil
+}
+
+// SearchStem roughly undoes English inflection, so that a search for "running"
+// still highlights "run" the way the text index matched it.
+func SearchStem(term string) string {
+	// Trim punctuation the text index splits words on, so "running!" still loses its suffix
+	stem := []rune(strings.TrimFunc(strings.ToLower(term), func(r rune) bool {
+		return !isWordRune(r)
+	}))
+	for _, suffix := range []string{"ing", "ies", "ed", "es", "ly", "s"} {
+		s := []rune(suffix)
+		if len(stem)-len(s) >= 3 && string(stem[len(stem)-len(s):]) == suffix {
+			stem = stem[:len(stem)-len(s)]
+			// running -> runn -> run
+			if n := len(stem); n > 3 && stem[n-1] == stem[n-2] && !strings.ContainsRune("aeiou", stem[n-1]) {
+				stem = stem[:n-1]
+			}
+			break
+		}
+	}
+	return string(stem)
+}
+
+// Highlight marks the words of text that start with one of stems, and cuts it
+// down to snippetLength runes around the first of them.
+func Highlight(text string, stems []string) (string, bool) {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	type match struct{ start, end int }
+	var matches []match
+	for i := 0; i < len(runes); i++ {
+		if i > 0 && isWordRune(runes[i-1]) {
+			continue
+		}
+		for _, stem := range stems {
+			s := []rune(stem)
+			if i+len(s) <= len(lower) && string(lower[i:i+len(s)]) == stem {
+				end := i + len(s)
+				for end < len(runes) && isWordRune(runes[end]) {
+					end++
+				}
+				matches = append(matches, match{i, end})
+				i = end - 1
+				break
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		return "", false
+	}
+
+	start := max(0, matches[0].start-snippetLead)
+	end := min(len(runes), start+snippetLength)
+	// Don't start or end halfway through a word
+	for start > 0 && isWordRune(runes[start-1]) && start < matches[0].start {
+		start++
+	}
+	for unicode.IsSpace(runes[start]) && start < matches[0].start {
+		start++
+	}
+	for end < len(runes) && isWordRune(runes[end]) && end > matches[0].end {
+		end--
+	}
+
+	var snippet strings.Builder
+	if start > 0 {
+		snippet.WriteString("…")
+	}
+	at := start
+	for _, m := range matches {
+		if m.start < at || m.end > end {
+			continue
+		}
+		snippet.WriteString(html.EscapeString(string(runes[at:m.start])))
+		snippet.WriteString("<mark>")
+		snippet.WriteString(html.EscapeString(string(runes[m.start:m.end])))
+		snippet.WriteString("</mark>")
+		at = m.end
+	}
+	snippet.WriteString(html.EscapeString(strings.TrimRightFunc(string(runes[at:end]), unicode.IsSpace)))
+	if end < len(runes) {
+		snippet.WriteString("…")
+	}
+	return snippet.String(), true
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
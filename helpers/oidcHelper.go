@@ -0,0 +1,372 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"shive/database"
+	"shive/models"
+	"shive/oidc"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrOidcNotConfigured     = errors.New("single sign-on is not configured")
+	ErrInvalidOidcState      = errors.New("this single sign-on request is invalid or has expired, please start again")
+	ErrOidcLoginFailed       = errors.New("single sign-on failed")
+	ErrOidcAccountConflict   = errors.New("an account with this email is already linked to another identity")
+	ErrOidcEmailRequired     = errors.New("the identity provider did not share a verified email address")
+	ErrOidcUnverifiedAccount = errors.New("an account with this email exists but has not verified it, verify it and sign in again")
+)
+
+var oidcStateCollection *mongo.Collection = database.OpenCollection(database.Client, "oidc_state")
+
+// OpenID Connect client settings. Single sign-on is off unless OIDC_ISSUER and OIDC_CLIENT_ID are set.
+var (
+	OIDC_ISSUER        string   = envOrDefault("OIDC_ISSUER", "")
+	OIDC_CLIENT_ID     string   = envOrDefault("OIDC_CLIENT_ID", "")
+	OIDC_CLIENT_SECRET string   = envOrDefault("OIDC_CLIENT_SECRET", "")
+	OIDC_REDIRECT_URL  string   = envOrDefault("OIDC_REDIRECT_URL", APP_URL+"/users/oidc/callback")
+	OIDC_SCOPES        []string = splitList(strings.ReplaceAll(envOrDefault("OIDC_SCOPES", "openid email profile"), " ", ","))
+	OIDC_GROUPS_CLAIM  string   = envOrDefault("OIDC_GROUPS_CLAIM", "groups")
+	// Members of any of these groups sign in as ADMIN, everyone else as USER
+	OIDC_ADMIN_GROUPS []string = splitList(envOrDefault("OIDC_ADMIN_GROUPS", ""))
+)
+
+// How long a user has to finish signing in at the identity provider.
+const oidcStateLifetime = 10 * time.Minute
+
+var oidcProvider struct {
+	sync.Mutex
+	provider *oidc.Provider
+}
+
+func init() {
+	database.EnsureIndexes(oidcStateCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "state_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// OidcEnabled reports whether single sign-on is configured.
+func OidcEnabled() bool {
+	return OIDC_ISSUER != "" && OIDC_CLIENT_ID != ""
+}
+
+// StartOidcLogin remembers a new login attempt and returns the identity
+// provider URL the user has to be sent to.
+func StartOidcLogin() (string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	provider, err := currentOidcProvider(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := GenerateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		return "", err
+	}
+
+	sealedVerifier, err := SealSecret(verifier)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = oidcStateCollection.InsertOne(ctx, models.OidcState{
+		ID:            primitive.NewObjectID(),
+		State_hash:    HashToken(state),
+		Nonce:         nonce,
+		Code_verifier: sealedVerifier,
+		Created_at:    now,
+		Expires_at:    now.Add(oidcStateLifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return provider.AuthCodeURL(state, nonce, challenge), nil
+}
+
+// FinishOidcLogin redeems the code the identity provider sent back and returns
+// the matching user, creating it on first sign in. mfa reports whether the
+// provider says it checked more than one factor.
+func FinishOidcLogin(state string, code string) (user *models.User, mfa bool, err error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	provider, err := currentOidcProvider(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Every state can only come back once
+	var pending models.OidcState
+	err = oidcStateCollection.FindOneAndDelete(
+		ctx,
+		bson.M{"state_hash": HashToken(state), "expires_at": bson.M{"$gt": time.Now()}},
+	).Decode(&pending)
+	if err == mongo.ErrNoDocuments {
+		return nil, false, ErrInvalidOidcState
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	verifier, err := OpenSecret(pending.Code_verifier)
+	if err != nil {
+		return nil, false, err
+	}
+
+	identity, err := provider.Login(ctx, code, verifier, pending.Nonce)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrOidcLoginFailed, err)
+	}
+
+	user, err = provisionOidcUser(ctx, identity)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return user, containsString(identity.AMR, "mfa"), nil
+}
+
+// provisionOidcUser finds the user linked to the identity, links an existing
+// account with the same email when both sides verified it, or creates a new user.
+func provisionOidcUser(ctx context.Context, identity *oidc.Identity) (*models.User, error) {
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.M{"oidc_issuer": identity.Issuer, "oidc_subject": identity.Subject}).Decode(&user)
+
+	if err == mongo.ErrNoDocuments {
+		// Only an address the provider vouches for may take over an existing account
+		if identity.Email == "" || !identity.EmailVerified {
+			return nil, ErrOidcEmailRequired
+		}
+
+		emailMatch := bson.M{"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(identity.Email) + "$", Options: "i"}}
+		err = userCollection.FindOne(ctx, bson.M{"email": emailMatch}).Decode(&user)
+
+		if err == mongo.ErrNoDocuments {
+			return createOidcUser(ctx, identity)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if user.Oidc_subject != nil {
+			return nil, ErrOidcAccountConflict
+		}
+		// Anyone could have signed up with the address, and linking would leave
+		// them their password
+		if !user.Email_verified {
+			return nil, ErrOidcUnverifiedAccount
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	update := bson.M{
+		"oidc_issuer":  identity.Issuer,
+		"oidc_subject": identity.Subject,
+		"updated_at":   time.Now(),
+	}
+	if identity.EmailVerified && !user.Email_verified && user.Email != nil && strings.EqualFold(*user.Email, identity.Email) {
+		update["email_verified"] = true
+		update["email_verified_at"] = time.Now()
+	}
+
+	changes := bson.M{"$set": update}
+
+	// The identity provider decides between ADMIN and USER once admin groups are
+	// configured. Tokens issued under the old role are revoked.
+	fromRole := ""
+	if user.User_type != nil {
+		fromRole = *user.User_type
+	}
+	toRole, changed := OidcSyncedRole(fromRole, oidcUserType(identity))
+	if len(OIDC_ADMIN_GROUPS) > 0 && changed {
+		var lastAdmin error
+		if fromRole == AdminRole {
+			lastAdmin = verifyNotLastAdmin(ctx)
+		}
+		switch {
+		case lastAdmin == ErrLastAdmin:
+			log.Printf("Keeping ADMIN for user %s, who left the admin groups but is the last ADMIN", user.User_id)
+		case lastAdmin != nil:
+			return nil, lastAdmin
+		default:
+			update["user_type"] = toRole
+			changes["$inc"] = bson.M{"token_version": 1}
+		}
+	}
+
+	returnDocument := options.After
+	err = userCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"user_id": user.User_id},
+		changes,
+		&options.FindOneAndUpdateOptions{ReturnDocument: &returnDocument},
+	).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, revoked := changes["$inc"]; revoked {
+		if _, err := refreshTokenCollection.UpdateMany(ctx, bson.M{"user_id": user.User_id}, bson.M{"$set": bson.M{"revoked": true}}); err != nil {
+			return nil, err
+		}
+		err = recordUserAdminAction(ctx, models.UserAdminAction{
+			User_id:   user.User_id,
+			Action:    UserActionRoleChange,
+			Reason:    "Synced from the identity provider's groups",
+			From_role: fromRole,
+			To_role:   toRole,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func createOidcUser(ctx context.Context, identity *oidc.Identity) (*models.User, error) {
+	username, err := availableUsername(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	name := identity.Name
+	if len(name) < 4 {
+		name = username
+	}
+
+	now := time.Now()
+	role := oidcUserType(identity)
+	email := identity.Email
+	issuer := identity.Issuer
+	subject := identity.Subject
+
+	user := models.User{
+		ID:           primitive.NewObjectID(),
+		Name:         &name,
+		Username:     &username,
+		Email:        &email,
+		User_type:    &role,
+		Created_at:   now,
+		Updated_at:   now,
+		Oidc_issuer:  &issuer,
+		Oidc_subject: &subject,
+		// Only reached for addresses the provider has verified
+		Email_verified:    true,
+		Email_verified_at: &now,
+	}
+	user.User_id = user.ID.Hex()
+
+	if _, err := userCollection.InsertOne(ctx, user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// availableUsername derives a username from the identity and adds a suffix when it is taken.
+func availableUsername(ctx context.Context, identity *oidc.Identity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = regexp.MustCompile(`[^A-Za-z0-9._-]`).ReplaceAllString(base, "")
+	for len(base) < 4 {
+		base += "0"
+	}
+	if len(base) > 90 {
+		base = base[:90]
+	}
+
+	username := base
+	for attempt := 0; attempt < 5; attempt++ {
+		usernameMatch := bson.M{"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(username) + "$", Options: "i"}}
+		count, err := userCollection.CountDocuments(ctx, bson.M{"username": usernameMatch})
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return username, nil
+		}
+
+		suffix, err := GenerateRandomToken(3)
+		if err != nil {
+			return "", err
+		}
+		username = base + "-" + strings.ToLower(suffix)
+	}
+	return "", errors.New("could not find a free username")
+}
+
+func oidcUserType(identity *oidc.Identity) string {
+	for _, group := range identity.Groups {
+		if containsString(OIDC_ADMIN_GROUPS, group) {
+			return AdminRole
+		}
+	}
+	return DefaultSignupRole
+}
+
+// OidcSyncedRole returns the role a user with role current gets from the
+// identity provider's groups, which map to groupsRole, and whether it changed.
+// Only ADMIN and USER are synced. Other roles were given by hand and are kept.
+func OidcSyncedRole(current string, groupsRole string) (string, bool) {
+	if current != "" && current != AdminRole && current != DefaultSignupRole {
+		return current, false
+	}
+	return groupsRole, groupsRole != current
+}
+
+// currentOidcProvider loads the provider's discovery document on first use and
+// keeps retrying on later requests if the provider could not be reached.
+func currentOidcProvider(ctx context.Context) (*oidc.Provider, error) {
+	if !OidcEnabled() {
+		return nil, ErrOidcNotConfigured
+	}
+
+	oidcProvider.Lock()
+	defer oidcProvider.Unlock()
+
+	if oidcProvider.provider != nil {
+		return oidcProvider.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, oidc.Config{
+		Issuer:       OIDC_ISSUER,
+		ClientID:     OIDC_CLIENT_ID,
+		ClientSecret: OIDC_CLIENT_SECRET,
+		RedirectURL:  OIDC_REDIRECT_URL,
+		Scopes:       OIDC_SCOPES,
+		GroupsClaim:  OIDC_GROUPS_CLAIM,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	oidcProvider.provider = provider
+	return provider, nil
+}
@@ -0,0 +1,211 @@
+package helpers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page picks the items of a sorted list to return. Items come after the After
+// cursor when it is set, or after skipping Offset items for clients that still
+// page by number.
+type Page struct {
+	After  string
+	Offset int64
+	Limit  int64
+}
+
+// pageCursor is what an opaque cursor holds: the sort it was made for and the
+// sort values of the last item of its page, or for sorts no index serves, how
+// many items came before the next page.
+type pageCursor struct {
+	Sort   string          `bson:"s"`
+	Values []bson.RawValue `bson:"v,omitempty"`
+	Offset int64           `bson:"o,omitempty"`
+}
+
+// Only plain values can come back from a cursor, so a crafted one can't slip
+// query operators into the filter.
+var cursorValueTypes = map[bsontype.Type]bool{
+	bson.TypeString:   true,
+	bson.TypeInt32:    true,
+	bson.TypeInt64:    true,
+	bson.TypeDouble:   true,
+	bson.TypeBoolean:  true,
+	bson.TypeDateTime: true,
+	bson.TypeObjectID: true,
+	bson.TypeNull:     true,
+}
+
+// findPage finds one page of the documents matching filter in sort order, and
+// returns the cursor of the next page, empty on the last one. sort has to end
+// with a unique field so every document has its own place. Pages continue from
+// the sort values of the last item when an index serves sort, which keyset says.
+// Otherwise they skip the items before them. collation may be nil.
+func findPage(ctx context.Context, collection *mongo.Collection, filter bson.M, sort bson.D, page Page, keyset bool, collation *options.Collation) ([]bson.Raw, string, error) {
+	find := options.Find().SetSort(sort).SetLimit(page.Limit + 1)
+	if collation != nil {
+		find.SetCollation(collation)
+	}
+
+	offset := page.Offset
+	switch {
+	case page.After != "" && keyset:
+		values, err := DecodeCursor(page.After, sort)
+		if err != nil {
+			return nil, "", err
+		}
+		filter = bson.M{"$and": bson.A{filter, KeysetFilter(sort, values)}}
+		offset = 0
+	case page.After != "":
+		var err error
+		if offset, err = DecodeOffsetCursor(page.After, sort); err != nil {
+			return nil, "", err
+		}
+	}
+	find.SetSkip(offset)
+
+	cursor, err := collection.Find(ctx, filter, find)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var docs []bson.Raw
+	for cursor.Next(ctx) {
+		docs = append(docs, append(bson.Raw{}, cursor.Current...))
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, "", err
+	}
+
+	// The extra document only says there is another page
+	if int64(len(docs)) <= page.Limit {
+		return docs, "", nil
+	}
+	docs = docs[:page.Limit]
+
+	var next string
+	if keyset {
+		next, err = EncodeCursor(sort, docs[len(docs)-1])
+	} else {
+		next, err = EncodeOffsetCursor(sort, offset+page.Limit)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return docs, next, nil
+}
+
+// KeysetFilter matches the documents that sort after values. For a sort on a
+// then b that is a after values[0], or a equal to it and b after values[1].
+func KeysetFilter(sort bson.D, values []bson.RawValue) bson.M {
+	after := bson.A{}
+	for i, key := range sort {
+		clause := bson.M{}
+		for j := 0; j < i; j++ {
+			clause[sort[j].Key] = values[j]
+		}
+
+		operator := "$gt"
+		if key.Value == -1 {
+			operator = "$lt"
+		}
+		clause[key.Key] = bson.M{operator: values[i]}
+		after = append(after, clause)
+	}
+	return bson.M{"$or": after}
+}
+
+// EncodeCursor makes the cursor of the page that follows last, for sort.
+func EncodeCursor(sort bson.D, last bson.Raw) (string, error) {
+	values := make([]bson.RawValue, len(sort))
+	for i, key := range sort {
+		value, err := last.LookupErr(key.Key)
+		if err != nil {
+			value = bson.RawValue{Type: bson.TypeNull, Value: []byte{}}
+		}
+		values[i] = value
+	}
+
+	raw, err := bson.Marshal(pageCursor{Sort: sortKey(sort), Values: values})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// DecodeCursor reads the sort values out of a cursor made for sort.
+func DecodeCursor(cursor string, sort bson.D) ([]bson.RawValue, error) {
+	decoded, err := readCursor(cursor, sort)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decoded.Values) != len(sort) {
+		return nil, ErrInvalidCursor
+	}
+	for _, value := range decoded.Values {
+		if !cursorValueTypes[value.Type] {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return decoded.Values, nil
+}
+
+// EncodeOffsetCursor makes the cursor of a page that starts after offset items
+// of a listing in sort order.
+func EncodeOffsetCursor(sort bson.D, offset int64) (string, error) {
+	raw, err := bson.Marshal(pageCursor{Sort: sortKey(sort), Offset: offset})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// DecodeOffsetCursor reads how many items to skip out of a cursor made for sort.
+func DecodeOffsetCursor(cursor string, sort bson.D) (int64, error) {
+	decoded, err := readCursor(cursor, sort)
+	if err != nil {
+		return 0, err
+	}
+	if len(decoded.Values) != 0 || decoded.Offset < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return decoded.Offset, nil
+}
+
+func readCursor(cursor string, sort bson.D) (*pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var decoded pageCursor
+	if err := bson.Unmarshal(raw, &decoded); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	// A cursor from a listing sorted another way would skip or repeat items
+	if decoded.Sort != sortKey(sort) {
+		return nil, fmt.Errorf("%w: it was made for another sort", ErrInvalidCursor)
+	}
+	return &decoded, nil
+}
+
+// sortKey names a sort, such as "average_rating:-1,movie_id:1".
+func sortKey(sort bson.D) string {
+	parts := make([]string, len(sort))
+	for i, key := range sort {
+		parts[i] = fmt.Sprintf("%s:%v", key.Key, key.Value)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,159 @@
+package helpers
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PASSWORD_MIN_LENGTH is the shortest password accepted.
+var PASSWORD_MIN_LENGTH int = intOrDefault("PASSWORD_MIN_LENGTH", 8)
+
+// PASSWORD_MIN_CLASSES is how many of lowercase, uppercase, digits and symbols a password has to mix.
+var PASSWORD_MIN_CLASSES int = intOrDefault("PASSWORD_MIN_CLASSES", 2)
+
+// BCRYPT_COST is the cost new password hashes are created with. Login rehashes
+// stored passwords that were hashed with a different cost.
+var BCRYPT_COST int = bcryptCostOrDefault("BCRYPT_COST", 14)
+
+// bcrypt only looks at the first 72 bytes, longer passwords are refused rather than truncated
+const passwordMaxBytes = 72
+
+//go:embed data/breached-passwords.txt
+var bundledBreachedPasswords string
+
+var breachedPasswords = loadBreachedPasswords()
+
+// PasswordPolicyError lists every rule a password breaks.
+type PasswordPolicyError struct {
+	Problems []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password " + strings.Join(e.Problems, ", ")
+}
+
+// CheckPasswordPolicy returns a *PasswordPolicyError when password does not meet
+// the policy for the account with the given email and username.
+func CheckPasswordPolicy(password string, email string, username string) error {
+	var problems []string
+
+	if len([]rune(password)) < PASSWORD_MIN_LENGTH {
+		problems = append(problems, "must be at least "+strconv.Itoa(PASSWORD_MIN_LENGTH)+" characters long")
+	}
+	if len(password) > passwordMaxBytes {
+		problems = append(problems, "must be at most "+strconv.Itoa(passwordMaxBytes)+" bytes long")
+	}
+
+	if classes := PasswordClasses(password); classes < PASSWORD_MIN_CLASSES {
+		problems = append(problems, "must mix at least "+strconv.Itoa(PASSWORD_MIN_CLASSES)+" of lowercase letters, uppercase letters, digits and symbols")
+	}
+
+	lowered := strings.ToLower(password)
+	localPart, _, _ := strings.Cut(strings.ToLower(email), "@")
+	for _, personal := range []string{strings.ToLower(username), localPart} {
+		if len(personal) >= 3 && strings.Contains(lowered, personal) {
+			problems = append(problems, "must not contain your email or username")
+			break
+		}
+	}
+
+	if _, breached := breachedPasswords[lowered]; breached {
+		problems = append(problems, "is too common, it appears in known data breaches")
+	}
+
+	if len(problems) > 0 {
+		return &PasswordPolicyError{Problems: problems}
+	}
+	return nil
+}
+
+// HashPassword hashes a password with the configured bcrypt cost.
+func HashPassword(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), BCRYPT_COST)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// PasswordNeedsRehash reports whether a stored hash was made with a different cost than BCRYPT_COST.
+func PasswordNeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost != BCRYPT_COST
+}
+
+// PasswordClasses counts which of lowercase letters, uppercase letters, digits
+// and symbols password uses.
+func PasswordClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
+
+// loadBreachedPasswords reads the bundled list and, when PASSWORD_BREACHED_LIST_FILE
+// is set, the extra list in that file.
+func loadBreachedPasswords() map[string]struct{} {
+	passwords := map[string]struct{}{}
+	addPasswordList(passwords, strings.NewReader(bundledBreachedPasswords))
+
+	if path := os.Getenv("PASSWORD_BREACHED_LIST_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Printf("Error opening PASSWORD_BREACHED_LIST_FILE: %v", err)
+			return passwords
+		}
+		defer file.Close()
+		addPasswordList(passwords, file)
+	}
+
+	return passwords
+}
+
+func addPasswordList(passwords map[string]struct{}, list io.Reader) {
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading breached password list: %v", err)
+	}
+}
+
+func bcryptCostOrDefault(key string, fallback int) int {
+	cost := intOrDefault(key, fallback)
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		log.Printf("Invalid bcrypt cost %d for %s, using %d", cost, key, fallback)
+		return fallback
+	}
+	return cost
+}
@@ -0,0 +1,159 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidResetToken = errors.New("this password reset link is invalid or has expired")
+
+var passwordResetCollection *mongo.Collection = database.OpenCollection(database.Client, "password_reset")
+
+// PASSWORD_RESET_TTL is how long a password reset link stays valid.
+var PASSWORD_RESET_TTL time.Duration = durationOrDefault("PASSWORD_RESET_TTL", 30*time.Minute)
+
+// PASSWORD_RESET_RESEND_INTERVAL is the minimum time between two reset emails to the same account.
+var PASSWORD_RESET_RESEND_INTERVAL time.Duration = durationOrDefault("PASSWORD_RESET_RESEND_INTERVAL", time.Minute)
+
+// At most this many reset emails are sent to an account, or asked for from an
+// IP, per hour.
+const (
+	maxPasswordResetsPerHour      = 5
+	maxPasswordResetsPerIpPerHour = 20
+)
+
+func init() {
+	database.EnsureIndexes(passwordResetCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// PasswordResetRetryAfter returns how long to wait before another reset email
+// may be sent to the user or asked for from ip, zero when one can be sent right away.
+func PasswordResetRetryAfter(userId string, ip string) (time.Duration, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	userSent, err := recentEmailSends(ctx, EmailSendPasswordReset, userId, now, maxPasswordResetsPerHour)
+	if err != nil {
+		return 0, err
+	}
+	ipSent, err := recentEmailSends(ctx, EmailSendPasswordResetIp, ip, now, maxPasswordResetsPerIpPerHour)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := RetryAfterSends(userSent, now, PASSWORD_RESET_RESEND_INTERVAL, maxPasswordResetsPerHour)
+	if ipWait := RetryAfterSends(ipSent, now, 0, maxPasswordResetsPerIpPerHour); ipWait > wait {
+		wait = ipWait
+	}
+	return wait, nil
+}
+
+// CreatePasswordResetToken issues a new reset token for the user and invalidates
+// any earlier token that was not used yet. The plain token is only returned here.
+func CreatePasswordResetToken(userId string, ip string) (string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	token, err := GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = passwordResetCollection.UpdateMany(
+		ctx,
+		bson.M{"user_id": userId, "used_at": nil},
+		bson.M{"$set": bson.M{"used_at": now}},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = passwordResetCollection.InsertOne(ctx, models.PasswordReset{
+		ID:         primitive.NewObjectID(),
+		User_id:    userId,
+		Token_hash: HashToken(token),
+		Created_at: now,
+		Expires_at: now.Add(PASSWORD_RESET_TTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// The reset is purged once it expires, the throttle looks back a whole hour
+	if err := recordEmailSend(ctx, EmailSendPasswordReset, userId, now); err != nil {
+		return "", err
+	}
+	if err := recordEmailSend(ctx, EmailSendPasswordResetIp, ip, now); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// LookupPasswordResetToken returns the user a reset token belongs to without
+// using it up, so the new password can be checked first.
+func LookupPasswordResetToken(token string) (string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var reset models.PasswordReset
+	err := passwordResetCollection.FindOne(
+		ctx,
+		bson.M{
+			"token_hash": HashToken(token),
+			"used_at":    nil,
+			"expires_at": bson.M{"$gt": time.Now()},
+		},
+	).Decode(&reset)
+
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidResetToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return reset.User_id, nil
+}
+
+// RedeemPasswordResetToken marks a reset token as used and returns the user it
+// belongs to. A token can only be redeemed once.
+func RedeemPasswordResetToken(token string) (string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var reset models.PasswordReset
+	err := passwordResetCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"token_hash": HashToken(token),
+			"used_at":    nil,
+			"expires_at": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"used_at": now}},
+	).Decode(&reset)
+
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidResetToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return reset.User_id, nil
+}
@@ -0,0 +1,539 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"shive/database"
+	"shive/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Permissions checked by the API. Roles are granted permissions in the role_policy collection.
+const (
+	PermMovieCreate     = "movie:create"
+	PermMovieUpdate     = "movie:update"
+	PermMovieDelete     = "movie:delete"
+	PermGenreCreate     = "genre:create"
+	PermGenreList       = "genre:list"
+	PermGenreUpdate     = "genre:update"
+	PermGenreDelete     = "genre:delete"
+	PermReviewCreate    = "review:create"
+	PermReviewDelete    = "review:delete"
+	PermReviewModerate  = "review:moderate"
+	PermUserRead        = "user:read"
+	PermUserDelete      = "user:delete"
+	PermUserRole        = "user:role"
+	PermUserSuspend     = "user:suspend"
+	PermUserInvite      = "user:invite"
+	PermSessionManage   = "session:manage"
+	PermLoginLockManage = "login_lock:manage"
+	PermApiKeyManage    = "api_key:manage"
+	PermPolicyManage    = "policy:manage"
+	PermAuditRead       = "audit:read"
+
+	// PermAll grants every permission, including ones added later
+	PermAll = "*"
+)
+
+// Permissions describes every permission a role can be granted.
+var Permissions = map[string]string{
+	PermMovieCreate:     "Add movies",
+	PermMovieUpdate:     "Edit movies",
+	PermMovieDelete:     "Delete movies",
+	PermGenreCreate:     "Add genres",
+	PermGenreList:       "List all genres",
+	PermGenreUpdate:     "Edit genres",
+	PermGenreDelete:     "Delete genres",
+	PermReviewCreate:    "Write reviews",
+	PermReviewDelete:    "Delete your own reviews",
+	PermReviewModerate:  "Delete anyone's reviews",
+	PermUserRead:        "View other users' profiles and list users",
+	PermUserDelete:      "Schedule and cancel the deletion of other users' accounts",
+	PermUserRole:        "Change other users' roles",
+	PermUserSuspend:     "Suspend, ban and reinstate other users",
+	PermUserInvite:      "Invite people to sign up, giving roles other than USER also needs user:role",
+	PermSessionManage:   "View and revoke other users' sessions",
+	PermLoginLockManage: "View and clear failed login counters",
+	PermApiKeyManage:    "Create and revoke API keys",
+	PermPolicyManage:    "Edit role permissions and read the decision log",
+	PermAuditRead:       "Read the security audit log",
+}
+
+// defaultRolePolicies are created on startup when missing. Existing policies are
+// left alone so changes made through the API survive restarts.
+var defaultRolePolicies = []models.RolePolicy{
+	{
+		Role:        "ADMIN",
+		Description: "Can perform all operations",
+		Permissions: []string{PermAll},
+	},
+	{
+		Role:        "USER",
+		Description: "Can view content and manage their own reviews",
+		Permissions: []string{PermReviewCreate, PermReviewDelete},
+	},
+	{
+		Role:        "MODERATOR",
+		Description: "Keeps reviews civil",
+		Permissions: []string{PermReviewCreate, PermReviewDelete, PermReviewModerate, PermUserRead, PermUserSuspend},
+	},
+	{
+		Role:        "CURATOR",
+		Description: "Maintains the movie and genre catalog",
+		Permissions: []string{PermReviewCreate, PermReviewDelete, PermMovieCreate, PermMovieUpdate, PermGenreCreate, PermGenreList, PermGenreUpdate},
+	},
+}
+
+var (
+	ErrUnknownRole       = errors.New("this role does not exist")
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrInvalidRoleName   = errors.New("role names must be 2 to 32 uppercase letters, digits or underscores")
+	ErrBuiltInRole       = errors.New("built-in roles can not be deleted")
+	ErrRoleInUse         = errors.New("this role is still assigned to users or API keys")
+	ErrPolicyLockout     = errors.New("ADMIN must keep the policy:manage permission")
+)
+
+// PermissionError is returned when a caller's role lacks every permission a request accepts.
+type PermissionError struct {
+	Role        string
+	Permissions []string
+}
+
+func (e *PermissionError) Error() string {
+	return "role " + e.Role + " lacks permission " + strings.Join(e.Permissions, " or ")
+}
+
+var rolePolicyCollection *mongo.Collection = database.OpenCollection(database.Client, "role_policy")
+var permissionDecisionCollection *mongo.Collection = database.OpenCollection(database.Client, "permission_decision")
+
+// ROLE_POLICY_CACHE_TTL is how long policies are cached. Changes made on another
+// instance take up to this long to apply.
+var ROLE_POLICY_CACHE_TTL time.Duration = durationOrDefault("ROLE_POLICY_CACHE_TTL", 30*time.Second)
+
+// PERMISSION_DECISION_RETENTION is how long permission decisions are kept.
+var PERMISSION_DECISION_RETENTION time.Duration = durationOrDefault("PERMISSION_DECISION_RETENTION", 30*24*time.Hour)
+
+var roleNamePattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]{1,31}$`)
+
+var rolePolicyCache struct {
+	sync.Mutex
+	policies map[string]models.RolePolicy
+	loadedAt time.Time
+}
+
+func init() {
+	database.EnsureIndexes(rolePolicyCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "role", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	database.EnsureIndexes(permissionDecisionCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "uid", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// SeedRolePolicies creates the built-in roles that are missing.
+func SeedRolePolicies() error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	for _, policy := range defaultRolePolicies {
+		_, err := rolePolicyCollection.UpdateOne(
+			ctx,
+			bson.M{"role": policy.Role},
+			bson.M{"$setOnInsert": models.RolePolicy{
+				ID:          primitive.NewObjectID(),
+				Role:        policy.Role,
+				Description: policy.Description,
+				Permissions: policy.Permissions,
+				Built_in:    true,
+				Updated_by:  "system",
+				Created_at:  now,
+				Updated_at:  now,
+			}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Authorize checks that the caller's role has at least one of the permissions and
+// records the decision. It returns a *PermissionError, or ErrAdminMfaRequired when
+// the role may only be used after a second factor.
+func Authorize(c *gin.Context, permissions ...string) error {
+	role := c.GetString("user_type")
+	decision := models.PermissionDecision{
+		Uid:         c.GetString("uid"),
+		User_type:   role,
+		Auth_method: c.GetString("auth_method"),
+		Permissions: permissions,
+		Method:      c.Request.Method,
+		Path:        c.Request.URL.Path,
+		Ip:          c.ClientIP(),
+	}
+
+	grantedBy, err := roleGrantsAny(role, permissions)
+	switch {
+	case err != nil:
+		// Not recorded, nothing was decided
+		return err
+	case grantedBy == "":
+		err = &PermissionError{Role: role, Permissions: permissions}
+	case mfaRequiredFor(role) && !c.GetBool("mfa"):
+		err = ErrAdminMfaRequired
+	}
+
+	decision.Allowed = err == nil
+	if decision.Allowed {
+		decision.Granted_by = grantedBy
+	} else {
+		decision.Reason = err.Error()
+	}
+	recordPermissionDecision(decision)
+
+	return err
+}
+
+// AuthorizeRoleGrant checks that the caller may hand out role, to a new user or
+// an API key. Roles other than USER need user:role, and no role may grant a
+// permission the caller's own role lacks. Otherwise user:invite or
+// api_key:manage would be a way around both.
+func AuthorizeRoleGrant(c *gin.Context, role string) error {
+	if role != DefaultSignupRole {
+		if err := Authorize(c, PermUserRole); err != nil {
+			return err
+		}
+	}
+
+	covers, err := roleCoversRole(c.GetString("user_type"), role)
+	if err != nil {
+		return err
+	}
+	if !covers {
+		return ErrOutranked
+	}
+	return nil
+}
+
+// AuthorizeStatus is the HTTP status for an error from Authorize or AuthorizeRoleGrant.
+func AuthorizeStatus(err error) int {
+	var denied *PermissionError
+	if errors.As(err, &denied) || err == ErrAdminMfaRequired || err == ErrOutranked {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// HasPermission reports whether role is granted permission, without recording a decision.
+func HasPermission(role string, permission string) (bool, error) {
+	grantedBy, err := roleGrantsAny(role, []string{permission})
+	return grantedBy != "", err
+}
+
+// PermissionsCover reports whether granted includes every permission in wanted.
+// Only "*" covers "*", since it also grants permissions added later.
+func PermissionsCover(granted []string, wanted []string) bool {
+	if containsString(granted, PermAll) {
+		return true
+	}
+	for _, permission := range wanted {
+		if !containsString(granted, permission) {
+			return false
+		}
+	}
+	return true
+}
+
+// RoleCovers reports whether role is granted every permission of other in
+// policies. A role without a policy grants nothing.
+func RoleCovers(policies map[string]models.RolePolicy, role string, other string) bool {
+	return PermissionsCover(policies[role].Permissions, policies[other].Permissions)
+}
+
+// roleCoversRole is RoleCovers for the current policies.
+func roleCoversRole(role string, other string) (bool, error) {
+	policies, err := cachedRolePolicies()
+	if err != nil {
+		return false, err
+	}
+	return RoleCovers(policies, role, other), nil
+}
+
+// VerifyRolePolicyEdit returns ErrOutranked unless actorRole covers both role as
+// it is now and the permissions it would be given, so nobody can hand out
+// permissions they lack, to their own role included.
+func VerifyRolePolicyEdit(policies map[string]models.RolePolicy, actorRole string, role string, permissions []string) error {
+	granted := policies[actorRole].Permissions
+	if !PermissionsCover(granted, policies[role].Permissions) || !PermissionsCover(granted, permissions) {
+		return ErrOutranked
+	}
+	return nil
+}
+
+// roleGrantsAny returns the first of permissions the role is granted, or "" when it has none of them.
+func roleGrantsAny(role string, permissions []string) (string, error) {
+	policies, err := cachedRolePolicies()
+	if err != nil {
+		return "", err
+	}
+
+	policy, ok := policies[role]
+	if !ok {
+		return "", nil
+	}
+
+	for _, permission := range permissions {
+		if containsString(policy.Permissions, permission) || containsString(policy.Permissions, PermAll) {
+			return permission, nil
+		}
+	}
+	return "", nil
+}
+
+// RoleExists reports whether a policy exists for role.
+func RoleExists(role string) (bool, error) {
+	policies, err := cachedRolePolicies()
+	if err != nil {
+		return false, err
+	}
+	_, ok := policies[role]
+	return ok, nil
+}
+
+// ListRolePolicies returns every role policy ordered by role.
+func ListRolePolicies() ([]models.RolePolicy, error) {
+	policies, err := cachedRolePolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]models.RolePolicy, 0, len(policies))
+	for _, policy := range policies {
+		list = append(list, policy)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Role < list[j].Role })
+	return list, nil
+}
+
+// SaveRolePolicy creates a role or replaces its permissions. created reports whether the role is new.
+// actorRole has to cover the role and its new permissions.
+func SaveRolePolicy(role string, description string, permissions []string, updatedBy string, actorRole string) (policy *models.RolePolicy, created bool, err error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if !roleNamePattern.MatchString(role) {
+		return nil, false, ErrInvalidRoleName
+	}
+
+	permissions = dedupeStrings(permissions)
+	for _, permission := range permissions {
+		if _, known := Permissions[permission]; !known && permission != PermAll {
+			return nil, false, fmt.Errorf("%w %s", ErrUnknownPermission, permission)
+		}
+	}
+
+	// Someone has to be able to fix the policies afterwards
+	if role == "ADMIN" && !containsString(permissions, PermPolicyManage) && !containsString(permissions, PermAll) {
+		return nil, false, ErrPolicyLockout
+	}
+
+	policies, err := cachedRolePolicies()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := VerifyRolePolicyEdit(policies, actorRole, role, permissions); err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	result, err := rolePolicyCollection.UpdateOne(
+		ctx,
+		bson.M{"role": role},
+		bson.M{
+			"$set": bson.M{
+				"description": description,
+				"permissions": permissions,
+				"updated_by":  updatedBy,
+				"updated_at":  now,
+			},
+			"$setOnInsert": bson.M{
+				"_id":        primitive.NewObjectID(),
+				"built_in":   false,
+				"created_at": now,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var saved models.RolePolicy
+	if err := rolePolicyCollection.FindOne(ctx, bson.M{"role": role}).Decode(&saved); err != nil {
+		return nil, false, err
+	}
+
+	invalidateRolePolicies()
+	return &saved, result.UpsertedCount > 0, nil
+}
+
+// DeleteRolePolicy removes a custom role that nobody uses any more.
+func DeleteRolePolicy(role string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var policy models.RolePolicy
+	err := rolePolicyCollection.FindOne(ctx, bson.M{"role": role}).Decode(&policy)
+	if err == mongo.ErrNoDocuments {
+		return ErrUnknownRole
+	}
+	if err != nil {
+		return err
+	}
+	if policy.Built_in {
+		return ErrBuiltInRole
+	}
+
+	users, err := userCollection.CountDocuments(ctx, bson.M{"user_type": role})
+	if err != nil {
+		return err
+	}
+	keys, err := apiKeyCollection.CountDocuments(ctx, bson.M{"user_type": role, "revoked_at": nil, "expires_at": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if users > 0 || keys > 0 {
+		return ErrRoleInUse
+	}
+
+	if _, err := rolePolicyCollection.DeleteOne(ctx, bson.M{"role": role}); err != nil {
+		return err
+	}
+
+	invalidateRolePolicies()
+	return nil
+}
+
+// PermissionDecisionFilter narrows ListPermissionDecisions. Empty fields match everything.
+type PermissionDecisionFilter struct {
+	Uid        string
+	Permission string
+	Allowed    *bool
+	Since      time.Time
+	Limit      int64
+}
+
+// ListPermissionDecisions returns the newest decisions matching filter.
+func ListPermissionDecisions(filter PermissionDecisionFilter) ([]models.PermissionDecision, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := bson.M{}
+	if filter.Uid != "" {
+		query["uid"] = filter.Uid
+	}
+	if filter.Permission != "" {
+		query["permissions"] = filter.Permission
+	}
+	if filter.Allowed != nil {
+		query["allowed"] = *filter.Allowed
+	}
+	if !filter.Since.IsZero() {
+		query["created_at"] = bson.M{"$gte": filter.Since}
+	}
+
+	cursor, err := permissionDecisionCollection.Find(
+		ctx,
+		query,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(filter.Limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	decisions := []models.PermissionDecision{}
+	if err := cursor.All(ctx, &decisions); err != nil {
+		return nil, err
+	}
+	return decisions, nil
+}
+
+func recordPermissionDecision(decision models.PermissionDecision) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	decision.ID = primitive.NewObjectID()
+	decision.Created_at = now
+	decision.Expires_at = now.Add(PERMISSION_DECISION_RETENTION)
+
+	// A lost log entry shouldn't fail the request
+	if _, err := permissionDecisionCollection.InsertOne(ctx, decision); err != nil {
+		log.Printf("Error recording permission decision: %v", err)
+	}
+}
+
+// cachedRolePolicies returns every policy keyed by role, reloading them once the cache is stale.
+func cachedRolePolicies() (map[string]models.RolePolicy, error) {
+	rolePolicyCache.Lock()
+	defer rolePolicyCache.Unlock()
+
+	if rolePolicyCache.policies != nil && time.Since(rolePolicyCache.loadedAt) < ROLE_POLICY_CACHE_TTL {
+		return rolePolicyCache.policies, nil
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := rolePolicyCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var list []models.RolePolicy
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string]models.RolePolicy, len(list))
+	for _, policy := range list {
+		policies[policy.Role] = policy
+	}
+
+	rolePolicyCache.policies = policies
+	rolePolicyCache.loadedAt = time.Now()
+	return policies, nil
+}
+
+func invalidateRolePolicies() {
+	rolePolicyCache.Lock()
+	rolePolicyCache.policies = nil
+	rolePolicyCache.Unlock()
+}
+
+func dedupeStrings(items []string) []string {
+	unique := make([]string, 0, len(items))
+	for _, item := range items {
+		if !containsString(unique, item) {
+			unique = append(unique, item)
+		}
+	}
+	return unique
+}
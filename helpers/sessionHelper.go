@@ -0,0 +1,141 @@
+package helpers
+
+import (
+	"context"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SessionClient describes the device a request came from.
+type SessionClient struct {
+	User_agent string
+	Ip         string
+}
+
+var sessionCollection *mongo.Collection = database.OpenCollection(database.Client, "session")
+
+// Last seen is only written once per interval so every request doesn't cost a write.
+const sessionLastSeenInterval = time.Minute
+
+func init() {
+	database.EnsureIndexes(sessionCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "session_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "last_seen_at", Value: -1}}},
+		// A session ends with its last refresh token
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
+// recordSession creates the session for a new login or, for a refreshed one,
+// moves its last seen time and expiry forward.
+func recordSession(ctx context.Context, sessionId string, userId string, expiresAt time.Time, client SessionClient) error {
+	now := time.Now()
+	upsert := true
+	_, err := sessionCollection.UpdateOne(
+		ctx,
+		bson.M{"session_id": sessionId},
+		bson.M{
+			"$setOnInsert": bson.M{
+				"_id":        primitive.NewObjectID(),
+				"session_id": sessionId,
+				"user_id":    userId,
+				"created_at": now,
+			},
+			"$set": bson.M{
+				"user_agent":   client.User_agent,
+				"ip":           client.Ip,
+				"last_seen_at": now,
+				"expires_at":   expiresAt,
+			},
+		},
+		&options.UpdateOptions{Upsert: &upsert},
+	)
+	return err
+}
+
+// TouchSession returns ErrTokenRevoked when the session a token belongs to was
+// revoked, and otherwise records that it was just used. Tokens from before
+// sessions were tracked have no session and are let through.
+func TouchSession(sessionId string, client SessionClient) error {
+	if sessionId == "" {
+		return nil
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var session models.Session
+	err := sessionCollection.FindOne(ctx, bson.M{"session_id": sessionId}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if session.Revoked_at != nil {
+		return ErrTokenRevoked
+	}
+
+	now := time.Now()
+	if now.Sub(session.Last_seen_at) < sessionLastSeenInterval {
+		return nil
+	}
+
+	_, err = sessionCollection.UpdateOne(
+		ctx,
+		bson.M{"session_id": sessionId},
+		bson.M{"$set": bson.M{"last_seen_at": now, "user_agent": client.User_agent, "ip": client.Ip}},
+	)
+	return err
+}
+
+// ListSessions returns the user's active sessions, most recently used first.
+func ListSessions(userId string) ([]models.Session, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := sessionCollection.Find(
+		ctx,
+		bson.M{"user_id": userId, "revoked_at": nil, "expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "last_seen_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []models.Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeSession signs one of the user's devices out. It returns
+// mongo.ErrNoDocuments when the user has no such active session.
+func RevokeSession(userId string, sessionId string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count, err := sessionCollection.CountDocuments(ctx, bson.M{"session_id": sessionId, "user_id": userId, "revoked_at": nil})
+	if err != nil {
+		return err
+	}
+	if count < 1 {
+		return mongo.ErrNoDocuments
+	}
+
+	return RevokeTokenFamily(sessionId)
+}
+
+func revokeSessions(ctx context.Context, filter bson.M) error {
+	filter["revoked_at"] = nil
+	_, err := sessionCollection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	return err
+}
@@ -2,6 +2,9 @@ package helpers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"log"
 	"os"
 	"shive/database"
@@ -10,81 +13,159 @@ import (
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+const (
+	AccessTokenType  = "access"
+	RefreshTokenType = "refresh"
+)
+
+const (
+	accessTokenLifetime  = 12 * time.Hour
+	refreshTokenLifetime = 100 * time.Hour
+)
+
 type JwtSignedDetails struct {
-	Email     string
-	Name      string
-	Username  string
-	Uid       string
-	User_type string
+	Email         string
+	Name          string
+	Username      string
+	Uid           string
+	User_type     string
+	Token_type    string
+	Family_id     string
+	Token_version int
+	Mfa           bool
 	jwt.StandardClaims
 }
 
+var (
+	ErrInvalidRefreshToken = errors.New("this refresh token is invalid or has expired")
+	ErrRefreshTokenReused  = errors.New("this refresh token has already been used, all sessions from this login have been revoked")
+	ErrTokenRevoked        = errors.New("this token has been revoked, please login again")
+)
+
 var userCollection *mongo.Collection = database.OpenCollection(database.Client, "user")
+var refreshTokenCollection *mongo.Collection = database.OpenCollection(database.Client, "refresh_token")
+var revokedTokenCollection *mongo.Collection = database.OpenCollection(database.Client, "revoked_token")
 
 var SECRET_KEY string = os.Getenv("SECRET_KEY")
 
+func init() {
+	database.EnsureIndexes(userCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		// Single sign-on identities. Password accounts store a null subject,
+		// which $exists would also index
+		{
+			Keys: bson.D{{Key: "oidc_issuer", Value: 1}, {Key: "oidc_subject", Value: 1}},
+			Options: options.Index().SetName("oidc_identity").SetUnique(true).SetPartialFilterExpression(
+				bson.M{"oidc_subject": bson.M{"$type": "string"}},
+			),
+		},
+		// Accounts waiting out their deletion grace period
+		{
+			Keys: bson.D{{Key: "deletion_scheduled_at", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(
+				bson.M{"deletion_scheduled_at": bson.M{"$type": "date"}},
+			),
+		},
+	})
+	database.EnsureIndexes(refreshTokenCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "family_id", Value: 1}}},
+		// Let mongo prune refresh tokens once they can no longer be exchanged
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	database.EnsureIndexes(revokedTokenCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		// A revoked token only has to be remembered until it would have expired anyway
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+}
+
 func GenerateAllTokens(
 	email string,
 	name string,
 	userName string,
 	userType string,
-	uid string) (
+	uid string,
+	tokenVersion int,
+	mfa bool) (
+	signedToken string,
+	signedRefreshToken string,
+	err error,
+) {
+	// Every fresh login starts a new refresh token family
+	return generateTokenPair(email, name, userName, userType, uid, tokenVersion, mfa, primitive.NewObjectID().Hex())
+}
+
+func generateTokenPair(
+	email string,
+	name string,
+	userName string,
+	userType string,
+	uid string,
+	tokenVersion int,
+	mfa bool,
+	familyId string) (
 	signedToken string,
 	signedRefreshToken string,
 	err error,
 ) {
 
 	claims := &JwtSignedDetails{
-		Uid:       uid,
-		Email:     email,
-		Name:      name,
-		Username:  userName,
-		User_type: userType,
+		Uid:           uid,
+		Email:         email,
+		Name:          name,
+		Username:      userName,
+		User_type:     userType,
+		Token_type:    AccessTokenType,
+		Family_id:     familyId,
+		Token_version: tokenVersion,
+		Mfa:           mfa,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Local().Add(time.Hour * time.Duration(12)).Unix(),
+			Id:        primitive.NewObjectID().Hex(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Local().Add(accessTokenLifetime).Unix(),
 		},
 	}
 
 	refreshClaims := &JwtSignedDetails{
+		Uid:           uid,
+		Token_type:    RefreshTokenType,
+		Family_id:     familyId,
+		Token_version: tokenVersion,
+		Mfa:           mfa,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Local().Add(time.Hour * time.Duration(100)).Unix(),
+			Id:        primitive.NewObjectID().Hex(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Local().Add(refreshTokenLifetime).Unix(),
 		},
 	}
 
-	token, err := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		claims,
-	).SignedString(
-		[]byte(SECRET_KEY),
-	)
-	refreshToken, refreshTokenErr := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims).SignedString([]byte(SECRET_KEY))
-
+	// Signing can fail when no key is usable, which callers answer with a 500
+	token, err := signClaims(claims)
 	if err != nil {
-
-		log.Panic(err)
-
-		return
+		return "", "", err
 	}
-	if refreshTokenErr != nil {
-		log.Panic(refreshTokenErr)
-		return
+	refreshToken, err := signClaims(refreshClaims)
+	if err != nil {
+		return "", "", err
 	}
 
-	return token, refreshToken, err
+	return token, refreshToken, nil
 
 }
 
 func ValidateToken(signedToken string) (claims *JwtSignedDetails, msg string) {
-	token, err := jwt.ParseWithClaims(
+	// Only the pinned algorithms are accepted, so a token can not pick how it is verified
+	parser := &jwt.Parser{ValidMethods: JWT_ACCEPTED_ALGS}
+	token, err := parser.ParseWithClaims(
 		signedToken,
 		&JwtSignedDetails{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(SECRET_KEY), nil
-		},
+		verificationKey,
 	)
 
 	if err != nil {
@@ -109,54 +190,286 @@ func ValidateToken(signedToken string) (claims *JwtSignedDetails, msg string) {
 	return claims, msg
 }
 
-func UpdateTokens(signedToken string, signedRefreshedToken string, userId string) (*models.User, error) {
-	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+// HashToken returns the hex encoded SHA-256 digest of a token so that only a
+// fingerprint of it has to be persisted.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SaveRefreshToken records a freshly signed refresh token so it can later be
+// exchanged exactly once through RotateRefreshToken.
+func SaveRefreshToken(signedRefreshToken string, userId string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Initialize the update document
-	updateTokenDocs := bson.D{
-		{
-			Key:   "token",
-			Value: signedToken,
-		},
-		{
-			Key:   "refreshedToken",
-			Value: signedRefreshedToken,
+	claims, msg := ValidateToken(signedRefreshToken)
+	if msg != "" {
+		return errors.New(msg)
+	}
+
+	record := models.RefreshToken{
+		ID:         primitive.NewObjectID(),
+		Token_id:   claims.Id,
+		Family_id:  claims.Family_id,
+		User_id:    userId,
+		Token_hash: HashToken(signedRefreshToken),
+		Created_at: time.Now(),
+		Expires_at: time.Unix(claims.ExpiresAt, 0),
+	}
+
+	_, err := refreshTokenCollection.InsertOne(ctx, record)
+	return err
+}
+
+// RevokeTokenFamily revokes every refresh token that descends from the same login.
+func RevokeTokenFamily(familyId string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := refreshTokenCollection.UpdateMany(
+		ctx,
+		bson.M{"family_id": familyId},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return err
+	}
+
+	// The family is the session, so its access tokens stop working too
+	return revokeSessions(ctx, bson.M{"session_id": familyId})
+}
+
+// RevokeToken adds an access token to the revocation list until it expires
+// and revokes the refresh tokens that were issued alongside it.
+func RevokeToken(tokenId string, familyId string, userId string, expiresAt int64) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if tokenId != "" {
+		upsert := true
+		_, err := revokedTokenCollection.UpdateOne(
+			ctx,
+			bson.M{"token_id": tokenId},
+			bson.M{"$setOnInsert": models.RevokedToken{
+				ID:         primitive.NewObjectID(),
+				Token_id:   tokenId,
+				User_id:    userId,
+				Revoked_at: time.Now(),
+				Expires_at: time.Unix(expiresAt, 0),
+			}},
+			&options.UpdateOptions{Upsert: &upsert},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if familyId != "" {
+		return RevokeTokenFamily(familyId)
+	}
+	return nil
+}
+
+// RevokeAllUserTokens invalidates every access and refresh token a user holds
+// by bumping their token version.
+func RevokeAllUserTokens(userId string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := userCollection.UpdateOne(
+		ctx,
+		bson.M{"user_id": userId},
+		bson.M{
+			"$inc": bson.M{"token_version": 1},
+			"$set": bson.M{"updated_at": time.Now()},
 		},
-		{
-			Key:   "updated_at",
-			Value: time.Now()},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount < 1 {
+		return mongo.ErrNoDocuments
 	}
 
-	// Define filter based on the userId
-	filter := bson.M{"user_id": userId}
-	returnDocument := options.After
+	_, err = refreshTokenCollection.UpdateMany(
+		ctx,
+		bson.M{"user_id": userId},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+	if err != nil {
+		return err
+	}
+
+	return revokeSessions(ctx, bson.M{"user_id": userId})
+}
+
+// CheckTokenRevocation returns ErrTokenRevoked when the token was logged out or
+// was issued before the user's sessions were last revoked. Otherwise it returns
+// the current state of the user the token belongs to.
+func CheckTokenRevocation(claims *JwtSignedDetails) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if claims.Id != "" {
+		count, err := revokedTokenCollection.CountDocuments(ctx, bson.M{"token_id": claims.Id})
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.M{"user_id": claims.Uid}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrTokenRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Token_version != claims.Token_version {
+		return nil, ErrTokenRevoked
+	}
+	return &user, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new access/refresh pair.
+// The presented token is retired; presenting a retired token again is treated
+// as theft and revokes the whole family.
+func RotateRefreshToken(signedRefreshToken string, client SessionClient) (signedToken string, newRefreshToken string, err error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	claims, msg := ValidateToken(signedRefreshToken)
+	if msg != "" || claims.Token_type != RefreshTokenType || claims.Id == "" {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	var record models.RefreshToken
+	err = refreshTokenCollection.FindOne(ctx, bson.M{"token_id": claims.Id}).Decode(&record)
+	if err != nil {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	if record.Token_hash != HashToken(signedRefreshToken) || record.User_id != claims.Uid {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	if record.Revoked {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	if record.Replaced_by != "" {
+		if err := RevokeTokenFamily(record.Family_id); err != nil {
+			log.Printf("Error revoking token family %s: %v", record.Family_id, err)
+		}
+		auditClient(client, record.User_id, AuditTokenRefresh, record.Family_id, ErrRefreshTokenReused)
+		return "", "", ErrRefreshTokenReused
+	}
 
-	// Specify options for upsert and to return the updated document
-	upsert := true
+	var user models.User
+	err = userCollection.FindOne(ctx, bson.M{"user_id": record.User_id}).Decode(&user)
+	if err != nil || user.Token_version != claims.Token_version {
+		return "", "", ErrInvalidRefreshToken
+	}
+	if err := AccountRestriction(&user, time.Now()); err != nil {
+		return "", "", err
+	}
+
+	signedToken, newRefreshToken, err = generateTokenPair(
+		*user.Email,
+		*user.Name,
+		*user.Username,
+		*user.User_type,
+		user.User_id,
+		user.Token_version,
+		// A refreshed session keeps the factors it was signed in with
+		claims.Mfa,
+		record.Family_id,
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	newClaims, _ := ValidateToken(newRefreshToken)
+
+	// Only the first request to rotate a token may succeed, a concurrent second
+	// attempt will not match and is handled as a reuse.
+	result, err := refreshTokenCollection.UpdateOne(
+		ctx,
+		bson.M{"token_id": record.Token_id, "replaced_by": "", "revoked": false},
+		bson.M{"$set": bson.M{"replaced_by": newClaims.Id}},
+	)
+	if err != nil {
+		return "", "", err
+	}
+	if result.ModifiedCount < 1 {
+		if err := RevokeTokenFamily(record.Family_id); err != nil {
+			log.Printf("Error revoking token family %s: %v", record.Family_id, err)
+		}
+		auditClient(client, record.User_id, AuditTokenRefresh, record.Family_id, ErrRefreshTokenReused)
+		return "", "", ErrRefreshTokenReused
+	}
+
+	if _, err := UpdateTokens(signedToken, newRefreshToken, user.User_id, client); err != nil {
+		return "", "", err
+	}
+
+	return signedToken, newRefreshToken, nil
+}
+
+// UpdateTokens registers a freshly issued token pair: the refresh token so it
+// can be exchanged later on and the session it belongs to. Tokens are no longer
+// stored on the user, so logging in on one device leaves the others alone. The
+// returned user carries the new pair for the response.
+func UpdateTokens(signedToken string, signedRefreshedToken string, userId string, client SessionClient) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
+	defer cancel()
+
+	claims, msg := ValidateToken(signedRefreshedToken)
+	if msg != "" {
+		return nil, errors.New(msg)
+	}
+
+	if err := SaveRefreshToken(signedRefreshedToken, userId); err != nil {
+		log.Printf("Error saving refresh token for user %s: %v", userId, err.Error())
+		return nil, err
+	}
+
+	if err := recordSession(ctx, claims.Family_id, userId, time.Unix(claims.ExpiresAt, 0), client); err != nil {
+		log.Printf("Error recording session for user %s: %v", userId, err.Error())
+		return nil, err
+	}
+
+	// The session ID ties the event to every token refreshed from this pair
+	auditClient(client, userId, AuditTokenIssue, claims.Family_id, nil)
+
+	returnDocument := options.After
 	opt := options.FindOneAndUpdateOptions{
-		Upsert:         &upsert,
 		ReturnDocument: &returnDocument, // Return the updated document
 	}
 
-	// Perform the update operation and get the updated document back
+	// Drop the token copies older versions kept on the user
 	var updatedUser models.User
 	err := userCollection.FindOneAndUpdate(
 		ctx,
-		filter,
-		bson.D{
-			{
-				Key:   "$set",
-				Value: updateTokenDocs,
-			},
+		bson.M{"user_id": userId},
+		bson.M{
+			"$set":   bson.M{"updated_at": time.Now()},
+			"$unset": bson.M{"token": "", "refresh_token": ""},
 		},
 		&opt,
-	).Decode(&updatedUser) // Decode the result into updatedUser
+	).Decode(&updatedUser)
 
 	if err != nil {
 		log.Printf("Error updating token for user %s: %v", userId, err.Error())
 		return nil, err
 	}
 
+	updatedUser.Token = &signedToken
+	updatedUser.Refresh_token = &signedRefreshedToken
 	return &updatedUser, nil
 }
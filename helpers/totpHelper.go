@@ -0,0 +1,362 @@
+package helpers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"shive/models"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MfaChallengeTokenType is issued by Login instead of a token pair when the
+// user has two-factor authentication enabled.
+const MfaChallengeTokenType = "mfa_challenge"
+
+// RFC 6238 defaults, which is what authenticator apps expect.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes from the step before and after the current one are accepted to allow for clock drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrTotpAlreadyEnabled  = errors.New("two-factor authentication is already enabled")
+	ErrTotpNotEnabled      = errors.New("two-factor authentication is not enabled")
+	ErrTotpNotEnrolled     = errors.New("start two-factor enrollment before confirming it")
+	ErrInvalidTotpCode     = errors.New("this two-factor code is invalid or has already been used")
+	ErrInvalidMfaChallenge = errors.New("this login challenge is invalid or has expired, please login again")
+	ErrAdminMfaRequired    = errors.New("admins must sign in with two-factor authentication to access this")
+)
+
+var (
+	totpSecretEncoding   = base32.StdEncoding.WithPadding(base32.NoPadding)
+	recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+// TOTP_ISSUER is the name authenticator apps show next to the account.
+var TOTP_ISSUER string = strings.ReplaceAll(envOrDefault("TOTP_ISSUER", "Shive"), ":", "")
+
+// MFA_CHALLENGE_TTL is how long a login challenge can be exchanged for tokens.
+var MFA_CHALLENGE_TTL time.Duration = durationOrDefault("MFA_CHALLENGE_TTL", 5*time.Minute)
+
+// REQUIRE_ADMIN_2FA makes admin actions only available to tokens that were
+// issued after a second factor was checked.
+var REQUIRE_ADMIN_2FA bool = envOrDefault("REQUIRE_ADMIN_2FA", "false") == "true"
+
+// EnrollTotp generates a new secret for the user and stores it as pending until
+// it is confirmed with a code. It returns the secret and the otpauth:// URI to
+// render as a QR code.
+func EnrollTotp(userId string, accountName string) (secret string, provisioningURI string, err error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	secret = totpSecretEncoding.EncodeToString(raw)
+
+	sealed, err := SealSecret(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	result, err := userCollection.UpdateOne(
+		ctx,
+		bson.M{"user_id": userId, "totp_enabled": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"totp_pending_secret": sealed, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return "", "", err
+	}
+	if result.MatchedCount < 1 {
+		return "", "", ErrTotpAlreadyEnabled
+	}
+
+	return secret, totpProvisioningURI(secret, accountName), nil
+}
+
+// ConfirmTotp turns two-factor authentication on once the user proves their
+// authenticator produces valid codes. It returns the recovery codes, which are
+// only ever shown here.
+func ConfirmTotp(userId string, code string) ([]string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := userCollection.FindOne(ctx, bson.M{"user_id": userId}).Decode(&user); err != nil {
+		return nil, err
+	}
+
+	if user.Totp_enabled {
+		return nil, ErrTotpAlreadyEnabled
+	}
+	if user.Totp_pending_secret == nil {
+		return nil, ErrTotpNotEnrolled
+	}
+
+	step, ok, err := checkTotpCode(*user.Totp_pending_secret, code, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidTotpCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result, err := userCollection.UpdateOne(
+		ctx,
+		bson.M{"user_id": userId, "totp_pending_secret": *user.Totp_pending_secret},
+		bson.M{
+			"$set": bson.M{
+				"totp_enabled":        true,
+				"totp_enabled_at":     now,
+				"totp_secret":         *user.Totp_pending_secret,
+				"totp_last_step":      step,
+				"totp_recovery_codes": hashes,
+				"updated_at":          now,
+			},
+			"$unset": bson.M{"totp_pending_secret": ""},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount < 1 {
+		// Enrollment was restarted while this code was being checked
+		return nil, ErrTotpNotEnrolled
+	}
+
+	return codes, nil
+}
+
+// DisableTotp turns two-factor authentication off and forgets the secret and recovery codes.
+func DisableTotp(userId string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := userCollection.UpdateOne(
+		ctx,
+		bson.M{"user_id": userId},
+		bson.M{
+			"$set": bson.M{"totp_enabled": false, "updated_at": time.Now()},
+			"$unset": bson.M{
+				"totp_enabled_at":     "",
+				"totp_secret":         "",
+				"totp_pending_secret": "",
+				"totp_last_step":      "",
+				"totp_recovery_codes": "",
+			},
+		},
+	)
+	return err
+}
+
+// VerifySecondFactor checks a TOTP code or, failing that, a recovery code for
+// a user with two-factor authentication enabled. Every code can only be used
+// once: TOTP steps must move forward and recovery codes are removed when used.
+func VerifySecondFactor(user *models.User, code string) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if !user.Totp_enabled || user.Totp_secret == nil {
+		return ErrTotpNotEnabled
+	}
+
+	step, ok, err := checkTotpCode(*user.Totp_secret, code, user.Totp_last_step)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		// Only the first request to use this step may succeed
+		result, err := userCollection.UpdateOne(
+			ctx,
+			bson.M{
+				"user_id": user.User_id,
+				"$or": bson.A{
+					bson.M{"totp_last_step": bson.M{"$lt": step}},
+					bson.M{"totp_last_step": bson.M{"$exists": false}},
+				},
+			},
+			bson.M{"$set": bson.M{"totp_last_step": step}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount < 1 {
+			return ErrInvalidTotpCode
+		}
+		return nil
+	}
+
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if normalized == "" {
+		return ErrInvalidTotpCode
+	}
+
+	hash := HashToken(normalized)
+	result, err := userCollection.UpdateOne(
+		ctx,
+		bson.M{"user_id": user.User_id, "totp_recovery_codes": hash},
+		bson.M{"$pull": bson.M{"totp_recovery_codes": hash}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount < 1 {
+		return ErrInvalidTotpCode
+	}
+	return nil
+}
+
+// GenerateMfaChallenge signs a short lived token proving the user already
+// passed the password check. It can only be exchanged through ValidateMfaChallenge.
+func GenerateMfaChallenge(user *models.User) (string, error) {
+	return signClaims(&JwtSignedDetails{
+		Uid:           user.User_id,
+		Token_type:    MfaChallengeTokenType,
+		Token_version: user.Token_version,
+		StandardClaims: jwt.StandardClaims{
+			Id:        primitive.NewObjectID().Hex(),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(MFA_CHALLENGE_TTL).Unix(),
+		},
+	})
+}
+
+// ValidateMfaChallenge checks a challenge from GenerateMfaChallenge and returns
+// its claims along with the current state of the user.
+func ValidateMfaChallenge(signedChallenge string) (*JwtSignedDetails, *models.User, error) {
+	claims, msg := ValidateToken(signedChallenge)
+	if msg != "" || claims.Token_type != MfaChallengeTokenType || claims.Id == "" {
+		return nil, nil, ErrInvalidMfaChallenge
+	}
+
+	user, err := CheckTokenRevocation(claims)
+	if err == ErrTokenRevoked {
+		return nil, nil, ErrInvalidMfaChallenge
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !user.Totp_enabled {
+		return nil, nil, ErrInvalidMfaChallenge
+	}
+	return claims, user, nil
+}
+
+// checkTotpCode reports whether code is valid for the sealed secret at a step
+// later than lastStep, and which step it matched.
+func checkTotpCode(sealedSecret string, code string, lastStep int64) (int64, bool, error) {
+	secret, err := OpenSecret(sealedSecret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	key, err := totpSecretEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	step, ok := MatchTotpCode(key, code, lastStep, time.Now())
+	return step, ok, nil
+}
+
+// MatchTotpCode reports whether code is the one-time password for key at now,
+// or one period either side of it, at a step later than lastStep. It also
+// returns the step it matched.
+func MatchTotpCode(key []byte, code string, lastStep int64, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(TotpCode(key, time.Unix(step*totpPeriod, 0))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TotpCode computes the RFC 6238 one-time password for key at t.
+func TotpCode(key []byte, t time.Time) string {
+	return hotp(key, uint64(t.Unix()/totpPeriod))
+}
+
+// hotp computes an RFC 4226 one-time password.
+func hotp(key []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+func totpProvisioningURI(secret string, accountName string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", TOTP_ISSUER)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(TOTP_ISSUER) + ":" + url.PathEscape(accountName)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// generateRecoveryCodes returns recovery codes formatted for display along with
+// the hashes that are stored.
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := recoveryCodeEncoding.EncodeToString(raw)[:10]
+
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, HashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// mfaRequiredFor reports whether the role can only be used with a second factor.
+func mfaRequiredFor(role string) bool {
+	return REQUIRE_ADMIN_2FA && role == "ADMIN"
+}
@@ -0,0 +1,339 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"shive/database"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Actions recorded in the user_admin_action collection.
+const (
+	UserActionRoleChange = "role_change"
+	UserActionSuspend    = "suspend"
+	UserActionBan        = "ban"
+	UserActionReinstate  = "reinstate"
+)
+
+var (
+	ErrAccountSuspended = errors.New("this account is suspended")
+	ErrAccountBanned    = errors.New("this account is banned")
+	ErrSelfAdminAction  = errors.New("you can not change your own role, suspend or reinstate yourself")
+	ErrNotSuspended     = errors.New("this account is not suspended or banned")
+	ErrOutranked        = errors.New("this role grants permissions yours does not")
+	ErrLastAdmin        = errors.New("the last ADMIN can not be given another role or deleted")
+)
+
+var userAdminActionCollection *mongo.Collection = database.OpenCollection(database.Client, "user_admin_action")
+
+func init() {
+	database.EnsureIndexes(userAdminActionCollection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+}
+
+// AccountRestriction returns ErrAccountBanned or ErrAccountSuspended when the
+// user may not use the API at the moment, and nil otherwise.
+func AccountRestriction(user *models.User, now time.Time) error {
+	if user.Banned {
+		return ErrAccountBanned
+	}
+	if user.Suspended_until != nil && user.Suspended_until.After(now) {
+		return ErrAccountSuspended
+	}
+	return nil
+}
+
+// ChangeUserRole gives a user another role and signs them out everywhere so
+// tokens carrying the old role stop working.
+// The actor's role has to cover both the user's current role and the new one,
+// and the last ADMIN keeps their role.
+func ChangeUserRole(userId string, role string, actorId string, actorRole string, reason string) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if userId == actorId {
+		return nil, ErrSelfAdminAction
+	}
+
+	exists, err := RoleExists(role)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUnknownRole
+	}
+
+	before, err := administeredUser(ctx, userId, actorRole)
+	if err != nil {
+		return nil, err
+	}
+	covers, err := roleCoversRole(actorRole, role)
+	if err != nil {
+		return nil, err
+	}
+	if !covers {
+		return nil, ErrOutranked
+	}
+
+	fromRole := ""
+	if before.User_type != nil {
+		fromRole = *before.User_type
+	}
+	if fromRole == AdminRole && role != AdminRole {
+		if err := verifyNotLastAdmin(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// Matching the old role too leaves the user alone if someone else changed it meanwhile
+	result, err := userCollection.UpdateOne(
+		ctx,
+		bson.M{"user_id": userId, "user_type": before.User_type},
+		bson.M{"$set": bson.M{"user_type": role, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount < 1 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	if err := RevokeAllUserTokens(userId); err != nil {
+		return nil, err
+	}
+
+	err = recordUserAdminAction(ctx, models.UserAdminAction{
+		User_id:   userId,
+		Actor_id:  actorId,
+		Action:    UserActionRoleChange,
+		Reason:    reason,
+		From_role: fromRole,
+		To_role:   role,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return findUser(ctx, userId)
+}
+
+// SuspendUser blocks a user until the given time, or for good when until is nil.
+// A new suspension replaces the current one.
+func SuspendUser(userId string, until *time.Time, actorId string, actorRole string, reason string) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if userId == actorId {
+		return nil, ErrSelfAdminAction
+	}
+	if _, err := administeredUser(ctx, userId, actorRole); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	update := bson.M{
+		"banned":            until == nil,
+		"suspended_at":      now,
+		"suspended_by":      actorId,
+		"suspension_reason": reason,
+		"updated_at":        now,
+	}
+	changes := bson.M{"$set": update}
+	if until == nil {
+		changes["$unset"] = bson.M{"suspended_until": ""}
+	} else {
+		update["suspended_until"] = *until
+	}
+
+	result, err := userCollection.UpdateOne(ctx, bson.M{"user_id": userId}, changes)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount < 1 {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	action := UserActionSuspend
+	if until == nil {
+		action = UserActionBan
+	}
+	err = recordUserAdminAction(ctx, models.UserAdminAction{
+		User_id:  userId,
+		Actor_id: actorId,
+		Action:   action,
+		Reason:   reason,
+		Until:    until,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return findUser(ctx, userId)
+}
+
+// ReinstateUser lifts a suspension or ban.
+// Like placing one, it needs a role covering the user's.
+func ReinstateUser(userId string, actorId string, actorRole string, reason string) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if userId == actorId {
+		return nil, ErrSelfAdminAction
+	}
+	if _, err := administeredUser(ctx, userId, actorRole); err != nil {
+		return nil, err
+	}
+
+	result, err := userCollection.UpdateOne(
+		ctx,
+		bson.M{
+			"user_id": userId,
+			"$or": []bson.M{
+				{"banned": true},
+				{"suspended_until": bson.M{"$gt": time.Now()}},
+			},
+		},
+		bson.M{
+			"$set": bson.M{"banned": false, "updated_at": time.Now()},
+			"$unset": bson.M{
+				"suspended_at":      "",
+				"suspended_until":   "",
+				"suspended_by":      "",
+				"suspension_reason": "",
+			},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount < 1 {
+		count, err := userCollection.CountDocuments(ctx, bson.M{"user_id": userId})
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, ErrNotSuspended
+		}
+		return nil, mongo.ErrNoDocuments
+	}
+
+	err = recordUserAdminAction(ctx, models.UserAdminAction{
+		User_id:  userId,
+		Actor_id: actorId,
+		Action:   UserActionReinstate,
+		Reason:   reason,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return findUser(ctx, userId)
+}
+
+// ListUserAdminActions returns the actions taken on a user, newest first.
+func ListUserAdminActions(userId string) ([]models.UserAdminAction, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := userAdminActionCollection.Find(
+		ctx,
+		bson.M{"user_id": userId},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := []models.UserAdminAction{}
+	if err := cursor.All(ctx, &actions); err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+func recordUserAdminAction(ctx context.Context, action models.UserAdminAction) error {
+	action.ID = primitive.NewObjectID()
+	action.Action_id = action.ID.Hex()
+	action.Created_at = time.Now()
+
+	_, err := userAdminActionCollection.InsertOne(ctx, action)
+	return err
+}
+
+// verifyNotLastAdmin returns ErrLastAdmin when at most one ADMIN is staying, so
+// taking the role or the account away from one would leave nobody to
+// administer the API. Admins whose deletion is scheduled don't count.
+func verifyNotLastAdmin(ctx context.Context) error {
+	admins, err := userCollection.CountDocuments(ctx, bson.M{"user_type": AdminRole, "deletion_scheduled_at": nil})
+	if err != nil {
+		return err
+	}
+	if admins <= 1 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// administeredUser finds the user an admin action is about, and returns
+// ErrOutranked when their role grants permissions actorRole does not.
+func administeredUser(ctx context.Context, userId string, actorRole string) (*models.User, error) {
+	user, err := findUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	role := ""
+	if user.User_type != nil {
+		role = *user.User_type
+	}
+	covers, err := roleCoversRole(actorRole, role)
+	if err != nil {
+		return nil, err
+	}
+	if !covers {
+		return nil, ErrOutranked
+	}
+	return user, nil
+}
+
+func findUser(ctx context.Context, userId string) (*models.User, error) {
+	var user models.User
+	if err := userCollection.FindOne(ctx, bson.M{"user_id": userId}).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ListUsers returns a page of users in the order they signed up, how many there
+// are in all and the cursor of the next page, empty on the last one.
+func ListUsers(page Page) ([]models.User, int64, string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := userCollection.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	// User IDs are ObjectIDs, so they sort by sign up time
+	docs, next, err := findPage(ctx, userCollection, bson.M{}, bson.D{{Key: "user_id", Value: 1}}, page, true, nil)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	users := make([]models.User, len(docs))
+	for i, doc := range docs {
+		if err := bson.Unmarshal(doc, &users[i]); err != nil {
+			return nil, 0, "", err
+		}
+	}
+	return users, total, next, nil
+}
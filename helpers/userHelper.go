@@ -0,0 +1,96 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"shive/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrEmailTaken    = errors.New("looks like this email already exists")
+	ErrUsernameTaken = errors.New("looks like this username already exists")
+)
+
+// EmailInUse reports whether another account has the email, ignoring case.
+// exceptUserId is left out of the check. Unverified pending addresses don't
+// count, so nobody can hold on to an address they don't own.
+func EmailInUse(email string, exceptUserId string) (bool, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count, err := userCollection.CountDocuments(ctx, bson.M{
+		"user_id": bson.M{"$ne": exceptUserId},
+		"email":   caseInsensitiveMatch(email),
+	})
+	return count > 0, err
+}
+
+// UsernameInUse reports whether another account has the username, ignoring case.
+func UsernameInUse(username string, exceptUserId string) (bool, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count, err := userCollection.CountDocuments(ctx, bson.M{
+		"user_id":  bson.M{"$ne": exceptUserId},
+		"username": caseInsensitiveMatch(username),
+	})
+	return count > 0, err
+}
+
+// FindUserByEmail returns the account with the email, ignoring case like
+// EmailInUse does, or mongo.ErrNoDocuments when there is none.
+func FindUserByEmail(email string) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := userCollection.FindOne(ctx, bson.M{"email": caseInsensitiveMatch(email)}).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func caseInsensitiveMatch(value string) bson.M {
+	return bson.M{"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}}
+}
+
+// UpdateProfile changes the name and username of a user. Nil fields are left as
+// they are. It returns ErrUsernameTaken when another account has the username.
+func UpdateProfile(userId string, name *string, username *string) (*models.User, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	update := bson.M{"updated_at": time.Now()}
+	if name != nil {
+		update["name"] = *name
+	}
+	if username != nil {
+		taken, err := UsernameInUse(*username, userId)
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			return nil, ErrUsernameTaken
+		}
+		update["username"] = *username
+	}
+
+	returnDocument := options.After
+	var user models.User
+	err := userCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"user_id": userId},
+		bson.M{"$set": update},
+		&options.FindOneAndUpdateOptions{ReturnDocument: &returnDocument},
+	).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
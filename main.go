@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"shive/database"
+	"shive/helpers"
 	"shive/routes"
 
 	"github.com/gin-gonic/gin"
@@ -21,14 +22,39 @@ func main() {
 	}
 	router := gin.Default()
 
+	// Tokens are signed with it, or with keys sealed with it
+	if helpers.SECRET_KEY == "" {
+		log.Fatal("SECRET_KEY must be set, it signs tokens and encrypts the secrets stored in the database")
+	}
+
 	// run database
 	database.StartDB()
 
+	// Bring stored documents up to the current schema before serving them
+	if err := helpers.RunMigrations(); err != nil {
+		log.Fatalf("Error running migrations: %v", err)
+	}
+
+	database.CreateIndexes()
+	if err := helpers.SeedRolePolicies(); err != nil {
+		log.Printf("Error creating default role policies: %v", err)
+	}
+
+	// Remove accounts whose deletion grace period is over
+	helpers.StartAccountDeletionWorker()
+	// Build requested data exports and remove expired ones
+	helpers.StartDataExportWorker()
+	// Print a one-time setup token until the first admin exists
+	helpers.PrintSetupTokenIfNeeded()
+
 	// LOG Events
 	router.Use(gin.Logger())
 	// Register app routes
 	routes.AuthRoutes(router)
 	routes.UserRoutes(router)
+	routes.ApiKeyRoutes(router)
+	routes.PermissionRoutes(router)
+	routes.AuditRoutes(router)
 	routes.GenreRouter(router)
 	routes.MovieRoutes(router)
 	routes.ReviewRoutes(router)
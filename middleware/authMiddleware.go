@@ -3,19 +3,50 @@ package middleware
 import (
 	"net/http"
 	"shive/helpers"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const authRealm = "shive"
+
 // The `Authenticate` checks for a valid token in the request header and validates it
 // before setting user information in the context.
+// Tokens are read from an RFC 6750 `Authorization: Bearer` header, falling back to the
+// legacy `token` header while clients migrate.
 func Authenticate() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		clientToken := c.Request.Header.Get("token")
+		// Routers register this middleware globally, so it can run more than once per request
+		if _, authenticated := c.Get("uid"); authenticated {
+			return
+		}
+
+		clientToken, ok := bearerToken(c.Request)
+
+		if !ok {
+			abortUnauthorized(c, "invalid_request", "Authorization header must use the Bearer scheme")
+			return
+		}
+
+		if clientToken == "" {
+			clientToken = c.Request.Header.Get("token")
+		}
+
+		// Service accounts send an API key instead of a JWT
+		apiKey := c.Request.Header.Get("X-API-Key")
+		if apiKey == "" && strings.HasPrefix(clientToken, helpers.ApiKeyPrefix) {
+			apiKey = clientToken
+		}
+		if apiKey != "" {
+			authenticateApiKey(c, apiKey)
+			return
+		}
 
 		if clientToken == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="`+authRealm+`"`)
 			c.JSON(
-				http.StatusBadRequest,
+				http.StatusUnauthorized,
 				gin.H{
 					"error": "No Authorization header provided",
 				},
@@ -26,10 +57,64 @@ func Authenticate() gin.HandlerFunc {
 		claims, err := helpers.ValidateToken(clientToken)
 
 		if err != "" {
+			abortUnauthorized(c, "invalid_token", err)
+			return
+		}
+
+		// Only access tokens are bearer tokens. Tokens signed before token types
+		// existed have none.
+		switch claims.Token_type {
+		case helpers.AccessTokenType, "":
+		case helpers.RefreshTokenType:
+			abortUnauthorized(c, "invalid_token", "Refresh tokens can only be used to refresh a session")
+			return
+		case helpers.MfaChallengeTokenType:
+			abortUnauthorized(c, "invalid_token", "Finish signing in with your two-factor code first")
+			return
+		default:
+			abortUnauthorized(c, "invalid_token", "This token can not be used to authenticate requests")
+			return
+		}
+
+		user, revokedErr := helpers.CheckTokenRevocation(claims)
+
+		if revokedErr == helpers.ErrTokenRevoked {
+			abortUnauthorized(c, "invalid_token", revokedErr.Error())
+			return
+		} else if revokedErr != nil {
 			c.JSON(
-				http.StatusBadRequest,
+				http.StatusInternalServerError,
 				gin.H{
-					"error": err,
+					"error": revokedErr.Error(),
+				},
+			)
+			c.Abort()
+			return
+		}
+
+		// Suspensions apply to tokens that were issued before them
+		if err := helpers.AccountRestriction(user, time.Now()); err != nil {
+			c.JSON(
+				http.StatusForbidden,
+				gin.H{
+					"status":          http.StatusForbidden,
+					"error":           err.Error(),
+					"reason":          user.Suspension_reason,
+					"suspended_until": user.Suspended_until,
+				},
+			)
+			c.Abort()
+			return
+		}
+
+		if err := helpers.TouchSession(claims.Family_id, helpers.SessionClient{User_agent: c.Request.UserAgent(), Ip: c.ClientIP()}); err == helpers.ErrTokenRevoked {
+			abortUnauthorized(c, "invalid_token", err.Error())
+			return
+		} else if err != nil {
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{
+					"error": err.Error(),
 				},
 			)
 			c.Abort()
@@ -41,7 +126,88 @@ func Authenticate() gin.HandlerFunc {
 		c.Set("name", claims.Name)
 		c.Set("uid", claims.Uid)
 		c.Set("user_type", claims.User_type)
+		c.Set("token_id", claims.Id)
+		c.Set("family_id", claims.Family_id)
+		c.Set("token_expires_at", claims.ExpiresAt)
+		c.Set("email_verified", user.Email_verified)
+		c.Set("mfa", claims.Mfa)
+		c.Set("auth_method", "token")
 		c.Next()
 
 	}
 }
+
+// authenticateApiKey sets the same context keys as a token for a service account's API key.
+func authenticateApiKey(c *gin.Context, plainKey string) {
+	key, err := helpers.AuthenticateApiKey(plainKey)
+
+	if err == helpers.ErrInvalidApiKey {
+		abortUnauthorized(c, "invalid_token", err.Error())
+		return
+	} else if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{
+				"error": err.Error(),
+			},
+		)
+		c.Abort()
+		return
+	}
+
+	if !helpers.ApiKeyAllows(key, c.Request.Method) {
+		c.Header("WWW-Authenticate", `Bearer realm="`+authRealm+`", error="insufficient_scope", scope="`+helpers.ApiKeyScopeWrite+`"`)
+		c.JSON(
+			http.StatusForbidden,
+			gin.H{
+				"error": "This API key is not allowed to make changes",
+			},
+		)
+		c.Abort()
+		return
+	}
+
+	c.Set("email", "")
+	c.Set("username", key.Name)
+	c.Set("name", key.Name)
+	c.Set("uid", key.Key_id)
+	c.Set("user_type", key.User_type)
+	c.Set("api_key_id", key.Key_id)
+	c.Set("scopes", key.Scopes)
+	c.Set("email_verified", false)
+	// Keys are created by admins and can't be phished like a password, so they
+	// satisfy REQUIRE_ADMIN_2FA
+	c.Set("mfa", true)
+	c.Set("auth_method", "api_key")
+	c.Next()
+}
+
+// bearerToken extracts the token from the Authorization header. ok is false when the
+// header is present but does not use the Bearer scheme.
+func bearerToken(r *http.Request) (token string, ok bool) {
+	authorization := strings.TrimSpace(r.Header.Get("Authorization"))
+	if authorization == "" {
+		return "", true
+	}
+
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// abortUnauthorized answers with a 401 and the RFC 6750 challenge describing why.
+func abortUnauthorized(c *gin.Context, code string, description string) {
+	c.Header(
+		"WWW-Authenticate",
+		`Bearer realm="`+authRealm+`", error="`+code+`", error_description="`+strings.ReplaceAll(description, `"`, `'`)+`"`,
+	)
+	c.JSON(
+		http.StatusUnauthorized,
+		gin.H{
+			"error": description,
+		},
+	)
+	c.Abort()
+}
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"shive/helpers"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequirePermission only lets callers whose role has at least one of the
+// permissions through, and records the decision. It has to run after `Authenticate`.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := helpers.Authorize(c, permissions...); err != nil {
+			status := helpers.AuthorizeStatus(err)
+			c.JSON(
+				status,
+				gin.H{
+					"status": status,
+					"error":  err.Error(),
+				},
+			)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
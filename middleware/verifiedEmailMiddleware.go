@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireVerifiedEmail only lets users with a verified email address through.
+// It has to run after `Authenticate`.
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool("email_verified") {
+			c.JSON(
+				http.StatusForbidden,
+				gin.H{
+					"status":  http.StatusForbidden,
+					"message": "Please verify your email address first",
+					"error":   "email_not_verified",
+				},
+			)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
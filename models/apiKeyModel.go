@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ApiKey lets a service account call the API without logging in. Only the hash
+// of the key is stored, the prefix is kept so admins can tell keys apart.
+type ApiKey struct {
+	ID           primitive.ObjectID `bson:"_id" json:"-"`
+	Key_id       string             `json:"key_id"`
+	Name         string             `json:"name"`
+	Prefix       string             `json:"prefix"`
+	Key_hash     string             `json:"-"`
+	User_type    string             `json:"user_type"`
+	Scopes       []string           `json:"scopes"`
+	Created_by   string             `json:"created_by"`
+	Created_at   time.Time          `json:"created_at"`
+	Expires_at   time.Time          `json:"expires_at"`
+	Last_used_at *time.Time         `json:"last_used_at"`
+	Revoked_at   *time.Time         `json:"revoked_at"`
+}
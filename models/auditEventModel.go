@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEvent records one security relevant action. Events are only ever
+// inserted, and removed once they pass Expires_at.
+type AuditEvent struct {
+	ID primitive.ObjectID `bson:"_id" json:"event_id"`
+	// The user or API key ID that acted, empty when nobody is signed in yet
+	Actor       string    `json:"actor"`
+	Auth_method string    `json:"auth_method,omitempty"`
+	Action      string    `json:"action"`
+	Target      string    `json:"target,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Reason      string    `json:"reason,omitempty"`
+	Ip          string    `json:"ip"`
+	User_agent  string    `json:"user_agent"`
+	Created_at  time.Time `json:"created_at"`
+	Expires_at  time.Time `json:"expires_at"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DataExport tracks an archive of a user's personal data that is built in the
+// background. The finished archive is stored in GridFS.
+type DataExport struct {
+	ID           primitive.ObjectID  `bson:"_id" json:"-"`
+	Export_id    string              `json:"export_id"`
+	User_id      string              `json:"user_id"`
+	Status       string              `json:"status"`
+	Error        string              `json:"error,omitempty"`
+	File_id      *primitive.ObjectID `json:"-"`
+	Size         int64               `json:"size,omitempty"`
+	Created_at   time.Time           `json:"created_at"`
+	Completed_at *time.Time          `json:"completed_at,omitempty"`
+	Expires_at   *time.Time          `json:"expires_at,omitempty"`
+	Locked_until *time.Time          `json:"-"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EmailSend records that a throttled email went out to Key, an address, user
+// ID or IP depending on Kind. Records outlive the tokens they carried so the
+// hourly limits see a whole hour.
+type EmailSend struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Kind       string             `json:"kind"`
+	Key        string             `json:"key"`
+	Created_at time.Time          `json:"created_at"`
+	Expires_at time.Time          `json:"expires_at"`
+}
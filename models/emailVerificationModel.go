@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EmailVerification is a single-use token proving the user controls Email.
+// Only the hash of the token is stored.
+type EmailVerification struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	User_id    string             `json:"user_id"`
+	Email      string             `json:"email"`
+	Token_hash string             `json:"-"`
+	Used_at    *time.Time         `json:"used_at"`
+	Created_at time.Time          `json:"created_at"`
+	Expires_at time.Time          `json:"expires_at"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Invite lets someone sign up with a role chosen by an admin. The signed token
+// sent to them carries the invite ID, so only one pending invite per email is kept.
+type Invite struct {
+	ID               primitive.ObjectID `bson:"_id" json:"invite_id"`
+	Email            string             `json:"email"`
+	User_type        string             `json:"user_type"`
+	Invited_by       string             `json:"invited_by"`
+	Created_at       time.Time          `json:"created_at"`
+	Expires_at       time.Time          `json:"expires_at"`
+	Accepted_at      *time.Time         `json:"accepted_at"`
+	Accepted_user_id *string            `json:"accepted_user_id,omitempty"`
+	Revoked_at       *time.Time         `json:"revoked_at"`
+}
+
+// SetupToken lets the first admin account be created. Only the hash of the
+// token is stored and it is deleted once an admin exists.
+type SetupToken struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Token_hash string             `json:"-"`
+	Created_at time.Time          `json:"created_at"`
+	Expires_at time.Time          `json:"expires_at"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LoginAttempt counts recent failed logins for one email address or client IP.
+type LoginAttempt struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Key             string             `json:"key"`
+	Kind            string             `json:"kind"`
+	Value           string             `json:"value"`
+	Failures        int                `json:"failures"`
+	Last_failure_at time.Time          `json:"last_failure_at"`
+	Locked_until    *time.Time         `json:"locked_until"`
+	Expires_at      time.Time          `json:"expires_at"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// Migration records a schema migration that was applied, or is being applied
+// while Finished_at is empty.
+type Migration struct {
+	ID          string     `bson:"_id" json:"id"`
+	Description string     `json:"description"`
+	Started_at  time.Time  `json:"started_at"`
+	Finished_at *time.Time `json:"finished_at"`
+}
@@ -14,8 +14,72 @@ type Movie struct {
 	Movie_id  string `json:"movie_id"`
 	Movie_URL string `json:"movie_url" validate:"url"`
 
-	Genre_id string `json:"genre_id"`
+	// IDs of existing genres, checked when the movie is saved
+	Genre_ids []string `json:"genre_ids" validate:"max=10,dive,required"`
+
+	// Catalog metadata. Everything is optional, and movies created before these
+	// fields existed were backfilled with empty values.
+	Release_date         string   `json:"release_date" validate:"omitempty,datetime=2006-01-02"`
+	Runtime              int      `json:"runtime" validate:"omitempty,min=1,max=1000"` // In minutes
+	Original_language    string   `json:"original_language" validate:"omitempty,bcp47_language_tag"`
+	Spoken_languages     []string `json:"spoken_languages" validate:"max=30,dive,bcp47_language_tag"`
+	Countries            []string `json:"countries" validate:"max=50,dive,iso3166_1_alpha2"`
+	Synopsis             string   `json:"synopsis" validate:"max=5000"`
+	Tagline              string   `json:"tagline" validate:"max=300"`
+	Certification        string   `json:"certification" validate:"max=20"`
+	Production_companies []string `json:"production_companies" validate:"max=50,dive,min=1,max=200"`
+
+	// Kept up to date from the ratings of the movie's reviews, clients can't set them
+	Average_rating float64 `json:"average_rating"`
+	Rating_count   int     `json:"rating_count"`
 
 	Created_at time.Time `json:"created_at"`
 	Updated_at time.Time `json:"updated_at"`
 }
+
+// MovieSearchResult is a movie found by a text search.
+type MovieSearchResult struct {
+	Movie `bson:",inline"`
+	// How well the movie matches, higher is better
+	Score   float64        `bson:"score" json:"score"`
+	Snippet *SearchSnippet `bson:"-" json:"snippet"`
+}
+
+// SearchSnippet is an excerpt of the field a search matched, with the matched
+// words wrapped in <mark> tags. The rest of the text is HTML escaped.
+type SearchSnippet struct {
+	Field string `json:"field"`
+	Text  string `json:"text"`
+}
+
+// MovieListing is a page of movies together with facet counts over every
+// movie that matched, not just the page.
+type MovieListing struct {
+	Total_count int64        `json:"total_count"`
+	Movie_items []Movie      `json:"movie_items"`
+	Facets      *MovieFacets `json:"facets"`
+	// Where the next page starts, empty on the last page
+	Next_cursor string `json:"next_cursor"`
+}
+
+type MovieFacets struct {
+	Genres    []GenreFacet    `json:"genres"`
+	Decades   []DecadeFacet   `json:"decades"`
+	Languages []LanguageFacet `json:"languages"`
+}
+
+type GenreFacet struct {
+	Genre_id string `json:"genre_id"`
+	Name     string `json:"name"`
+	Count    int64  `json:"count"`
+}
+
+type DecadeFacet struct {
+	Decade int   `json:"decade"` // 1970 for the 1970s
+	Count  int64 `json:"count"`
+}
+
+type LanguageFacet struct {
+	Language string `json:"language"`
+	Count    int64  `json:"count"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OidcState remembers a login that was sent to the identity provider until it
+// comes back to the callback. Only the hash of the state is stored.
+type OidcState struct {
+	ID            primitive.ObjectID `bson:"_id"`
+	State_hash    string             `json:"-"`
+	Nonce         string             `json:"-"`
+	Code_verifier string             `json:"-"`
+	Created_at    time.Time          `json:"created_at"`
+	Expires_at    time.Time          `json:"expires_at"`
+}
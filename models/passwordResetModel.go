@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PasswordReset is a single-use reset token. Only the hash of the token is stored.
+type PasswordReset struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	User_id    string             `json:"user_id"`
+	Token_hash string             `json:"-"`
+	Used_at    *time.Time         `json:"used_at"`
+	Created_at time.Time          `json:"created_at"`
+	Expires_at time.Time          `json:"expires_at"`
+}
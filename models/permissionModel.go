@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RolePolicy grants a role its permissions. The `*` permission grants every permission.
+type RolePolicy struct {
+	ID          primitive.ObjectID `bson:"_id" json:"-"`
+	Role        string             `json:"role"`
+	Description string             `json:"description"`
+	Permissions []string           `json:"permissions"`
+	Built_in    bool               `json:"built_in"`
+	Updated_by  string             `json:"updated_by"`
+	Created_at  time.Time          `json:"created_at"`
+	Updated_at  time.Time          `json:"updated_at"`
+}
+
+// PermissionDecision records one permission check made for a request.
+type PermissionDecision struct {
+	ID          primitive.ObjectID `bson:"_id" json:"decision_id"`
+	Uid         string             `json:"uid"`
+	User_type   string             `json:"user_type"`
+	Auth_method string             `json:"auth_method"`
+	Permissions []string           `json:"permissions"`
+	Granted_by  string             `json:"granted_by,omitempty"`
+	Allowed     bool               `json:"allowed"`
+	Reason      string             `json:"reason,omitempty"`
+	Method      string             `json:"method"`
+	Path        string             `json:"path"`
+	Ip          string             `json:"ip"`
+	Created_at  time.Time          `json:"created_at"`
+	Expires_at  time.Time          `json:"expires_at"`
+}
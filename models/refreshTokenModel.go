@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RefreshToken tracks every refresh token that has been issued so it can be
+// rotated exactly once. Tokens minted from the same login share a Family_id.
+type RefreshToken struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Token_id    string             `json:"token_id"`
+	Family_id   string             `json:"family_id"`
+	User_id     string             `json:"user_id"`
+	Token_hash  string             `json:"-"`
+	Replaced_by string             `json:"replaced_by"`
+	Revoked     bool               `json:"revoked"`
+	Created_at  time.Time          `json:"created_at"`
+	Expires_at  time.Time          `json:"expires_at"`
+}
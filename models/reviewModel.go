@@ -12,6 +12,7 @@ type Review struct {
 	Review_id   string             `json:"review_id"`
 	Movie_id    string             `json:"movie_id"`
 	Reviewer_id string             `json:"reviewer_id"`
+	Rating      int                `json:"rating" validate:"omitempty,min=1,max=10"` // 0 when the review has none
 	Created_at  time.Time          `json:"created_at"`
 	Updated_at  time.Time          `json:"updated_at"`
 }
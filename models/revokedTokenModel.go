@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RevokedToken is an access token that was logged out before it expired.
+type RevokedToken struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Token_id   string             `json:"token_id"`
+	User_id    string             `json:"user_id"`
+	Revoked_at time.Time          `json:"revoked_at"`
+	Expires_at time.Time          `json:"expires_at"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Session is one login on one device. Its Session_id is the family id shared by
+// every refresh token issued from that login.
+type Session struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Session_id   string             `json:"session_id"`
+	User_id      string             `json:"user_id"`
+	User_agent   string             `json:"user_agent"`
+	Ip           string             `json:"ip"`
+	Created_at   time.Time          `json:"created_at"`
+	Last_seen_at time.Time          `json:"last_seen_at"`
+	Expires_at   time.Time          `json:"expires_at"`
+	Revoked_at   *time.Time         `json:"revoked_at"`
+}
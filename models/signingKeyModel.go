@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SigningKey is an asymmetric key used to sign tokens. A key signs new tokens
+// between Not_before and Expires_at and is published for verification until Retire_at.
+type SigningKey struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Kid         string             `json:"kid"`
+	Alg         string             `json:"alg"`
+	Private_key string             `json:"-"`
+	Public_key  string             `json:"public_key"`
+	Not_before  time.Time          `json:"not_before"`
+	Expires_at  time.Time          `json:"expires_at"`
+	Retire_at   time.Time          `json:"retire_at"`
+	Created_at  time.Time          `json:"created_at"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UserAdminAction records a change an admin made to a user's account.
+type UserAdminAction struct {
+	ID         primitive.ObjectID `bson:"_id" json:"-"`
+	Action_id  string             `json:"action_id"`
+	User_id    string             `json:"user_id"`
+	Actor_id   string             `json:"actor_id"`
+	Action     string             `json:"action"`
+	Reason     string             `json:"reason,omitempty"`
+	From_role  string             `json:"from_role,omitempty"`
+	To_role    string             `json:"to_role,omitempty"`
+	Until      *time.Time         `json:"until,omitempty"`
+	Created_at time.Time          `json:"created_at"`
+}
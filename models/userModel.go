@@ -7,15 +7,45 @@ import (
 )
 
 type User struct {
-	ID            primitive.ObjectID `bson:"_id"`
-	Name          *string            `json:"name" validate:"required,min=4,max=100"`
-	Username      *string            `json:"username" validate:"required,min=4,max=100"`
-	Password      *string            `json:"password" validate:"required,min=8"`
-	Email         *string            `json:"email" validate:"email,required"`
-	Token         *string            `json:"token"`
-	User_type     *string            `json:"user_type" validate:"required,eq=ADMIN|eq=USER"`
-	Refresh_token *string            `json:"refresh_token"`
-	Created_at    time.Time          `json:"created_at"`
-	Updated_at    time.Time          `json:"updated_at"`
-	User_id       string             `json:"user_id"`
+	ID                primitive.ObjectID `bson:"_id"`
+	Name              *string            `json:"name" validate:"required,min=4,max=100"`
+	Username          *string            `json:"username" validate:"required,min=4,max=100"`
+	Password          *string            `json:"password" validate:"required,min=8"`
+	Email             *string            `json:"email" validate:"email,required"`
+	Token             *string            `json:"token"`
+	User_type         *string            `json:"user_type" validate:"required,min=2,max=32"`
+	Refresh_token     *string            `json:"refresh_token"`
+	Created_at        time.Time          `json:"created_at"`
+	Updated_at        time.Time          `json:"updated_at"`
+	User_id           string             `json:"user_id"`
+	Token_version     int                `json:"token_version"`
+	Email_verified    bool               `json:"email_verified"`
+	Email_verified_at *time.Time         `json:"email_verified_at"`
+	// A new address waiting to be verified before it replaces Email
+	Pending_email *string `json:"pending_email,omitempty"`
+
+	// Two-factor authentication. Secrets are sealed and recovery codes hashed.
+	Totp_enabled        bool       `json:"totp_enabled"`
+	Totp_enabled_at     *time.Time `json:"totp_enabled_at"`
+	Totp_secret         *string    `json:"-"`
+	Totp_pending_secret *string    `json:"-"`
+	Totp_last_step      int64      `json:"-"`
+	Totp_recovery_codes []string   `json:"-"`
+
+	// Set for accounts linked to an OpenID Connect identity provider
+	Oidc_issuer  *string `json:"oidc_issuer,omitempty"`
+	Oidc_subject *string `json:"oidc_subject,omitempty"`
+
+	// Set while an admin has suspended the account. Bans have no end date.
+	Banned            bool       `json:"banned,omitempty"`
+	Suspended_at      *time.Time `json:"suspended_at,omitempty"`
+	Suspended_until   *time.Time `json:"suspended_until,omitempty"`
+	Suspended_by      *string    `json:"suspended_by,omitempty"`
+	Suspension_reason *string    `json:"suspension_reason,omitempty"`
+
+	// Set while the account waits out its deletion grace period
+	Deletion_requested_at *time.Time `json:"deletion_requested_at,omitempty"`
+	Deletion_requested_by *string    `json:"deletion_requested_by,omitempty"`
+	Deletion_scheduled_at *time.Time `json:"deletion_scheduled_at,omitempty"`
+	Deletion_locked_until *time.Time `json:"-"`
 }
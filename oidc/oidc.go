@@ -0,0 +1,421 @@
+// Package oidc is a small OpenID Connect relying party for the authorization code
+// flow with PKCE. It only talks HTTP, so it can be tested against a mock issuer
+// without a database.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("the identity provider returned an invalid ID token")
+	ErrNonceMismatch  = errors.New("the ID token does not belong to this login")
+)
+
+// How long ID tokens may be dated in the future to allow for clock drift.
+const clockSkew = time.Minute
+
+// Unknown key ids trigger a JWKS refresh at most this often.
+const jwksRefreshInterval = time.Minute
+
+// Config describes the client registered with the identity provider.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// GroupsClaim names the ID token claim listing the user's groups, "groups" by default.
+	GroupsClaim string
+	HTTPClient  *http.Client
+}
+
+// Identity is what the identity provider asserts about the signed in user.
+type Identity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+	Groups            []string
+	// AMR lists the authentication methods the provider used, such as "pwd" or "mfa".
+	AMR []string
+}
+
+// Provider is an identity provider discovered from its issuer URL.
+type Provider struct {
+	config    Config
+	discovery discoveryDocument
+
+	mu            sync.Mutex
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	TokenType        string `json:"token_type"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type jsonWebKeySet struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// NewProvider loads the issuer's discovery document.
+func NewProvider(ctx context.Context, config Config) (*Provider, error) {
+	if config.Issuer == "" || config.ClientID == "" {
+		return nil, errors.New("oidc: issuer and client id are required")
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	provider := &Provider{config: config}
+
+	wellKnown := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := provider.getJSON(ctx, wellKnown, &provider.discovery); err != nil {
+		return nil, fmt.Errorf("oidc: loading discovery document: %w", err)
+	}
+
+	// The issuer has to identify itself exactly as configured (OpenID Connect Discovery 4.3)
+	if provider.discovery.Issuer != config.Issuer {
+		return nil, fmt.Errorf("oidc: issuer %q does not match the configured issuer %q", provider.discovery.Issuer, config.Issuer)
+	}
+	if provider.discovery.AuthorizationEndpoint == "" || provider.discovery.TokenEndpoint == "" || provider.discovery.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing required endpoints")
+	}
+
+	return provider, nil
+}
+
+// NewPKCE returns a random RFC 7636 code verifier and its S256 challenge.
+func NewPKCE() (verifier string, challenge string, err error) {
+	verifier, err = RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	return verifier, PKCEChallenge(verifier), nil
+}
+
+// RandomString returns a URL safe random value built from n bytes, for states, nonces and verifiers.
+func RandomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// PKCEChallenge derives the S256 code challenge for a verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where the user is sent to sign in at the identity provider.
+func (p *Provider) AuthCodeURL(state string, nonce string, codeChallenge string) string {
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.discovery.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// Login exchanges an authorization code and returns the verified identity from its ID token.
+func (p *Provider) Login(ctx context.Context, code string, codeVerifier string, nonce string) (*Identity, error) {
+	idToken, err := p.Exchange(ctx, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	return p.VerifyIDToken(ctx, idToken, nonce)
+}
+
+// Exchange redeems an authorization code at the token endpoint and returns the raw ID token.
+func (p *Provider) Exchange(ctx context.Context, code string, codeVerifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	// Confidential clients authenticate with client_secret_basic, public ones only send their id
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	response, err := p.config.HTTPClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("oidc: exchanging code: %w", err)
+	}
+	defer response.Body.Close()
+
+	var token tokenResponse
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("oidc: decoding token response: %w", err)
+	}
+
+	if response.StatusCode != http.StatusOK || token.Error != "" {
+		if token.Error == "" {
+			token.Error = response.Status
+		}
+		return "", fmt.Errorf("oidc: token endpoint returned %s %s", token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("oidc: token response has no id_token, is the openid scope requested?")
+	}
+
+	return token.IDToken, nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of an
+// ID token as described in OpenID Connect Core 3.1.3.7.
+func (p *Provider) VerifyIDToken(ctx context.Context, rawIDToken string, nonce string) (*Identity, error) {
+	parser := &jwt.Parser{ValidMethods: []string{jwt.SigningMethodRS256.Alg()}, SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(rawIDToken, jwt.MapClaims{}, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	now := time.Now()
+
+	if stringClaim(claims, "iss") != p.config.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidIDToken)
+	}
+
+	audiences := stringsClaim(claims, "aud")
+	if !contains(audiences, p.config.ClientID) {
+		return nil, fmt.Errorf("%w: not issued for this client", ErrInvalidIDToken)
+	}
+	if azp := stringClaim(claims, "azp"); len(audiences) > 1 && azp != p.config.ClientID {
+		return nil, fmt.Errorf("%w: not authorized for this client", ErrInvalidIDToken)
+	}
+
+	expiresAt, ok := numberClaim(claims, "exp")
+	if !ok || now.After(time.Unix(expiresAt, 0)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	}
+	if issuedAt, ok := numberClaim(claims, "iat"); ok && time.Unix(issuedAt, 0).After(now.Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	}
+
+	if nonce != "" && stringClaim(claims, "nonce") != nonce {
+		return nil, ErrNonceMismatch
+	}
+
+	identity := &Identity{
+		Issuer:            p.config.Issuer,
+		Subject:           stringClaim(claims, "sub"),
+		Email:             stringClaim(claims, "email"),
+		Name:              stringClaim(claims, "name"),
+		PreferredUsername: stringClaim(claims, "preferred_username"),
+		Groups:            stringsClaim(claims, p.config.GroupsClaim),
+		AMR:               stringsClaim(claims, "amr"),
+	}
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+
+	// Some providers send email_verified as the string "true"
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+
+	return identity, nil
+}
+
+// publicKey returns the signing key with the given id, refreshing the JWKS when
+// the provider has rotated to a key that is not cached yet.
+func (p *Provider) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := p.cachedKey(kid); key != nil {
+		return key, nil
+	}
+
+	if p.keys != nil && time.Since(p.keysFetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set jsonWebKeySet
+	if err := p.getJSON(ctx, p.discovery.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("loading signing keys: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := parseRSAKey(jwk.N, jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	if key := p.cachedKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// cachedKey looks up a key by id. Tokens without a kid are accepted when the provider only publishes one key.
+func (p *Provider) cachedKey(kid string) *rsa.PublicKey {
+	if key, ok := p.keys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, endpoint string, target interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+
+	response, err := p.config.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", endpoint, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
+
+func parseRSAKey(n string, e string) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	if len(modulus) == 0 || len(exponent) == 0 || len(exponent) > 4 {
+		return nil, errors.New("malformed RSA key")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}, nil
+}
+
+func stringClaim(claims jwt.MapClaims, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// stringsClaim reads a claim that may be a single string or an array of strings.
+func stringsClaim(claims jwt.MapClaims, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var items []string
+		for _, item := range value {
+			if text, ok := item.(string); ok {
+				items = append(items, text)
+			}
+		}
+		return items
+	}
+	return nil
+}
+
+func numberClaim(claims jwt.MapClaims, name string) (int64, bool) {
+	switch value := claims[name].(type) {
+	case float64:
+		return int64(value), true
+	case json.Number:
+		number, err := value.Int64()
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func contains(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package routes
+
+import (
+	"shive/controllers"
+	"shive/helpers"
+	"shive/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func ApiKeyRoutes(router *gin.Engine) {
+	// Auth Middleware
+	router.Use(middleware.Authenticate())
+
+	// Service account keys
+	router.POST("/api-keys", middleware.RequirePermission(helpers.PermApiKeyManage), controllers.CreateApiKey())
+	router.GET("/api-keys", middleware.RequirePermission(helpers.PermApiKeyManage), controllers.GetApiKeys())
+	router.DELETE("/api-keys/:key_id", middleware.RequirePermission(helpers.PermApiKeyManage), controllers.RevokeApiKey())
+}
@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"shive/controllers"
+	"shive/helpers"
+	"shive/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func AuditRoutes(router *gin.Engine) {
+	// Auth Middleware
+	router.Use(middleware.Authenticate())
+
+	// Security audit log
+	router.GET("/audit-events", middleware.RequirePermission(helpers.PermAuditRead), controllers.GetAuditEvents())
+}
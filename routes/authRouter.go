@@ -10,7 +10,33 @@ func AuthRoutes(router *gin.Engine) {
 
 	// Login
 	router.POST("/users/login", controllers.Login())
+	router.POST("/users/login/2fa", controllers.LoginTwoFactor())
+
+	// Passwordless sign in through an emailed link
+	router.POST("/users/login/magic-link", controllers.RequestMagicLink())
+	router.POST("/users/login/magic-link/redeem", controllers.RedeemMagicLink())
+
+	// Single sign-on through an OpenID Connect provider
+	router.GET("/users/oidc/login", controllers.OidcLogin())
+	router.GET("/users/oidc/callback", controllers.OidcCallback())
 
 	// Signup Route
 	router.POST("/users/signup", controllers.Signup())
+	router.POST("/users/signup/invite", controllers.AcceptInvite())
+
+	// Create the first admin with the setup token printed at startup
+	router.POST("/setup/admin", controllers.SetupAdmin())
+
+	// Exchange a refresh token for a new token pair
+	router.POST("/users/refresh", controllers.RefreshToken())
+
+	// Password recovery
+	router.POST("/users/forgot-password", controllers.ForgotPassword())
+	router.POST("/users/reset-password", controllers.ResetPassword())
+
+	// Email verification
+	router.POST("/users/verify-email", controllers.VerifyEmail())
+
+	// Public keys for verifying tokens
+	router.GET("/.well-known/jwks.json", controllers.GetJWKS())
 }
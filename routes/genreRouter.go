@@ -2,6 +2,7 @@ package routes
 
 import (
 	controller "shive/controllers"
+	"shive/helpers"
 	"shive/middleware"
 
 	"github.com/gin-gonic/gin"
@@ -14,6 +15,7 @@ func GenreRouter(router *gin.Engine) {
 	// Post route to create  a genre
 	router.POST(
 		"/genres/creategenre",
+		middleware.RequirePermission(helpers.PermGenreCreate),
 		controller.CreateGenre(),
 	)
 
@@ -24,16 +26,19 @@ func GenreRouter(router *gin.Engine) {
 
 	router.GET(
 		"/genres",
+		middleware.RequirePermission(helpers.PermGenreList),
 		controller.GetAllGenres(),
 	)
 
 	router.PUT(
 		"/genres/:genre_id",
+		middleware.RequirePermission(helpers.PermGenreUpdate),
 		controller.UpdateGenre(),
 	)
 
 	router.DELETE(
 		"/genres/:genre_id",
+		middleware.RequirePermission(helpers.PermGenreDelete),
 		controller.DeleteGenre(),
 	)
 
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"shive/controllers"
+	"shive/helpers"
 	"shive/middleware"
 
 	"github.com/gin-gonic/gin"
@@ -11,7 +12,7 @@ func MovieRoutes(router *gin.Engine) {
 	// Auth middleware
 	router.Use(middleware.Authenticate())
 	// POST calls
-	router.POST("/movies/create-movie", controllers.CreateMovie())
+	router.POST("/movies/create-movie", middleware.RequirePermission(helpers.PermMovieCreate), controllers.CreateMovie())
 
 	// GET Calls
 	router.GET("/movies/:movie_id", controllers.GetMovie())
@@ -20,8 +21,8 @@ func MovieRoutes(router *gin.Engine) {
 	router.GET("/movies/filter/:genreId", controllers.SearchMovieByGenreId())
 
 	// Update calls
-	router.PUT("/movies/:movie_id", controllers.UpdateMovie())
+	router.PUT("/movies/:movie_id", middleware.RequirePermission(helpers.PermMovieUpdate), controllers.UpdateMovie())
 
 	// Delete calls
-	router.DELETE("/movies/:movie_id", controllers.DeleteMovieByMovieId())
+	router.DELETE("/movies/:movie_id", middleware.RequirePermission(helpers.PermMovieDelete), controllers.DeleteMovieByMovieId())
 }
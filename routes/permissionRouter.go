@@ -0,0 +1,23 @@
+package routes
+
+import (
+	"shive/controllers"
+	"shive/helpers"
+	"shive/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+func PermissionRoutes(router *gin.Engine) {
+	// Auth Middleware
+	router.Use(middleware.Authenticate())
+
+	// Role policies
+	router.GET("/permissions", middleware.RequirePermission(helpers.PermPolicyManage), controllers.GetPermissions())
+	router.GET("/roles", middleware.RequirePermission(helpers.PermPolicyManage), controllers.GetRoles())
+	router.PUT("/roles/:role", middleware.RequirePermission(helpers.PermPolicyManage), controllers.SaveRole())
+	router.DELETE("/roles/:role", middleware.RequirePermission(helpers.PermPolicyManage), controllers.DeleteRole())
+
+	// Decision log
+	router.GET("/permission-decisions", middleware.RequirePermission(helpers.PermPolicyManage), controllers.GetPermissionDecisions())
+}
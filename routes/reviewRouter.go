@@ -2,6 +2,7 @@ package routes
 
 import (
 	"shive/controllers"
+	"shive/helpers"
 	"shive/middleware"
 
 	"github.com/gin-gonic/gin"
@@ -12,15 +13,15 @@ func ReviewRoutes(router *gin.Engine) {
 	router.Use(middleware.Authenticate())
 
 	// POST Calls
-	router.POST("/review/add-review", controllers.AddReview())
+	router.POST("/review/add-review", middleware.RequirePermission(helpers.PermReviewCreate), middleware.RequireVerifiedEmail(), controllers.AddReview())
 
 	// GET Calls
 	router.GET("/review/filter/:movie_id", controllers.GetAllMovieReviews())
 	router.GET("/review/user_reviews/:reviewer_id", controllers.AllUserReviews())
 
 	// DELETE Calls
-	router.DELETE("/review/delete/:review_id", controllers.DeleteReviewByReviewId())
+	router.DELETE("/review/delete/:review_id", middleware.RequirePermission(helpers.PermReviewDelete, helpers.PermReviewModerate), controllers.DeleteReviewByReviewId())
 
 	// PUT Calls
-	router.PUT("reviews/edit-review/:review_id", controllers.EditReviews())
+	router.PUT("reviews/edit-review/:review_id", middleware.RequireVerifiedEmail(), controllers.EditReviews())
 }
@@ -2,6 +2,7 @@ package routes
 
 import (
 	controllers "shive/controllers"
+	"shive/helpers"
 	"shive/middleware"
 
 	"github.com/gin-gonic/gin"
@@ -11,7 +12,56 @@ func UserRoutes(router *gin.Engine) {
 
 	// Auth middleware
 	router.Use(middleware.Authenticate())
+	// Your own profile
+	router.GET("/users/me", controllers.GetMe())
+	router.PATCH("/users/me", controllers.UpdateMe())
+	router.DELETE("/users/me", controllers.DeleteMe())
+	router.POST("/users/me/cancel-deletion", controllers.CancelMyDeletion())
+
+	// Personal data export
+	router.GET("/users/me/export", controllers.ExportMyData())
+	router.GET("/users/me/exports/:export_id", controllers.GetMyDataExport())
+	router.GET("/users/me/exports/:export_id/download", controllers.DownloadMyDataExport())
+
 	// Get User
 	router.GET("/users/:user_id", controllers.GetUser())
-	router.GET("/users", controllers.GetUsers())
+	router.DELETE("/users/:user_id", middleware.RequirePermission(helpers.PermUserDelete), controllers.DeleteUser())
+	router.POST("/users/:user_id/cancel-deletion", middleware.RequirePermission(helpers.PermUserDelete), controllers.CancelUserDeletion())
+	router.GET("/users", middleware.RequirePermission(helpers.PermUserRead), controllers.GetUsers())
+
+	// User administration
+	router.PUT("/users/:user_id/role", middleware.RequirePermission(helpers.PermUserRole), controllers.ChangeUserRole())
+	router.POST("/users/:user_id/suspend", middleware.RequirePermission(helpers.PermUserSuspend), controllers.SuspendUser())
+	router.POST("/users/:user_id/ban", middleware.RequirePermission(helpers.PermUserSuspend), controllers.BanUser())
+	router.POST("/users/:user_id/reinstate", middleware.RequirePermission(helpers.PermUserSuspend), controllers.ReinstateUser())
+	router.GET("/users/:user_id/admin-actions", middleware.RequirePermission(helpers.PermUserRead), controllers.GetUserAdminActions())
+
+	// Invites
+	router.POST("/invites", middleware.RequirePermission(helpers.PermUserInvite), controllers.CreateInvite())
+	router.GET("/invites", middleware.RequirePermission(helpers.PermUserInvite), controllers.GetInvites())
+	router.DELETE("/invites/:invite_id", middleware.RequirePermission(helpers.PermUserInvite), controllers.RevokeInvite())
+
+	// Sessions
+	router.POST("/users/logout", controllers.Logout())
+	router.POST("/users/:user_id/revoke-sessions", middleware.RequirePermission(helpers.PermSessionManage), controllers.RevokeUserSessions())
+	router.GET("/users/me/sessions", controllers.GetMySessions())
+	router.DELETE("/users/me/sessions/:session_id", controllers.RevokeMySession())
+	router.GET("/users/:user_id/sessions", middleware.RequirePermission(helpers.PermSessionManage), controllers.GetUserSessions())
+	router.DELETE("/users/:user_id/sessions/:session_id", middleware.RequirePermission(helpers.PermSessionManage), controllers.RevokeUserSession())
+
+	// Failed login tracking
+	router.GET("/users/login-locks", middleware.RequirePermission(helpers.PermLoginLockManage), controllers.GetLoginLocks())
+	router.DELETE("/users/login-locks", middleware.RequirePermission(helpers.PermLoginLockManage), controllers.ClearLoginLock())
+
+	// Account changes
+	router.PUT("/users/me/password", controllers.ChangePassword())
+	router.PUT("/users/me/email", controllers.ChangeEmail())
+
+	// Two-factor authentication
+	router.POST("/users/me/2fa/enroll", controllers.EnrollTwoFactor())
+	router.POST("/users/me/2fa/confirm", controllers.ConfirmTwoFactor())
+	router.POST("/users/me/2fa/disable", controllers.DisableTwoFactor())
+
+	// Email verification
+	router.POST("/users/verify-email/resend", controllers.ResendVerificationEmail())
 }
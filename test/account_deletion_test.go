@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"context"
+	"shive/database"
+	"shive/helpers"
+	"shive/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestScheduleAccountDeletion(t *testing.T) {
+	mailer := withRecordedMail(t)
+	user := insertTestUser(t, "USER")
+
+	scheduled, err := helpers.ScheduleAccountDeletion(user.User_id, user.User_id, "USER")
+	if assert.NoError(t, err) && assert.NotNil(t, scheduled.Deletion_scheduled_at) {
+		assert.WithinDuration(t, time.Now().Add(helpers.ACCOUNT_DELETION_GRACE), *scheduled.Deletion_scheduled_at, time.Minute)
+	}
+	assert.Len(t, mailer.sentTo(*user.Email), 1, "The user should be told when the account goes")
+	assert.Equal(t, 0, findTestUser(t, user.User_id).Token_version, "Deleting your own account keeps you signed in to cancel")
+
+	_, err = helpers.ScheduleAccountDeletion(user.User_id, user.User_id, "USER")
+	assert.ErrorIs(t, err, helpers.ErrDeletionAlreadyScheduled)
+
+	assert.NoError(t, helpers.CancelAccountDeletion(user.User_id))
+	assert.Nil(t, findTestUser(t, user.User_id).Deletion_scheduled_at)
+	assert.ErrorIs(t, helpers.CancelAccountDeletion(user.User_id), helpers.ErrDeletionNotScheduled)
+
+	_, err = helpers.ScheduleAccountDeletion(primitive.NewObjectID().Hex(), user.User_id, "ADMIN")
+	assert.ErrorIs(t, err, mongo.ErrNoDocuments)
+}
+
+func TestScheduleAccountDeletionOfOthers(t *testing.T) {
+	requireDatabase(t)
+	withRecordedMail(t)
+	assert.NoError(t, helpers.SeedRolePolicies())
+	admin := insertTestUser(t, "ADMIN")
+	other := insertTestUser(t, "ADMIN")
+	user := insertTestUser(t, "USER")
+
+	// Nobody deletes a user whose role outranks theirs
+	_, err := helpers.ScheduleAccountDeletion(admin.User_id, user.User_id, "MODERATOR")
+	assert.ErrorIs(t, err, helpers.ErrOutranked)
+
+	// Deletions by someone else sign the user out everywhere
+	_, err = helpers.ScheduleAccountDeletion(user.User_id, admin.User_id, "ADMIN")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, findTestUser(t, user.User_id).Token_version)
+
+	_, err = helpers.ScheduleAccountDeletion(other.User_id, admin.User_id, "ADMIN")
+	assert.NoError(t, err)
+
+	// Admins waiting to be deleted don't count, so the last one left stays
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	admins, err := database.OpenCollection(database.Client, "user").CountDocuments(ctx, bson.M{"user_type": "ADMIN", "deletion_scheduled_at": nil})
+	assert.NoError(t, err)
+
+	_, err = helpers.ScheduleAccountDeletion(admin.User_id, admin.User_id, "ADMIN")
+	if admins == 1 {
+		assert.ErrorIs(t, err, helpers.ErrLastAdmin)
+	} else {
+		assert.NoError(t, err)
+	}
+}
+
+func TestPurgeDueAccounts(t *testing.T) {
+	withRecordedMail(t)
+	withSecretKey(t, "test-secret-key")
+	grace := helpers.ACCOUNT_DELETION_GRACE
+	helpers.ACCOUNT_DELETION_GRACE = -time.Second
+	t.Cleanup(func() { helpers.ACCOUNT_DELETION_GRACE = grace })
+
+	user := insertTestUser(t, "USER")
+	signInTestUser(t, &user, testClient)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reviews := database.OpenCollection(database.Client, "review")
+	text := "Loved it"
+	review := models.Review{
+		Id:          primitive.NewObjectID(),
+		Review:      &text,
+		Review_id:   primitive.NewObjectID().Hex(),
+		Movie_id:    primitive.NewObjectID().Hex(),
+		Reviewer_id: user.User_id,
+		Rating:      8,
+		Created_at:  time.Now(),
+		Updated_at:  time.Now(),
+	}
+	_, err := reviews.InsertOne(ctx, review)
+	assert.NoError(t, err)
+	t.Cleanup(func() { reviews.DeleteOne(context.Background(), bson.M{"review_id": review.Review_id}) })
+
+	_, err = helpers.ScheduleAccountDeletion(user.User_id, user.User_id, "USER")
+	assert.NoError(t, err)
+
+	removed, err := helpers.PurgeDueAccounts()
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, removed, 1)
+
+	users, err := database.OpenCollection(database.Client, "user").CountDocuments(ctx, bson.M{"user_id": user.User_id})
+	assert.NoError(t, err)
+	assert.Zero(t, users)
+
+	sessions, err := helpers.ListSessions(user.User_id)
+	assert.NoError(t, err)
+	assert.Empty(t, sessions, "The user's sessions should go with the account")
+
+	// Reviews stay, without saying who wrote them
+	var kept models.Review
+	assert.NoError(t, reviews.FindOne(ctx, bson.M{"review_id": review.Review_id}).Decode(&kept))
+	assert.Equal(t, helpers.AnonymousReviewerId, kept.Reviewer_id)
+}
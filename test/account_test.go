@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"shive/controllers"
+	"shive/database"
+	"shive/helpers"
+	"shive/models"
+	"shive/routes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const testPassword = "Correct-Horse-42-battery"
+
+// userRouter serves the user routes, as the API does.
+func userRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	routes.UserRoutes(router)
+	return router
+}
+
+// serveJSON sends body to the router as JSON, signed in with token when it isn't empty.
+func serveJSON(t *testing.T, router *gin.Engine, method string, path string, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var payload bytes.Buffer
+	if body != nil {
+		assert.NoError(t, json.NewEncoder(&payload).Encode(body))
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+// withTestPassword gives a stored user testPassword, and forgets the failed
+// attempts made against it when the test ends.
+func withTestPassword(t *testing.T, user *models.User) {
+	t.Helper()
+
+	hash := controllers.MaskPassword(testPassword)
+	user.Password = &hash
+	updateTestUser(t, user.User_id, bson.M{"password": hash})
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// httptest requests come from 192.0.2.1, an address kept for documentation
+		database.OpenCollection(database.Client, "login_attempt").DeleteMany(ctx, bson.M{"value": bson.M{"$in": bson.A{*user.Email, "192.0.2.1"}}})
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	withRecordedMail(t)
+	user := insertTestUser(t, "USER")
+	withTestPassword(t, &user)
+	router := userRouter()
+
+	_, token, _ := signInTestUser(t, &user, testClient)
+	_, otherToken, _ := signInTestUser(t, &user, testClient)
+	newPassword := "Another-Horse-43-battery"
+
+	resp := serveJSON(t, router, "PUT", "/users/me/password", token, gin.H{"current_password": "wrong password", "new_password": newPassword})
+	assert.Equal(t, http.StatusBadRequest, resp.Code, "The current password is required")
+
+	resp = serveJSON(t, router, "PUT", "/users/me/password", token, gin.H{"current_password": testPassword, "new_password": "short"})
+	assert.Equal(t, http.StatusBadRequest, resp.Code, "The password policy applies")
+
+	resp = serveJSON(t, router, "PUT", "/users/me/password", token, gin.H{"current_password": testPassword, "new_password": newPassword})
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var login LoginResponse
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &login))
+	assert.Nil(t, login.Password)
+	assert.NotEmpty(t, login.Token, "The caller should get a fresh token pair")
+
+	stored := findTestUser(t, user.User_id)
+	matches, _ := controllers.ConfirmPassword(newPassword, *stored.Password)
+	assert.True(t, matches)
+
+	// Every session from before the change is signed out, the new one works
+	for _, old := range []string{token, otherToken} {
+		resp = serveJSON(t, router, "GET", "/users/me", old, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	}
+	resp = serveJSON(t, router, "GET", "/users/me", login.Token, nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestChangeEmail(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	mailer := withRecordedMail(t)
+	user := insertTestUser(t, "USER")
+	withTestPassword(t, &user)
+	router := userRouter()
+	_, token, _ := signInTestUser(t, &user, testClient)
+
+	newEmail := "new_" + *user.Email
+	resp := serveJSON(t, router, "PUT", "/users/me/email", token, gin.H{"new_email": newEmail, "password": "wrong password"})
+	assert.Equal(t, http.StatusBadRequest, resp.Code, "The password is required")
+
+	resp = serveJSON(t, router, "PUT", "/users/me/email", token, gin.H{"new_email": newEmail, "password": testPassword})
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+
+	// The current address stays until the new one is verified, and hears of the change
+	stored := findTestUser(t, user.User_id)
+	assert.Equal(t, *user.Email, *stored.Email)
+	if assert.NotNil(t, stored.Pending_email) {
+		assert.Equal(t, newEmail, *stored.Pending_email)
+	}
+	assert.Len(t, mailer.sentTo(*user.Email), 1)
+
+	verified, err := helpers.VerifyEmail(mailedToken(t, mailer, newEmail))
+	if assert.NoError(t, err) {
+		assert.Equal(t, newEmail, *verified.Email)
+		assert.Nil(t, verified.Pending_email)
+	}
+}
+
+func TestChangeEmailTaken(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	withRecordedMail(t)
+	user := insertTestUser(t, "USER")
+	withTestPassword(t, &user)
+	other := insertTestUser(t, "USER")
+	router := userRouter()
+	_, token, _ := signInTestUser(t, &user, testClient)
+
+	// Addresses are unique regardless of case, as at signup
+	resp := serveJSON(t, router, "PUT", "/users/me/email", token, gin.H{"new_email": strings.ToUpper(*other.Email), "password": testPassword})
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Nil(t, findTestUser(t, user.User_id).Pending_email)
+}
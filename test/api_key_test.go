@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"shive/database"
+	"shive/helpers"
+	"shive/middleware"
+	"shive/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestApiKeyAllows(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		method string
+		want   bool
+	}{
+		{scopes: []string{helpers.ApiKeyScopeRead}, method: "GET", want: true},
+		{scopes: []string{helpers.ApiKeyScopeRead}, method: "HEAD", want: true},
+		{scopes: []string{helpers.ApiKeyScopeRead}, method: "POST", want: false},
+		{scopes: []string{helpers.ApiKeyScopeRead}, method: "DELETE", want: false},
+		{scopes: []string{helpers.ApiKeyScopeWrite}, method: "GET", want: true},
+		{scopes: []string{helpers.ApiKeyScopeWrite}, method: "PATCH", want: true},
+		{scopes: nil, method: "GET", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.scopes, ",")+" "+tt.method, func(t *testing.T) {
+			key := &models.ApiKey{Scopes: tt.scopes}
+			assert.Equal(t, tt.want, helpers.ApiKeyAllows(key, tt.method))
+		})
+	}
+}
+
+// createTestApiKey creates a key and deletes it when the test ends.
+func createTestApiKey(t *testing.T, scopes []string, expiresAt time.Time) (*models.ApiKey, string) {
+	t.Helper()
+	requireDatabase(t)
+
+	key, plainKey, err := helpers.CreateApiKey("test job", "USER", scopes, expiresAt, "tester")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		database.OpenCollection(database.Client, "api_key").DeleteOne(ctx, bson.M{"key_id": key.Key_id})
+	})
+	return key, plainKey
+}
+
+// whoAmI answers requests that authenticate with the uid and role they were given.
+func whoAmI() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.Authenticate())
+	handler := func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"uid": c.GetString("uid"), "user_type": c.GetString("user_type")})
+	}
+	router.GET("/whoami", handler)
+	router.POST("/whoami", handler)
+	return router
+}
+
+func TestApiKeyAuthentication(t *testing.T) {
+	key, plainKey := createTestApiKey(t, []string{helpers.ApiKeyScopeRead}, time.Now().Add(time.Hour))
+	router := whoAmI()
+
+	request := func(method string, header string, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/whoami", nil)
+		req.Header.Set(header, value)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	resp := request("GET", "Authorization", "Bearer "+plainKey)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"uid": "`+key.Key_id+`", "user_type": "USER"}`, resp.Body.String())
+
+	resp = request("GET", "X-API-Key", plainKey)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Read-only keys can't make changes
+	resp = request("POST", "X-API-Key", plainKey)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	resp = request("GET", "X-API-Key", plainKey+"x")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	assert.NoError(t, helpers.RevokeApiKey(key.Key_id))
+	resp = request("GET", "X-API-Key", plainKey)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code, "Revoked keys should stop working")
+}
+
+func TestApiKeyStorage(t *testing.T) {
+	key, plainKey := createTestApiKey(t, []string{helpers.ApiKeyScopeWrite}, time.Now().Add(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var stored bson.M
+	err := database.OpenCollection(database.Client, "api_key").FindOne(ctx, bson.M{"key_id": key.Key_id}).Decode(&stored)
+	assert.NoError(t, err)
+	for name, value := range stored {
+		assert.NotEqual(t, plainKey, value, "The plain key should not be stored in %s", name)
+	}
+	assert.Equal(t, helpers.HashToken(plainKey), stored["key_hash"])
+
+	used, err := helpers.AuthenticateApiKey(plainKey)
+	if assert.NoError(t, err) {
+		assert.NotNil(t, used.Last_used_at, "Using a key should record when")
+	}
+}
+
+func TestExpiredApiKey(t *testing.T) {
+	_, plainKey := createTestApiKey(t, []string{helpers.ApiKeyScopeRead}, time.Now().Add(-time.Minute))
+
+	_, err := helpers.AuthenticateApiKey(plainKey)
+	assert.ErrorIs(t, err, helpers.ErrInvalidApiKey)
+}
+
+func TestAuthorizeRoleGrant(t *testing.T) {
+	requireDatabase(t)
+	assert.NoError(t, helpers.SeedRolePolicies())
+
+	tests := []struct {
+		name       string
+		callerRole string
+		role       string
+		wantStatus int
+	}{
+		{name: "admin grants a custom role", callerRole: "ADMIN", role: "MODERATOR"},
+		{name: "admin grants admin", callerRole: "ADMIN", role: "ADMIN"},
+		{name: "user grants user", callerRole: "USER", role: "USER"},
+		{name: "other roles need user:role", callerRole: "MODERATOR", role: "CURATOR", wantStatus: http.StatusForbidden},
+		{name: "a role that doesn't cover user", callerRole: "GUEST", role: "USER", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("POST", "/api-keys", nil)
+			c.Set("uid", "tester")
+			c.Set("user_type", tt.callerRole)
+			c.Set("mfa", true)
+
+			err := helpers.AuthorizeRoleGrant(c, tt.role)
+			if tt.wantStatus == 0 {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, tt.wantStatus, helpers.AuthorizeStatus(err))
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"shive/helpers"
+	"shive/models"
+	"shive/routes"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAudit(t *testing.T) {
+	user := insertTestUser(t, "USER")
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("PUT", "/users/me/password", nil)
+	c.Request.Header.Set("User-Agent", "audit test")
+	c.Set("uid", user.User_id)
+	c.Set("auth_method", "token")
+
+	helpers.Audit(c, helpers.AuditPasswordConfirm, *user.Email, errors.New("wrong password"))
+	helpers.Audit(c, helpers.AuditPasswordChange, user.User_id, nil)
+
+	events, err := helpers.ListAuditEvents(helpers.AuditEventFilter{Actor: user.User_id, Limit: 10})
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		// Newest first
+		assert.Equal(t, helpers.AuditPasswordChange, events[0].Action)
+		assert.Equal(t, helpers.AuditSuccess, events[0].Outcome)
+		assert.Equal(t, "audit test", events[0].User_agent)
+		assert.Equal(t, "token", events[0].Auth_method)
+
+		assert.Equal(t, helpers.AuditPasswordConfirm, events[1].Action)
+		assert.Equal(t, helpers.AuditFailure, events[1].Outcome)
+		assert.Equal(t, "wrong password", events[1].Reason)
+	}
+
+	failures, err := helpers.ListAuditEvents(helpers.AuditEventFilter{Actor: user.User_id, Outcome: helpers.AuditFailure, Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, failures, 1)
+
+	later, err := helpers.ListAuditEvents(helpers.AuditEventFilter{Actor: user.User_id, Since: time.Now().Add(time.Minute), Limit: 10})
+	assert.NoError(t, err)
+	assert.Empty(t, later)
+}
+
+func TestAuditTokenIssue(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	user := insertTestUser(t, "USER")
+	claims, _, _ := signInTestUser(t, &user, testClient)
+
+	// Logins are recorded against the session they start
+	events, err := helpers.ListAuditEvents(helpers.AuditEventFilter{Actor: user.User_id, Action: helpers.AuditTokenIssue, Limit: 10})
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, claims.Family_id, events[0].Target)
+		assert.Equal(t, testClient.Ip, events[0].Ip)
+	}
+}
+
+func TestGetAuditEvents(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	requireDatabase(t)
+	assert.NoError(t, helpers.SeedRolePolicies())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	routes.AuditRoutes(router)
+
+	user := insertTestUser(t, "USER")
+	_, userToken, _ := signInTestUser(t, &user, testClient)
+	admin := insertTestUser(t, "ADMIN")
+	_, adminToken, _ := signInTestUser(t, &admin, testClient)
+
+	query := url.Values{"actor": {user.User_id}, "action": {helpers.AuditTokenIssue}}
+	resp := serveJSON(t, router, "GET", "/audit-events?"+query.Encode(), userToken, nil)
+	assert.Equal(t, http.StatusForbidden, resp.Code, "Reading the audit log needs audit:read")
+
+	requireMfa := helpers.REQUIRE_ADMIN_2FA
+	helpers.REQUIRE_ADMIN_2FA = false
+	t.Cleanup(func() { helpers.REQUIRE_ADMIN_2FA = requireMfa })
+
+	resp = serveJSON(t, router, "GET", "/audit-events?"+query.Encode(), adminToken, nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var body struct {
+		Data []models.AuditEvent `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+	if assert.Len(t, body.Data, 1) {
+		assert.Equal(t, user.User_id, body.Data[0].Actor)
+	}
+
+	resp = serveJSON(t, router, "GET", "/audit-events?since=yesterday", adminToken, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"shive/models"
 	"strconv"
@@ -42,6 +44,17 @@ type SignupRespone struct {
 	Data LoginResponse
 }
 
+type TokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RefreshResponse struct {
+	Status  int       `json:"status"`
+	Message string    `json:"message"`
+	Data    TokenPair `json:"data"`
+}
+
 type TestUser struct {
 	Name     string `json:"name"`
 	Username string `json:"username"`
@@ -53,6 +66,25 @@ type TestUser struct {
 
 var baseURL = os.Getenv("API_URL")
 
+// requireAPI skips tests that call the running API when nothing listens at baseURL.
+func requireAPI(t *testing.T) {
+	t.Helper()
+
+	api, err := url.Parse(baseURL)
+	if err != nil {
+		t.Fatalf("API_URL is not a URL: %v", err)
+	}
+	host := api.Host
+	if api.Port() == "" {
+		host = net.JoinHostPort(api.Hostname(), api.Scheme)
+	}
+	conn, err := net.DialTimeout("tcp", host, 2*time.Second)
+	if err != nil {
+		t.Skipf("The API is not reachable at %s: %v", baseURL, err)
+	}
+	conn.Close()
+}
+
 func TestAPIEndpoints(t *testing.T) {
 	if baseURL == "" {
 		baseURL = "http://localhost:9000"
@@ -67,7 +99,7 @@ func TestAPIEndpoints(t *testing.T) {
 		Username: username,
 		Password: "testpass123",
 		Email:    email,
-		UserType: "ADMIN",
+		UserType: "USER",
 	}
 
 	// {
@@ -79,6 +111,7 @@ func TestAPIEndpoints(t *testing.T) {
 	// }
 	// Setup: Start the server and wait for it to be ready
 	time.Sleep(2 * time.Second)
+	requireAPI(t)
 
 	// First sign up the user
 	t.Run("Signup Flow", func(t *testing.T) {
@@ -89,6 +122,17 @@ func TestAPIEndpoints(t *testing.T) {
 
 	})
 
+	// Password accounts have no OIDC identity, which must not count as a duplicate one
+	t.Run("Second Local Signup", func(t *testing.T) {
+		secondUser := testUser
+		secondUser.Email = "second_" + email
+		secondUser.Username = "second" + username
+
+		token, userID := testSignup(t, baseURL, secondUser)
+		assert.NotEmpty(t, token, "Token should not be empty")
+		assert.NotEmpty(t, userID, "UserID should not be empty")
+	})
+
 	t.Run("Login Flow", func(t *testing.T) {
 		// Test Login
 		token, userID := testLogin(t, baseURL, testUser)
@@ -102,6 +146,43 @@ func TestAPIEndpoints(t *testing.T) {
 
 	})
 
+	t.Run("Bearer Authentication", func(t *testing.T) {
+		token, userID := testLogin(t, baseURL, testUser)
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/users/%s", baseURL, userID), nil)
+		assert.NoError(t, err, "User details request should not error")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "User details request should not error")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Bearer token should be accepted")
+
+		// Requests without a token are challenged
+		resp, err = http.Get(fmt.Sprintf("%s/users/%s", baseURL, userID))
+		assert.NoError(t, err, "User details request should not error")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "Should return 401 Unauthorized")
+		assert.True(t, strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Bearer"), "Should send a Bearer challenge")
+	})
+
+	t.Run("Refresh Flow", func(t *testing.T) {
+		refreshToken := testLoginRefreshToken(t, baseURL, testUser)
+
+		// A refresh token can be exchanged once
+		status, rotated := testRefresh(t, baseURL, refreshToken)
+		assert.Equal(t, http.StatusOK, status, "Should return 200 OK")
+		assert.NotEmpty(t, rotated.Token, "Token should not be empty")
+		assert.NotEmpty(t, rotated.RefreshToken, "Refresh token should not be empty")
+
+		// Reusing it revokes the family, including the token it was rotated into
+		status, _ = testRefresh(t, baseURL, refreshToken)
+		assert.Equal(t, http.StatusUnauthorized, status, "Reused refresh token should return 401")
+
+		status, _ = testRefresh(t, baseURL, rotated.RefreshToken)
+		assert.Equal(t, http.StatusUnauthorized, status, "Revoked refresh token family should return 401")
+	})
+
 }
 
 func testSignup(t *testing.T, baseURL string, user TestUser) (string, string) {
@@ -230,5 +311,37 @@ func testGetUserDetails(t *testing.T, baseURL string, token string, userID strin
 	// Assert email and username
 	assert.Equal(t, testUser.Email, *userDetails.Email, "Email should match")
 	assert.Equal(t, testUser.Username, *userDetails.Username, "Username should match")
+	assert.Nil(t, userDetails.Password, "Password should be null")
+
+}
+
+func testLoginRefreshToken(t *testing.T, baseURL string, user TestUser) string {
+	jsonData, _ := json.Marshal(user)
+
+	resp, err := http.Post(fmt.Sprintf("%s/users/login", baseURL), "application/json", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err, "Login request should not error")
+	defer resp.Body.Close()
+
+	var loginResp LoginResponse
+	err = json.NewDecoder(resp.Body).Decode(&loginResp)
+	assert.NoError(t, err, "Should decode response")
+
+	if loginResp.RefreshToken == nil {
+		t.Fatal("Refresh token is nil in login response")
+	}
+	return *loginResp.RefreshToken
+}
+
+func testRefresh(t *testing.T, baseURL string, refreshToken string) (int, TokenPair) {
+	jsonData, _ := json.Marshal(map[string]string{"refresh_token": refreshToken})
+
+	resp, err := http.Post(fmt.Sprintf("%s/users/refresh", baseURL), "application/json", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err, "Refresh request should not error")
+	defer resp.Body.Close()
+
+	var refreshResp RefreshResponse
+	err = json.NewDecoder(resp.Body).Decode(&refreshResp)
+	assert.NoError(t, err, "Should decode response")
 
+	return resp.StatusCode, refreshResp.Data
 }
@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"shive/helpers"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withSecretKey(t *testing.T, key string) {
+	previous := helpers.SECRET_KEY
+	helpers.SECRET_KEY = key
+	t.Cleanup(func() { helpers.SECRET_KEY = previous })
+}
+
+func TestSealSecret(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+
+	sealed, err := helpers.SealSecret("JBSWY3DPEHPK3PXP")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, "sealed:"), "Sealed secrets should be prefixed")
+	assert.NotContains(t, sealed, "JBSWY3DPEHPK3PXP", "Sealed secrets should not contain the plaintext")
+
+	opened, err := helpers.OpenSecret(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", opened)
+
+	again, err := helpers.SealSecret("JBSWY3DPEHPK3PXP")
+	assert.NoError(t, err)
+	assert.NotEqual(t, sealed, again, "Every seal should use a fresh nonce")
+}
+
+func TestOpenSecret(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	sealed, err := helpers.SealSecret("secret")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "value stored before sealing", key: "test-secret-key", value: "secret", want: "secret"},
+		{name: "sealed value", key: "test-secret-key", value: sealed, want: "secret"},
+		{name: "another key", key: "another-key", value: sealed, wantErr: true},
+		{name: "no key", key: "", value: sealed, wantErr: true},
+		{name: "not base64", key: "test-secret-key", value: "sealed:***", wantErr: true},
+		{name: "too short", key: "test-secret-key", value: "sealed:AAAA", wantErr: true},
+		{name: "tampered", key: "test-secret-key", value: sealed[:len(sealed)-2] + "AA", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSecretKey(t, tt.key)
+			opened, err := helpers.OpenSecret(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, opened)
+		})
+	}
+}
+
+func TestSealSecretWithoutKey(t *testing.T) {
+	withSecretKey(t, "")
+
+	sealed, err := helpers.SealSecret("secret")
+	assert.ErrorIs(t, err, helpers.ErrNoSecretKey, "Secrets should never be stored in the clear")
+	assert.Empty(t, sealed)
+}
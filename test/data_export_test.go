@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"shive/helpers"
+	"shive/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// readExport returns the files of an export archive by name.
+func readExport(t *testing.T, archive []byte) map[string][]byte {
+	t.Helper()
+
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	files := map[string][]byte{}
+	for _, file := range reader.File {
+		opened, err := file.Open()
+		assert.NoError(t, err)
+		content, err := io.ReadAll(opened)
+		assert.NoError(t, err)
+		opened.Close()
+		files[file.Name] = content
+	}
+	return files
+}
+
+func TestWriteDataExport(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	user := insertTestUser(t, "USER")
+	signInTestUser(t, &user, testClient)
+
+	var archive bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, helpers.WriteDataExport(ctx, &archive, user.User_id))
+
+	files := readExport(t, archive.Bytes())
+
+	var profile map[string]interface{}
+	assert.NoError(t, json.Unmarshal(files["profile.json"], &profile))
+	assert.Equal(t, user.User_id, profile["user_id"])
+	assert.Nil(t, profile["password"], "The password hash should not be exported")
+
+	var sessions []models.Session
+	assert.NoError(t, json.Unmarshal(files["sessions.json"], &sessions))
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, testClient.User_agent, sessions[0].User_agent)
+	}
+
+	var reviews []models.Review
+	assert.NoError(t, json.Unmarshal(files["reviews.json"], &reviews))
+	assert.Empty(t, reviews)
+
+	var manifest struct {
+		User_id string         `json:"user_id"`
+		Files   map[string]int `json:"files"`
+	}
+	assert.NoError(t, json.Unmarshal(files["manifest.json"], &manifest))
+	assert.Equal(t, user.User_id, manifest.User_id)
+	assert.Equal(t, map[string]int{"profile.json": 1, "reviews.json": 0, "sessions.json": 1}, manifest.Files)
+}
+
+func TestRequestDataExport(t *testing.T) {
+	user := insertTestUser(t, "USER")
+
+	export, created, err := helpers.RequestDataExport(user.User_id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, created)
+
+	// Asking again before it is finished returns the same export
+	again, created, err := helpers.RequestDataExport(user.User_id)
+	if assert.NoError(t, err) && !created {
+		assert.Equal(t, export.Export_id, again.Export_id)
+	}
+
+	// The export is built in the background
+	var built *models.DataExport
+	assert.Eventually(t, func() bool {
+		built, err = helpers.GetDataExport(user.User_id, export.Export_id)
+		return err == nil && built.Status != helpers.DataExportPending && built.Status != helpers.DataExportProcessing
+	}, 10*time.Second, 50*time.Millisecond)
+	if !assert.NotNil(t, built) {
+		return
+	}
+	assert.Equal(t, helpers.DataExportReady, built.Status)
+	assert.Positive(t, built.Size)
+
+	download, err := helpers.OpenDataExport(built)
+	if assert.NoError(t, err) {
+		archive, err := io.ReadAll(download)
+		download.Close()
+		assert.NoError(t, err)
+		assert.Contains(t, readExport(t, archive), "profile.json")
+	}
+
+	// Exports belong to the user who asked for them
+	other := insertTestUser(t, "USER")
+	_, err = helpers.GetDataExport(other.User_id, export.Export_id)
+	assert.Error(t, err)
+}
+
+func TestOpenDataExport(t *testing.T) {
+	fileId := primitive.NewObjectID()
+	expired := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name   string
+		export models.DataExport
+		want   error
+	}{
+		{name: "pending", export: models.DataExport{Status: helpers.DataExportPending}, want: helpers.ErrDataExportNotReady},
+		{name: "processing", export: models.DataExport{Status: helpers.DataExportProcessing}, want: helpers.ErrDataExportNotReady},
+		{name: "failed", export: models.DataExport{Status: helpers.DataExportFailed}, want: helpers.ErrDataExportNotReady},
+		{name: "expired", export: models.DataExport{Status: helpers.DataExportReady, File_id: &fileId, Expires_at: &expired}, want: helpers.ErrDataExportExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			download, err := helpers.OpenDataExport(&tt.export)
+			assert.ErrorIs(t, err, tt.want)
+			assert.Nil(t, download)
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"context"
+	"shive/database"
+	"shive/models"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var databaseReachable = sync.OnceValue(func() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return database.Client.Ping(ctx, nil)
+})
+
+// requireDatabase skips tests that need MongoDB when it can't be reached.
+func requireDatabase(t *testing.T) {
+	t.Helper()
+
+	if err := databaseReachable(); err != nil {
+		t.Skipf("MongoDB is not reachable: %v", err)
+	}
+}
+
+// Collections whose documents belong to a user through their user_id.
+var userDataCollections = []string{
+	"user", "refresh_token", "revoked_token", "session", "password_reset", "email_verification",
+	"magic_link", "data_export", "review", "user_admin_action",
+}
+
+// insertTestUser stores a verified user with role and removes it and whatever
+// it left behind when the test ends.
+func insertTestUser(t *testing.T, role string) models.User {
+	t.Helper()
+	requireDatabase(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id := primitive.NewObjectID()
+	name, username, email := "Test User", "test"+id.Hex(), "test_"+id.Hex()+"@example.com"
+	password := "unused password hash"
+	now := time.Now()
+	user := models.User{
+		ID:                id,
+		Name:              &name,
+		Username:          &username,
+		Password:          &password,
+		Email:             &email,
+		User_type:         &role,
+		Created_at:        now,
+		Updated_at:        now,
+		User_id:           id.Hex(),
+		Email_verified:    true,
+		Email_verified_at: &now,
+	}
+
+	_, err := database.OpenCollection(database.Client, "user").InsertOne(ctx, user)
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, name := range userDataCollections {
+			database.OpenCollection(database.Client, name).DeleteMany(ctx, bson.M{"user_id": user.User_id})
+		}
+		database.OpenCollection(database.Client, "audit_event").DeleteMany(ctx, bson.M{"actor": user.User_id})
+		// Throttled emails are keyed by the user's ID, address or an IP named after it
+		database.OpenCollection(database.Client, "email_send").DeleteMany(ctx, bson.M{"key": primitive.Regex{Pattern: user.User_id}})
+	})
+	return user
+}
+
+// findTestUser reads the stored state of a user.
+func findTestUser(t *testing.T, userId string) models.User {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user models.User
+	err := database.OpenCollection(database.Client, "user").FindOne(ctx, bson.M{"user_id": userId}).Decode(&user)
+	assert.NoError(t, err)
+	return user
+}
+
+// updateTestUser sets fields of a stored user.
+func updateTestUser(t *testing.T, userId string, set bson.M) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := database.OpenCollection(database.Client, "user").UpdateOne(ctx, bson.M{"user_id": userId}, bson.M{"$set": set})
+	assert.NoError(t, err)
+}
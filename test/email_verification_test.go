@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"context"
+	"regexp"
+	"shive/database"
+	"shive/helpers"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// recordingMailer keeps the messages it is asked to send.
+type recordingMailer struct {
+	mu       sync.Mutex
+	messages []helpers.MailMessage
+}
+
+func (m *recordingMailer) Send(message helpers.MailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// sentTo returns the messages sent to address.
+func (m *recordingMailer) sentTo(address string) []helpers.MailMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sent []helpers.MailMessage
+	for _, message := range m.messages {
+		if message.To == address {
+			sent = append(sent, message)
+		}
+	}
+	return sent
+}
+
+// withRecordedMail sends the mail of the test to a recordingMailer.
+func withRecordedMail(t *testing.T) *recordingMailer {
+	mailer := &recordingMailer{}
+	previous := helpers.AppMailer
+	helpers.AppMailer = mailer
+	t.Cleanup(func() { helpers.AppMailer = previous })
+	return mailer
+}
+
+var linkToken = regexp.MustCompile(`token=([A-Za-z0-9_.-]+)`)
+
+// mailedToken returns the token in the link of the last message sent to address.
+func mailedToken(t *testing.T, mailer *recordingMailer, address string) string {
+	t.Helper()
+
+	sent := mailer.sentTo(address)
+	if !assert.NotEmpty(t, sent, "A message should have been sent to %s", address) {
+		return ""
+	}
+	match := linkToken.FindStringSubmatch(sent[len(sent)-1].Body)
+	if !assert.NotNil(t, match, "The message should hold a link with a token") {
+		return ""
+	}
+	return match[1]
+}
+
+func TestVerifyEmail(t *testing.T) {
+	mailer := withRecordedMail(t)
+	user := insertTestUser(t, "USER")
+	updateTestUser(t, user.User_id, bson.M{"email_verified": false, "email_verified_at": nil})
+
+	assert.NoError(t, helpers.SendVerificationEmail(user.User_id, *user.Name, *user.Email))
+	token := mailedToken(t, mailer, *user.Email)
+
+	verified, err := helpers.VerifyEmail(token)
+	if assert.NoError(t, err) {
+		assert.True(t, verified.Email_verified)
+		assert.NotNil(t, verified.Email_verified_at)
+	}
+	assert.True(t, findTestUser(t, user.User_id).Email_verified)
+
+	// Links are single use
+	_, err = helpers.VerifyEmail(token)
+	assert.ErrorIs(t, err, helpers.ErrInvalidVerificationToken)
+}
+
+func TestVerifyEmailResent(t *testing.T) {
+	mailer := withRecordedMail(t)
+	user := insertTestUser(t, "USER")
+	updateTestUser(t, user.User_id, bson.M{"email_verified": false})
+
+	assert.NoError(t, helpers.SendVerificationEmail(user.User_id, *user.Name, *user.Email))
+	first := mailedToken(t, mailer, *user.Email)
+	assert.NoError(t, helpers.SendVerificationEmail(user.User_id, *user.Name, *user.Email))
+	second := mailedToken(t, mailer, *user.Email)
+
+	// Sending another link retires the earlier one
+	_, err := helpers.VerifyEmail(first)
+	assert.ErrorIs(t, err, helpers.ErrInvalidVerificationToken)
+	_, err = helpers.VerifyEmail(second)
+	assert.NoError(t, err)
+
+	wait, err := helpers.VerificationRetryAfter(user.User_id)
+	assert.NoError(t, err)
+	assert.Positive(t, wait, "Another email should wait out the resend interval")
+}
+
+func TestVerifyEmailOfOldAddress(t *testing.T) {
+	mailer := withRecordedMail(t)
+	user := insertTestUser(t, "USER")
+	updateTestUser(t, user.User_id, bson.M{"email_verified": false})
+
+	assert.NoError(t, helpers.SendVerificationEmail(user.User_id, *user.Name, *user.Email))
+	token := mailedToken(t, mailer, *user.Email)
+
+	// A link only verifies the address it was sent to
+	updateTestUser(t, user.User_id, bson.M{"email": "moved_" + *user.Email})
+	_, err := helpers.VerifyEmail(token)
+	assert.ErrorIs(t, err, helpers.ErrInvalidVerificationToken)
+	assert.False(t, findTestUser(t, user.User_id).Email_verified)
+}
+
+func TestVerificationRetryAfterHourlyLimit(t *testing.T) {
+	ttl := helpers.EMAIL_VERIFICATION_TTL
+	helpers.EMAIL_VERIFICATION_TTL = -time.Second
+	t.Cleanup(func() { helpers.EMAIL_VERIFICATION_TTL = ttl })
+
+	withRecordedMail(t)
+	user := insertTestUser(t, "USER")
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, helpers.SendVerificationEmail(user.User_id, *user.Name, *user.Email))
+	}
+
+	// Links with a short TTL are purged within the hour, the throttle still counts them
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := database.OpenCollection(database.Client, "email_verification").DeleteMany(ctx, bson.M{"user_id": user.User_id})
+	assert.NoError(t, err)
+
+	// The hourly limit outlasts the resend interval, so it sets the wait
+	wait, err := helpers.VerificationRetryAfter(user.User_id)
+	assert.NoError(t, err)
+	assert.Greater(t, wait, 55*time.Minute)
+}
@@ -0,0 +1,33 @@
+package tests
+
+import (
+	"shive/helpers"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestGenreFilter(t *testing.T) {
+	ids := []string{"1", "2"}
+
+	tests := []struct {
+		name    string
+		match   string
+		want    bson.M
+		wantErr error
+	}{
+		{name: "any by default", match: "", want: bson.M{"genre_ids": bson.M{"$in": ids}}},
+		{name: "any", match: helpers.GenreMatchAny, want: bson.M{"genre_ids": bson.M{"$in": ids}}},
+		{name: "all", match: helpers.GenreMatchAll, want: bson.M{"genre_ids": bson.M{"$all": ids}}},
+		{name: "unknown match", match: "some", wantErr: helpers.ErrInvalidGenreMatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := helpers.GenreFilter(ids, tt.match)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, filter)
+		})
+	}
+}
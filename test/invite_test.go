@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"shive/database"
+	"shive/helpers"
+	"shive/routes"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// inviteTestEmail is an address no account has, whose invites and account are
+// removed when the test ends.
+func inviteTestEmail(t *testing.T) string {
+	t.Helper()
+	requireDatabase(t)
+
+	email := "invited_" + primitive.NewObjectID().Hex() + "@example.com"
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		database.OpenCollection(database.Client, "invite").DeleteMany(ctx, bson.M{"email": email})
+		database.OpenCollection(database.Client, "user").DeleteMany(ctx, bson.M{"email": email})
+	})
+	return email
+}
+
+func TestAcceptInvite(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	mailer := withRecordedMail(t)
+	email := inviteTestEmail(t)
+	assert.NoError(t, helpers.SeedRolePolicies())
+
+	invite, err := helpers.CreateInvite(email, "MODERATOR", "tester")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "MODERATOR", invite.User_type)
+	token := mailedToken(t, mailer, email)
+
+	username := "invited" + invite.ID.Hex()
+	user, err := helpers.AcceptInvite(token, "Invited User", username, "unused password hash")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "MODERATOR", *user.User_type)
+		assert.Equal(t, email, *user.Email)
+		assert.True(t, user.Email_verified, "The invite link proves the address")
+	}
+
+	// Invites are single use
+	_, err = helpers.AcceptInvite(token, "Invited User", "other"+username, "unused password hash")
+	assert.ErrorIs(t, err, helpers.ErrInvalidInvite)
+	assert.ErrorIs(t, helpers.RevokeInvite(invite.ID.Hex()), helpers.ErrInviteNotPending)
+
+	// Only invite tokens create accounts
+	accessToken, _, err := helpers.GenerateAllTokens(email, "Invited User", username, "ADMIN", invite.ID.Hex(), 0, false)
+	assert.NoError(t, err)
+	_, err = helpers.AcceptInvite(accessToken, "Invited User", "third"+username, "unused password hash")
+	assert.ErrorIs(t, err, helpers.ErrInvalidInvite)
+}
+
+func TestRevokeInvite(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	mailer := withRecordedMail(t)
+	email := inviteTestEmail(t)
+	assert.NoError(t, helpers.SeedRolePolicies())
+
+	first, err := helpers.CreateInvite(email, "USER", "tester")
+	assert.NoError(t, err)
+	firstToken := mailedToken(t, mailer, email)
+
+	// A new invite to the same address replaces the earlier one
+	second, err := helpers.CreateInvite(email, "CURATOR", "tester")
+	assert.NoError(t, err)
+	secondToken := mailedToken(t, mailer, email)
+	assert.ErrorIs(t, helpers.RevokeInvite(first.ID.Hex()), helpers.ErrInviteNotPending)
+
+	_, err = helpers.AcceptInvite(firstToken, "Invited User", "invited"+first.ID.Hex(), "unused password hash")
+	assert.ErrorIs(t, err, helpers.ErrInvalidInvite)
+
+	assert.NoError(t, helpers.RevokeInvite(second.ID.Hex()))
+	_, err = helpers.AcceptInvite(secondToken, "Invited User", "invited"+second.ID.Hex(), "unused password hash")
+	assert.ErrorIs(t, err, helpers.ErrInvalidInvite)
+
+	assert.ErrorIs(t, helpers.RevokeInvite(primitive.NewObjectID().Hex()), mongo.ErrNoDocuments)
+	assert.ErrorIs(t, helpers.RevokeInvite("not an id"), mongo.ErrNoDocuments)
+}
+
+func TestCreateInviteRefused(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	withRecordedMail(t)
+	email := inviteTestEmail(t)
+	assert.NoError(t, helpers.SeedRolePolicies())
+
+	_, err := helpers.CreateInvite(email, "NOBODY", "tester")
+	assert.ErrorIs(t, err, helpers.ErrUnknownRole)
+
+	user := insertTestUser(t, "USER")
+	_, err = helpers.CreateInvite(*user.Email, "USER", "tester")
+	assert.ErrorIs(t, err, helpers.ErrEmailTaken)
+}
+
+func TestBootstrapAdminOnce(t *testing.T) {
+	insertTestUser(t, "ADMIN")
+
+	// With an admin around, setup tokens are refused whatever they are
+	exists, err := helpers.AdminExists()
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	admin, err := helpers.BootstrapAdmin("any token", "Second Admin", "secondadmin", "second_admin@example.com", "unused password hash")
+	assert.ErrorIs(t, err, helpers.ErrAdminAlreadyExists)
+	assert.Nil(t, admin)
+}
+
+func TestSignupMissingFields(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	routes.AuthRoutes(router)
+	body := map[string]string{
+		"name":     "Test User",
+		"username": "signupfields",
+		"email":    "signup_fields@example.com",
+		"password": testPassword,
+	}
+
+	// Every field is checked before any of them is used
+	for _, field := range []string{"name", "username", "email"} {
+		t.Run(field, func(t *testing.T) {
+			partial := map[string]string{}
+			for key, value := range body {
+				if key != field {
+					partial[key] = value
+				}
+			}
+
+			resp := serveJSON(t, router, "POST", "/users/signup", "", partial)
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+		})
+	}
+}
+
+func TestListInvites(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	withRecordedMail(t)
+	pendingEmail, expiredEmail := inviteTestEmail(t), inviteTestEmail(t)
+	assert.NoError(t, helpers.SeedRolePolicies())
+
+	pending, err := helpers.CreateInvite(pendingEmail, "USER", "tester")
+	assert.NoError(t, err)
+
+	ttl := helpers.INVITE_TTL
+	helpers.INVITE_TTL = -time.Second
+	t.Cleanup(func() { helpers.INVITE_TTL = ttl })
+	expired, err := helpers.CreateInvite(expiredEmail, "USER", "tester")
+	assert.NoError(t, err)
+
+	invites, err := helpers.ListInvites()
+	assert.NoError(t, err)
+	listed := map[primitive.ObjectID]bool{}
+	for _, invite := range invites {
+		listed[invite.ID] = true
+	}
+	assert.True(t, listed[pending.ID], "Pending invites should be listed")
+	assert.False(t, listed[expired.ID], "Expired invites should not be listed, even before they are purged")
+}
@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"shive/helpers"
+	"shive/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginRetryAfterAttempt(t *testing.T) {
+	base, max := helpers.LOGIN_BACKOFF_BASE, helpers.LOGIN_BACKOFF_MAX
+	helpers.LOGIN_BACKOFF_BASE, helpers.LOGIN_BACKOFF_MAX = time.Second, 5*time.Minute
+	t.Cleanup(func() { helpers.LOGIN_BACKOFF_BASE, helpers.LOGIN_BACKOFF_MAX = base, max })
+
+	lastFailure := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	lockedUntil := lastFailure.Add(15 * time.Minute)
+	lockEnded := lastFailure.Add(-time.Minute)
+
+	// With the default thresholds an email backs off after 3 failures and an IP after 20
+	tests := []struct {
+		name        string
+		kind        string
+		failures    int
+		lockedUntil *time.Time
+		now         time.Time
+		wantWait    time.Duration
+		wantBlocked bool
+	}{
+		{name: "below the email threshold", kind: helpers.LoginAttemptEmail, failures: 2, now: lastFailure},
+		{name: "at the email threshold", kind: helpers.LoginAttemptEmail, failures: 3, now: lastFailure, wantWait: time.Second, wantBlocked: true},
+		{name: "doubles with each failure", kind: helpers.LoginAttemptEmail, failures: 4, now: lastFailure, wantWait: 2 * time.Second, wantBlocked: true},
+		{name: "doubles again", kind: helpers.LoginAttemptEmail, failures: 5, now: lastFailure, wantWait: 4 * time.Second, wantBlocked: true},
+		{name: "counts down", kind: helpers.LoginAttemptEmail, failures: 5, now: lastFailure.Add(3 * time.Second), wantWait: time.Second, wantBlocked: true},
+		{name: "over once the delay passed", kind: helpers.LoginAttemptEmail, failures: 3, now: lastFailure.Add(time.Second)},
+		{name: "capped at the maximum", kind: helpers.LoginAttemptEmail, failures: 12, now: lastFailure, wantWait: 5 * time.Minute, wantBlocked: true},
+		{name: "capped when the delay overflows", kind: helpers.LoginAttemptEmail, failures: 200, now: lastFailure, wantWait: 5 * time.Minute, wantBlocked: true},
+		{name: "below the IP threshold", kind: helpers.LoginAttemptIP, failures: 19, now: lastFailure},
+		{name: "at the IP threshold", kind: helpers.LoginAttemptIP, failures: 20, now: lastFailure, wantWait: time.Second, wantBlocked: true},
+		{name: "locked", kind: helpers.LoginAttemptEmail, failures: 10, lockedUntil: &lockedUntil, now: lastFailure, wantWait: 15 * time.Minute, wantBlocked: true},
+		{name: "lock ended", kind: helpers.LoginAttemptEmail, failures: 1, lockedUntil: &lockEnded, now: lastFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempt := models.LoginAttempt{
+				Kind:            tt.kind,
+				Failures:        tt.failures,
+				Last_failure_at: lastFailure,
+				Locked_until:    tt.lockedUntil,
+			}
+
+			wait, blocked := helpers.LoginRetryAfterAttempt(attempt, tt.now)
+			assert.Equal(t, tt.wantBlocked, blocked)
+			assert.Equal(t, tt.wantWait, wait)
+		})
+	}
+}
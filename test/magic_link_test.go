@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"shive/database"
+	"shive/helpers"
+	"shive/routes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMagicLinkRetryAfterSends(t *testing.T) {
+	interval := helpers.MAGIC_LINK_RESEND_INTERVAL
+	helpers.MAGIC_LINK_RESEND_INTERVAL = time.Minute
+	t.Cleanup(func() { helpers.MAGIC_LINK_RESEND_INTERVAL = interval })
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(minutes ...int) []time.Time {
+		sent := make([]time.Time, len(minutes))
+		for i, m := range minutes {
+			sent[i] = now.Add(-time.Duration(m) * time.Minute)
+		}
+		return sent
+	}
+
+	// At most one link a minute and five an hour
+	tests := []struct {
+		name string
+		sent []time.Time
+		want time.Duration
+	}{
+		{name: "never sent", sent: nil, want: 0},
+		{name: "just sent", sent: ago(0), want: time.Minute},
+		{name: "sent within the interval", sent: []time.Time{now.Add(-20 * time.Second)}, want: 40 * time.Second},
+		{name: "interval passed", sent: ago(1), want: 0},
+		{name: "four in the hour", sent: ago(2, 10, 20, 30), want: 0},
+		{name: "five in the hour", sent: ago(2, 10, 20, 30, 40), want: 20 * time.Minute},
+		{name: "more than five in the hour", sent: ago(2, 10, 20, 30, 40, 50), want: 20 * time.Minute},
+		{name: "hourly limit outweighs the interval", sent: ago(0, 10, 20, 30, 40), want: 20 * time.Minute},
+		{name: "interval outweighs the hourly limit", sent: append(ago(0, 10, 20, 30), now.Add(-59*time.Minute-30*time.Second)), want: time.Minute},
+		{name: "oldest sent an hour ago", sent: ago(2, 10, 20, 30, 60), want: 0},
+		{name: "older links are ignored", sent: ago(61, 70, 80, 90, 100), want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, helpers.MagicLinkRetryAfterSends(tt.sent, now))
+		})
+	}
+}
+
+func TestRetryAfterSends(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	minutesAgo := func(count int, every int) []time.Time {
+		sent := make([]time.Time, count)
+		for i := range sent {
+			sent[i] = now.Add(-time.Duration((i+1)*every) * time.Minute)
+		}
+		return sent
+	}
+
+	// Password resets per IP have no interval, only an hourly limit
+	tests := []struct {
+		name     string
+		sent     []time.Time
+		interval time.Duration
+		perHour  int
+		want     time.Duration
+	}{
+		{name: "no interval", sent: []time.Time{now}, interval: 0, perHour: 20, want: 0},
+		{name: "below the hourly limit", sent: minutesAgo(19, 1), interval: 0, perHour: 20, want: 0},
+		{name: "at the hourly limit", sent: minutesAgo(20, 1), interval: 0, perHour: 20, want: 40 * time.Minute},
+		{name: "limit of one", sent: minutesAgo(1, 15), interval: 0, perHour: 1, want: 45 * time.Minute},
+		{name: "interval only", sent: minutesAgo(1, 1), interval: 5 * time.Minute, perHour: 20, want: 4 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, helpers.RetryAfterSends(tt.sent, now, tt.interval, tt.perHour))
+		})
+	}
+}
+
+func TestMagicLinkRetryAfterPurgedLinks(t *testing.T) {
+	user := insertTestUser(t, "USER")
+	withRecordedMail(t)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, helpers.SendMagicLink(&user))
+	}
+
+	// Expired links are purged long before the hour is over, the throttle still counts them
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := database.OpenCollection(database.Client, "magic_link").DeleteMany(ctx, bson.M{"user_id": user.User_id})
+	assert.NoError(t, err)
+
+	wait, err := helpers.MagicLinkRetryAfter(*user.Email)
+	assert.NoError(t, err)
+	assert.Greater(t, wait, 55*time.Minute, "Five links in the hour should hold the next one back until the first ages out")
+}
+
+func TestRequestMagicLinkIgnoresEmailCase(t *testing.T) {
+	mailer := withRecordedMail(t)
+	user := insertTestUser(t, "USER")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	routes.AuthRoutes(router)
+
+	// Signup treats addresses that only differ in case as the same one
+	resp := serveJSON(t, router, "POST", "/users/login/magic-link", "", map[string]string{"email": strings.ToUpper(*user.Email)})
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	assert.NotEmpty(t, mailedToken(t, mailer, *user.Email), "The account should get a sign-in link")
+}
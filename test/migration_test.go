@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"context"
+	"shive/database"
+	"shive/helpers"
+	"shive/models"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The migrations that rewrite movies, which are safe to run again.
+var movieMigrations = bson.A{"001_movie_metadata", "002_movie_genre_ids", "003_movie_ratings"}
+
+func TestRunMigrations(t *testing.T) {
+	requireDatabase(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	movies := database.OpenCollection(database.Client, "movie")
+	migrations := database.OpenCollection(database.Client, "migration")
+
+	// Movies as they were stored before the metadata, genre lists and ratings
+	legacy := map[string]bson.M{
+		"with a genre": {"name": "Legacy", "topic": "Old", "genre_id": "g1"},
+		"blank genre":  {"name": "Blank", "topic": "Old", "genre_id": ""},
+		"null fields":  {"name": "Nulls", "topic": "Old", "runtime": nil, "average_rating": nil},
+	}
+	ids := bson.A{}
+	for _, movie := range legacy {
+		id := primitive.NewObjectID().Hex()
+		movie["movie_id"] = id
+		ids = append(ids, id)
+		_, err := movies.InsertOne(ctx, movie)
+		assert.NoError(t, err)
+	}
+	t.Cleanup(func() { movies.DeleteMany(context.Background(), bson.M{"movie_id": bson.M{"$in": ids}}) })
+
+	// Run the movie migrations again over the legacy movies
+	_, err := migrations.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": movieMigrations}})
+	assert.NoError(t, err)
+	assert.NoError(t, helpers.RunMigrations())
+
+	for name, movie := range legacy {
+		t.Run(name, func(t *testing.T) {
+			var migrated bson.M
+			assert.NoError(t, movies.FindOne(ctx, bson.M{"movie_id": movie["movie_id"]}).Decode(&migrated))
+			assert.NotContains(t, migrated, "genre_id")
+			assert.Equal(t, "", migrated["release_date"])
+			assert.EqualValues(t, 0, migrated["runtime"])
+			assert.Equal(t, bson.A{}, migrated["spoken_languages"])
+			assert.EqualValues(t, 0, migrated["average_rating"])
+			assert.EqualValues(t, 0, migrated["rating_count"])
+
+			var decoded models.Movie
+			assert.NoError(t, movies.FindOne(ctx, bson.M{"movie_id": movie["movie_id"]}).Decode(&decoded), "Migrated movies decode like new ones")
+			if movie["genre_id"] == "g1" {
+				assert.Equal(t, []string{"g1"}, decoded.Genre_ids)
+			} else {
+				assert.Equal(t, []string{}, decoded.Genre_ids)
+			}
+		})
+	}
+
+	// Every migration is recorded once it finished, and isn't applied again
+	var applied []models.Migration
+	cursor, err := migrations.Find(ctx, bson.M{})
+	assert.NoError(t, err)
+	assert.NoError(t, cursor.All(ctx, &applied))
+	finished := map[string]time.Time{}
+	for _, m := range applied {
+		if assert.NotNil(t, m.Finished_at, m.ID) {
+			finished[m.ID] = *m.Finished_at
+		}
+	}
+	for _, id := range movieMigrations {
+		assert.Contains(t, finished, id)
+	}
+
+	assert.NoError(t, helpers.RunMigrations())
+	for _, id := range movieMigrations {
+		var again models.Migration
+		assert.NoError(t, migrations.FindOne(ctx, bson.M{"_id": id}).Decode(&again))
+		assert.True(t, again.Finished_at.Equal(finished[id.(string)]), "%s should not run twice", id)
+	}
+}
+
+func TestMovieMetadataValidation(t *testing.T) {
+	name, topic := "Metropolis", "Science fiction"
+	valid := func() models.Movie {
+		return models.Movie{
+			Name:              &name,
+			Topic:             &topic,
+			Movie_URL:         "https://example.com/metropolis",
+			Genre_ids:         []string{"g1"},
+			Release_date:      "1927-01-10",
+			Runtime:           153,
+			Original_language: "de",
+			Spoken_languages:  []string{"de", "en-US"},
+			Countries:         []string{"DE"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		change  func(*models.Movie)
+		wantErr bool
+	}{
+		{name: "full metadata", change: func(m *models.Movie) {}},
+		{name: "no metadata", change: func(m *models.Movie) {
+			m.Release_date, m.Runtime, m.Original_language = "", 0, ""
+			m.Spoken_languages, m.Countries = nil, nil
+		}},
+		{name: "release date not a date", change: func(m *models.Movie) { m.Release_date = "10/01/1927" }, wantErr: true},
+		{name: "negative runtime", change: func(m *models.Movie) { m.Runtime = -5 }, wantErr: true},
+		{name: "unknown language", change: func(m *models.Movie) { m.Original_language = "not a language" }, wantErr: true},
+		{name: "unknown spoken language", change: func(m *models.Movie) { m.Spoken_languages = []string{"de", "xx-123456789"} }, wantErr: true},
+		{name: "unknown country", change: func(m *models.Movie) { m.Countries = []string{"Germany"} }, wantErr: true},
+		{name: "blank production company", change: func(m *models.Movie) { m.Production_companies = []string{""} }, wantErr: true},
+	}
+
+	validate := validator.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := valid()
+			tt.change(&movie)
+			err := validate.Struct(movie)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
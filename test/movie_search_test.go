@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"shive/controllers"
+	"shive/helpers"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    []string
+		wantErr error
+	}{
+		{name: "words", query: "blade  runner", want: []string{"blade", "runner"}},
+		{name: "quotes are dropped", query: `"blade runner"`, want: []string{"blade", "runner"}},
+		{name: "quote inside a word", query: `blade"runner`, want: []string{"blade", "runner"}},
+		{name: "leading minus is dropped", query: "--blade -runner", want: []string{"blade", "runner"}},
+		{name: "inner minus is kept", query: "spider-man", want: []string{"spider-man"}},
+		{name: "blank", query: "   ", wantErr: helpers.ErrEmptySearch},
+		{name: "only operators", query: `"-" --`, wantErr: helpers.ErrEmptySearch},
+		{name: "longest query", query: strings.Repeat("a", 200), want: []string{strings.Repeat("a", 200)}},
+		{name: "length counts characters", query: strings.Repeat("é", 200), want: []string{strings.Repeat("é", 200)}},
+		{name: "too long", query: strings.Repeat("a", 201), wantErr: helpers.ErrSearchTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terms, err := helpers.SearchTerms(tt.query)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, terms)
+		})
+	}
+}
+
+func TestSearchStem(t *testing.T) {
+	tests := []struct {
+		term string
+		want string
+	}{
+		{term: "running", want: "run"},
+		{term: "hopping", want: "hop"},
+		{term: "runs", want: "run"},
+		{term: "played", want: "play"},
+		{term: "stories", want: "stor"},
+		{term: "quickly", want: "quick"},
+		{term: "Running!", want: "run"},
+		{term: `"quoted"`, want: "quot"},
+		{term: "Café", want: "café"},
+		// Stems keep at least three letters
+		{term: "sing", want: "sing"},
+		{term: "bus", want: "bus"},
+		{term: "ran", want: "ran"},
+		{term: "", want: ""},
+		{term: "!!!", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.term, func(t *testing.T) {
+			assert.Equal(t, tt.want, helpers.SearchStem(tt.term))
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		stems  []string
+		want   string
+		wantOk bool
+	}{
+		{name: "whole word", text: "The Running Man", stems: []string{"run"}, want: "The <mark>Running</mark> Man", wantOk: true},
+		{name: "every match", text: "run and RUN", stems: []string{"run"}, want: "<mark>run</mark> and <mark>RUN</mark>", wantOk: true},
+		{name: "any stem", text: "blade runner", stems: []string{"run", "blad"}, want: "<mark>blade</mark> <mark>runner</mark>", wantOk: true},
+		{name: "only at the start of words", text: "outrun", stems: []string{"run"}, want: "", wantOk: false},
+		{name: "escapes html", text: "Tom & <Jerry> run", stems: []string{"run"}, want: "Tom &amp; &lt;Jerry&gt; <mark>run</mark>", wantOk: true},
+		{name: "no match", text: "The Matrix", stems: []string{"run"}, want: "", wantOk: false},
+		{name: "empty text", text: "", stems: []string{"run"}, want: "", wantOk: false},
+		{
+			name:   "cut around the match on word boundaries",
+			text:   strings.Repeat("word ", 20) + "target" + strings.Repeat(" word", 40),
+			stems:  []string{"target"},
+			want:   "…" + strings.Repeat("word ", 8) + "<mark>target</mark>" + strings.Repeat(" word", 22) + "…",
+			wantOk: true,
+		},
+		{
+			name:   "match at the start",
+			text:   "target" + strings.Repeat(" word", 40),
+			stems:  []string{"target"},
+			want:   "<mark>target</mark>" + strings.Repeat(" word", 30) + "…",
+			wantOk: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, ok := helpers.Highlight(tt.text, tt.stems)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, text)
+		})
+	}
+}
+
+func TestSearchMovieByQueryPaging(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/movies/search/:movieName", controllers.SearchMovieByQuery())
+
+	// These are refused before the search runs
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "page past what an offset can hold", query: "page=4611686018427387904&recordPerPage=10"},
+		{name: "page past the deepest skip", query: "page=1002&recordPerPage=10"},
+		{name: "start index past the deepest skip", query: "startIndex=10001"},
+		{name: "page and cursor", query: "page=2&after=abc"},
+		{name: "cursor of another list", query: "after=not-a-cursor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest("GET", "/movies/search/heat?"+tt.query, nil))
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+		})
+	}
+}
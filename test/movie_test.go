@@ -0,0 +1,223 @@
+package tests
+
+import (
+	"context"
+	"shive/database"
+	"shive/helpers"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMovieSort(t *testing.T) {
+	tests := []struct {
+		name    string
+		sort    string
+		want    bson.D
+		wantErr error
+	}{
+		{name: "oldest first by default", sort: "", want: bson.D{{Key: "created_at", Value: 1}, {Key: "movie_id", Value: 1}}},
+		{name: "blank", sort: "  ", want: bson.D{{Key: "created_at", Value: 1}, {Key: "movie_id", Value: 1}}},
+		{name: "descending", sort: "-rating", want: bson.D{{Key: "average_rating", Value: -1}, {Key: "movie_id", Value: -1}}},
+		{
+			name: "several fields",
+			sort: "-rating, name",
+			want: bson.D{{Key: "average_rating", Value: -1}, {Key: "name", Value: 1}, {Key: "movie_id", Value: 1}},
+		},
+		{
+			name: "tiebreaker follows the last field",
+			sort: "name,-rating",
+			want: bson.D{{Key: "name", Value: 1}, {Key: "average_rating", Value: -1}, {Key: "movie_id", Value: -1}},
+		},
+		{name: "first of a repeated field wins", sort: "name,-name", want: bson.D{{Key: "name", Value: 1}, {Key: "movie_id", Value: 1}}},
+		{name: "unknown field", sort: "name,budget", wantErr: helpers.ErrUnknownSortField},
+		{name: "stored field names are not sort names", sort: "average_rating", wantErr: helpers.ErrUnknownSortField},
+		{name: "empty field", sort: "name,", wantErr: helpers.ErrUnknownSortField},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sort, err := helpers.MovieSort(tt.sort)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, sort)
+		})
+	}
+}
+
+// Sorts that page by keyset, which an index serves either way round.
+var indexedMovieSorts = []string{
+	"", "name", "-name", "rating", "-rating", "rating_count", "-rating_count", "release_date", "-release_date",
+	"runtime", "-runtime", "created_at", "-created_at", "updated_at", "-updated_at",
+	"-rating,name", "rating,-name", "-release_date,name", "release_date,-name",
+}
+
+func TestMovieSortIndexed(t *testing.T) {
+	for _, sort := range indexedMovieSorts {
+		t.Run("indexed "+sort, func(t *testing.T) {
+			order, err := helpers.MovieSort(sort)
+			assert.NoError(t, err)
+			assert.True(t, helpers.MovieSortIndexed(order))
+		})
+	}
+
+	for _, sort := range []string{"name,-rating", "-rating,-name", "rating,name", "runtime,name", "name,runtime,rating"} {
+		t.Run("not indexed "+sort, func(t *testing.T) {
+			order, err := helpers.MovieSort(sort)
+			assert.NoError(t, err)
+			assert.False(t, helpers.MovieSortIndexed(order))
+		})
+	}
+
+	// A tiebreaker that doesn't follow the sort needs sorting in memory
+	mixed := bson.D{{Key: "average_rating", Value: -1}, {Key: "movie_id", Value: 1}}
+	assert.False(t, helpers.MovieSortIndexed(mixed))
+}
+
+func TestMovieSortPlan(t *testing.T) {
+	requireDatabase(t)
+	database.CreateIndexes()
+
+	movies := database.OpenCollection(database.Client, "movie")
+	for _, sort := range indexedMovieSorts {
+		t.Run(sort, func(t *testing.T) {
+			order, err := helpers.MovieSort(sort)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var explained bson.M
+			err = movies.Database().RunCommand(ctx, bson.D{
+				{Key: "explain", Value: bson.D{
+					{Key: "find", Value: movies.Name()},
+					{Key: "filter", Value: bson.M{}},
+					{Key: "sort", Value: order},
+					{Key: "limit", Value: 21},
+					// Movie listings sort with the collation of their indexes
+					{Key: "collation", Value: bson.M{"locale": "en", "strength": 2}},
+				}},
+				{Key: "verbosity", Value: "queryPlanner"},
+			}).Decode(&explained)
+			assert.NoError(t, err)
+
+			planner, _ := explained["queryPlanner"].(bson.M)
+			stages := planStages(planner["winningPlan"])
+			assert.Contains(t, stages, "IXSCAN")
+			assert.NotContains(t, stages, "SORT")
+		})
+	}
+}
+
+// planStages lists the stages of a query plan and of its inputs.
+func planStages(plan interface{}) []string {
+	var stages []string
+	switch plan := plan.(type) {
+	case bson.M:
+		for key, value := range plan {
+			if key == "stage" {
+				if stage, ok := value.(string); ok {
+					stages = append(stages, stage)
+				}
+				continue
+			}
+			stages = append(stages, planStages(value)...)
+		}
+	case bson.A:
+		for _, value := range plan {
+			stages = append(stages, planStages(value)...)
+		}
+	}
+	return stages
+}
+
+func TestMovieListMatch(t *testing.T) {
+	six, eight := 6.0, 8.0
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		filter  helpers.MovieListFilter
+		want    bson.M
+		wantErr error
+	}{
+		{name: "everything", filter: helpers.MovieListFilter{}, want: bson.M{}},
+		{
+			name:   "any genre",
+			filter: helpers.MovieListFilter{GenreIds: []string{"1", "2"}},
+			want:   bson.M{"genre_ids": bson.M{"$in": []string{"1", "2"}}},
+		},
+		{
+			name:   "all genres",
+			filter: helpers.MovieListFilter{GenreIds: []string{"1", "2"}, GenreMatch: helpers.GenreMatchAll},
+			want:   bson.M{"genre_ids": bson.M{"$all": []string{"1", "2"}}},
+		},
+		{name: "unknown genre match", filter: helpers.MovieListFilter{GenreIds: []string{"1"}, GenreMatch: "some"}, wantErr: helpers.ErrInvalidGenreMatch},
+		{
+			name:   "years",
+			filter: helpers.MovieListFilter{YearFrom: 1970, YearTo: 1989},
+			want:   bson.M{"release_date": bson.M{"$gt": "", "$gte": "1970", "$lte": "1989-12-31"}},
+		},
+		{
+			name:   "single year",
+			filter: helpers.MovieListFilter{YearFrom: 1999, YearTo: 1999},
+			want:   bson.M{"release_date": bson.M{"$gt": "", "$gte": "1999", "$lte": "1999-12-31"}},
+		},
+		{
+			name:   "last year there is",
+			filter: helpers.MovieListFilter{YearTo: 9999},
+			want:   bson.M{"release_date": bson.M{"$gt": "", "$lte": "9999-12-31"}},
+		},
+		{
+			name:   "years before 1000",
+			filter: helpers.MovieListFilter{YearFrom: 1, YearTo: 999},
+			want:   bson.M{"release_date": bson.M{"$gt": "", "$gte": "0001", "$lte": "0999-12-31"}},
+		},
+		{
+			name:   "ratings leave unrated movies out",
+			filter: helpers.MovieListFilter{RatingMin: &six, RatingMax: &eight},
+			want:   bson.M{"average_rating": bson.M{"$gte": 6.0, "$lte": 8.0}, "rating_count": bson.M{"$gt": 0}},
+		},
+		{
+			name:   "languages",
+			filter: helpers.MovieListFilter{Languages: []string{"en", "fr"}},
+			want:   bson.M{"original_language": bson.M{"$in": []string{"en", "fr"}}},
+		},
+		{
+			name:   "created and updated windows",
+			filter: helpers.MovieListFilter{CreatedSince: since, UpdatedUntil: since},
+			want:   bson.M{"created_at": bson.M{"$gte": since}, "updated_at": bson.M{"$lt": since}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := helpers.MovieListMatch(tt.filter)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, match)
+		})
+	}
+}
+
+func TestReviewEditUpdate(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	text, rating := "Better the second time", 9
+
+	tests := []struct {
+		name   string
+		review *string
+		rating *int
+		want   bson.M
+	}{
+		{name: "text keeps the rating", review: &text, want: bson.M{"$set": bson.M{"review": text, "updated_at": now}}},
+		{name: "rating keeps the text", rating: &rating, want: bson.M{"$set": bson.M{"rating": rating, "updated_at": now}}},
+		{name: "both", review: &text, rating: &rating, want: bson.M{"$set": bson.M{"review": text, "rating": rating, "updated_at": now}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, helpers.ReviewEditUpdate(tt.review, tt.rating, now))
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package tests
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"shive/oidc"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockIssuer is a minimal OpenID provider that hands out ID tokens for codes
+// issued through authorize.
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+	// claims are added to every ID token and override the defaults
+	claims jwt.MapClaims
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &mockIssuer{key: key, kid: "mock-key", codes: map[string]url.Values{}, claims: jwt.MapClaims{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.server.URL,
+			"authorization_endpoint": issuer.server.URL + "/authorize",
+			"token_endpoint":         issuer.server.URL + "/token",
+			"jwks_uri":               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": issuer.kid,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", issuer.token)
+
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// authorize plays the part of the user signing in and returns the code the
+// provider would send to the redirect URL.
+func (m *mockIssuer) authorize(t *testing.T, authURL string) string {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := oidc.RandomString(16)
+	m.mu.Lock()
+	m.codes[code] = parsed.Query()
+	m.mu.Unlock()
+	return code
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	request, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	m.mu.Unlock()
+
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	if !ok || r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != request.Get("redirect_uri") {
+		fail("invalid_grant")
+		return
+	}
+	if oidc.PKCEChallenge(r.FormValue("code_verifier")) != request.Get("code_challenge") {
+		fail("invalid_grant")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"id_token":     m.signIDToken(request.Get("client_id"), request.Get("nonce")),
+	})
+}
+
+func (m *mockIssuer) signIDToken(clientID string, nonce string) string {
+	claims := jwt.MapClaims{
+		"iss":                m.server.URL,
+		"sub":                "mock-subject-1",
+		"aud":                clientID,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+		"nonce":              nonce,
+		"email":              "sso.user@example.com",
+		"email_verified":     true,
+		"name":               "SSO User",
+		"preferred_username": "sso.user",
+		"groups":             []string{"staff", "shive-admins"},
+	}
+	m.mu.Lock()
+	for name, value := range m.claims {
+		claims[name] = value
+	}
+	m.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	signed, _ := token.SignedString(m.key)
+	return signed
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	ctx := context.Background()
+
+	config := oidc.Config{
+		Issuer:      issuer.server.URL,
+		ClientID:    "shive",
+		RedirectURL: "http://localhost:8000/users/oidc/callback",
+	}
+
+	provider, err := oidc.NewProvider(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startLogin := func(t *testing.T) (code string, verifier string, nonce string) {
+		verifier, challenge, err := oidc.NewPKCE()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, _ = oidc.RandomString(16)
+
+		authURL := provider.AuthCodeURL("state-1", nonce, challenge)
+		query, _ := url.Parse(authURL)
+		assert.Equal(t, "S256", query.Query().Get("code_challenge_method"))
+		assert.Equal(t, "openid email profile", query.Query().Get("scope"))
+		assert.Equal(t, "state-1", query.Query().Get("state"))
+
+		return issuer.authorize(t, authURL), verifier, nonce
+	}
+
+	t.Run("Authorization Code With PKCE", func(t *testing.T) {
+		code, verifier, nonce := startLogin(t)
+
+		identity, err := provider.Login(ctx, code, verifier, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, "mock-subject-1", identity.Subject)
+		assert.Equal(t, issuer.server.URL, identity.Issuer)
+		assert.Equal(t, "sso.user@example.com", identity.Email)
+		assert.True(t, identity.EmailVerified)
+		assert.Equal(t, "sso.user", identity.PreferredUsername)
+		assert.Equal(t, []string{"staff", "shive-admins"}, identity.Groups)
+	})
+
+	t.Run("Codes Can Not Be Redeemed Twice", func(t *testing.T) {
+		code, verifier, nonce := startLogin(t)
+
+		_, err := provider.Login(ctx, code, verifier, nonce)
+		assert.NoError(t, err)
+
+		_, err = provider.Login(ctx, code, verifier, nonce)
+		assert.Error(t, err)
+	})
+
+	t.Run("Wrong Code Verifier", func(t *testing.T) {
+		code, _, nonce := startLogin(t)
+		otherVerifier, _, _ := oidc.NewPKCE()
+
+		_, err := provider.Login(ctx, code, otherVerifier, nonce)
+		assert.Error(t, err)
+	})
+
+	t.Run("Wrong Nonce", func(t *testing.T) {
+		code, verifier, _ := startLogin(t)
+
+		_, err := provider.Login(ctx, code, verifier, "another-login")
+		assert.True(t, errors.Is(err, oidc.ErrNonceMismatch))
+	})
+
+	t.Run("Rejected ID Tokens", func(t *testing.T) {
+		cases := map[string]jwt.MapClaims{
+			"wrong audience": {"aud": "another-client"},
+			"wrong issuer":   {"iss": "https://evil.example.com"},
+			"expired":        {"exp": time.Now().Add(-time.Minute).Unix()},
+			"no subject":     {"sub": ""},
+		}
+
+		for name, claims := range cases {
+			t.Run(name, func(t *testing.T) {
+				issuer.mu.Lock()
+				issuer.claims = claims
+				issuer.mu.Unlock()
+				defer func() {
+					issuer.mu.Lock()
+					issuer.claims = jwt.MapClaims{}
+					issuer.mu.Unlock()
+				}()
+
+				code, verifier, nonce := startLogin(t)
+				_, err := provider.Login(ctx, code, verifier, nonce)
+				assert.True(t, errors.Is(err, oidc.ErrInvalidIDToken), "got %v", err)
+			})
+		}
+	})
+
+	t.Run("Forged Signature", func(t *testing.T) {
+		forger, _ := rsa.GenerateKey(rand.Reader, 2048)
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss": issuer.server.URL,
+			"sub": "mock-subject-1",
+			"aud": "shive",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		})
+		token.Header["kid"] = issuer.kid
+		signed, _ := token.SignedString(forger)
+
+		_, err := provider.VerifyIDToken(ctx, signed, "")
+		assert.True(t, errors.Is(err, oidc.ErrInvalidIDToken))
+	})
+
+	t.Run("Issuer Mismatch", func(t *testing.T) {
+		mismatched := config
+		mismatched.Issuer = issuer.server.URL + "/"
+
+		_, err := oidc.NewProvider(ctx, mismatched)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"encoding/base64"
+	"shive/helpers"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ratingSort = bson.D{{Key: "average_rating", Value: -1}, {Key: "movie_id", Value: 1}}
+
+func TestCursorRoundTrip(t *testing.T) {
+	created := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	id := primitive.NewObjectID()
+
+	tests := []struct {
+		name string
+		sort bson.D
+		last bson.M
+		want []interface{}
+	}{
+		{name: "string and double", sort: ratingSort, last: bson.M{"average_rating": 8.5, "movie_id": "m1"}, want: []interface{}{8.5, "m1"}},
+		{name: "integers", sort: bson.D{{Key: "runtime", Value: 1}, {Key: "rating_count", Value: 1}}, last: bson.M{"runtime": int32(90), "rating_count": int64(3)}, want: []interface{}{int32(90), int64(3)}},
+		{name: "date and object id", sort: bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}, last: bson.M{"created_at": created, "_id": id}, want: []interface{}{primitive.NewDateTimeFromTime(created), id}},
+		{name: "missing field is null", sort: ratingSort, last: bson.M{"movie_id": "m1"}, want: []interface{}{nil, "m1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			last, err := bson.Marshal(tt.last)
+			assert.NoError(t, err)
+
+			cursor, err := helpers.EncodeCursor(tt.sort, last)
+			assert.NoError(t, err)
+
+			values, err := helpers.DecodeCursor(cursor, tt.sort)
+			assert.NoError(t, err)
+
+			got := make([]interface{}, len(values))
+			for i, value := range values {
+				assert.NoError(t, value.Unmarshal(&got[i]))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	craft := func(doc bson.M) string {
+		raw, err := bson.Marshal(doc)
+		assert.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+
+	last, _ := bson.Marshal(bson.M{"average_rating": 8.5, "movie_id": "m1"})
+	valid, err := helpers.EncodeCursor(ratingSort, last)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		cursor string
+		sort   bson.D
+	}{
+		{name: "not base64", cursor: "not a cursor!", sort: ratingSort},
+		{name: "not bson", cursor: base64.RawURLEncoding.EncodeToString([]byte("hello")), sort: ratingSort},
+		{name: "made for another sort", cursor: valid, sort: bson.D{{Key: "name", Value: 1}, {Key: "movie_id", Value: 1}}},
+		{name: "made for another direction", cursor: valid, sort: bson.D{{Key: "average_rating", Value: 1}, {Key: "movie_id", Value: 1}}},
+		{name: "too few values", cursor: craft(bson.M{"s": "average_rating:-1,movie_id:1", "v": bson.A{8.5}}), sort: ratingSort},
+		{name: "query operator", cursor: craft(bson.M{"s": "average_rating:-1,movie_id:1", "v": bson.A{bson.M{"$gt": 0}, "m1"}}), sort: ratingSort},
+		{name: "array", cursor: craft(bson.M{"s": "average_rating:-1,movie_id:1", "v": bson.A{8.5, bson.A{"m1"}}}), sort: ratingSort},
+		{name: "regex", cursor: craft(bson.M{"s": "average_rating:-1,movie_id:1", "v": bson.A{8.5, primitive.Regex{Pattern: ".*"}}}), sort: ratingSort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := helpers.DecodeCursor(tt.cursor, tt.sort)
+			assert.ErrorIs(t, err, helpers.ErrInvalidCursor)
+			assert.Nil(t, values)
+		})
+	}
+}
+
+func TestOffsetCursor(t *testing.T) {
+	nameSort := bson.D{{Key: "name", Value: 1}, {Key: "average_rating", Value: -1}, {Key: "movie_id", Value: -1}}
+
+	cursor, err := helpers.EncodeOffsetCursor(nameSort, 40)
+	assert.NoError(t, err)
+	offset, err := helpers.DecodeOffsetCursor(cursor, nameSort)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(40), offset)
+
+	// Neither kind of cursor passes for the other
+	_, err = helpers.DecodeCursor(cursor, nameSort)
+	assert.ErrorIs(t, err, helpers.ErrInvalidCursor)
+
+	last, _ := bson.Marshal(bson.M{"average_rating": 8.5, "movie_id": "m1"})
+	keyset, err := helpers.EncodeCursor(ratingSort, last)
+	assert.NoError(t, err)
+	_, err = helpers.DecodeOffsetCursor(keyset, ratingSort)
+	assert.ErrorIs(t, err, helpers.ErrInvalidCursor)
+
+	_, err = helpers.DecodeOffsetCursor(cursor, ratingSort)
+	assert.ErrorIs(t, err, helpers.ErrInvalidCursor)
+
+	raw, _ := bson.Marshal(bson.M{"s": "average_rating:-1,movie_id:1", "o": int64(-20)})
+	_, err = helpers.DecodeOffsetCursor(base64.RawURLEncoding.EncodeToString(raw), ratingSort)
+	assert.ErrorIs(t, err, helpers.ErrInvalidCursor)
+}
+
+func TestKeysetFilter(t *testing.T) {
+	rating := bson.RawValue{Type: bson.TypeDouble, Value: bsonValue(t, 8.5)}
+	movie := bson.RawValue{Type: bson.TypeString, Value: bsonValue(t, "m1")}
+
+	// After the last item: a lower rating, or the same rating and a later movie_id
+	want := bson.M{"$or": bson.A{
+		bson.M{"average_rating": bson.M{"$lt": rating}},
+		bson.M{"average_rating": rating, "movie_id": bson.M{"$gt": movie}},
+	}}
+	assert.Equal(t, want, helpers.KeysetFilter(ratingSort, []bson.RawValue{rating, movie}))
+}
+
+func bsonValue(t *testing.T, value interface{}) []byte {
+	_, raw, err := bson.MarshalValue(value)
+	assert.NoError(t, err)
+	return raw
+}
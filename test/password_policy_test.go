@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"shive/helpers"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordClasses(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"lowercase", 1},
+		{"UPPERCASE", 1},
+		{"12345678", 1},
+		{"!@#$%^&*", 1},
+		{"lower123", 2},
+		{"Lower123", 3},
+		{"Lower 123", 4},
+		{"Lower-123", 4},
+		{"ÉcoleÜber", 2},
+		{"пароль12", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			assert.Equal(t, tt.want, helpers.PasswordClasses(tt.password))
+		})
+	}
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	minLength, minClasses := helpers.PASSWORD_MIN_LENGTH, helpers.PASSWORD_MIN_CLASSES
+	helpers.PASSWORD_MIN_LENGTH, helpers.PASSWORD_MIN_CLASSES = 8, 2
+	t.Cleanup(func() { helpers.PASSWORD_MIN_LENGTH, helpers.PASSWORD_MIN_CLASSES = minLength, minClasses })
+
+	tests := []struct {
+		name     string
+		password string
+		email    string
+		username string
+		problems []string
+	}{
+		{name: "acceptable", password: "tangerine-Orbit7", email: "jane@example.com", username: "janedoe"},
+		{name: "too short", password: "Ab1!xyz", email: "jane@example.com", username: "janedoe", problems: []string{"at least 8 characters"}},
+		{name: "length counts characters", password: "ééééééé1", email: "jane@example.com", username: "janedoe"},
+		{name: "over 72 bytes", password: strings.Repeat("a1", 37), email: "jane@example.com", username: "janedoe", problems: []string{"at most 72 bytes"}},
+		{name: "one class", password: "tangerineorbit", email: "jane@example.com", username: "janedoe", problems: []string{"must mix"}},
+		{name: "contains the username", password: "Janedoe-2024", email: "jane@example.com", username: "janedoe", problems: []string{"email or username"}},
+		{name: "contains the email local part", password: "xJANE2024x", email: "Jane@example.com", username: "someone", problems: []string{"email or username"}},
+		{name: "short personal parts are ignored", password: "jo-Tangerine7", email: "jo@example.com", username: "jo", problems: nil},
+		{name: "breached", password: "Password1", email: "jane@example.com", username: "janedoe", problems: []string{"too common"}},
+		{name: "several problems", password: "abc", email: "jane@example.com", username: "janedoe", problems: []string{"at least 8 characters", "must mix"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := helpers.CheckPasswordPolicy(tt.password, tt.email, tt.username)
+			if len(tt.problems) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			var policyErr *helpers.PasswordPolicyError
+			if assert.ErrorAs(t, err, &policyErr) {
+				assert.Len(t, policyErr.Problems, len(tt.problems))
+				for _, problem := range tt.problems {
+					assert.Contains(t, err.Error(), problem)
+				}
+			}
+		})
+	}
+}
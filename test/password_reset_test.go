@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"shive/database"
+	"shive/helpers"
+	"shive/routes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPasswordResetToken(t *testing.T) {
+	user := insertTestUser(t, "USER")
+	ip := "reset-" + user.User_id
+
+	token, err := helpers.CreatePasswordResetToken(user.User_id, ip)
+	assert.NoError(t, err)
+
+	// Looking a token up leaves it usable
+	userId, err := helpers.LookupPasswordResetToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, user.User_id, userId)
+
+	userId, err = helpers.RedeemPasswordResetToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, user.User_id, userId)
+
+	// Tokens are single use
+	_, err = helpers.RedeemPasswordResetToken(token)
+	assert.ErrorIs(t, err, helpers.ErrInvalidResetToken)
+	_, err = helpers.LookupPasswordResetToken(token)
+	assert.ErrorIs(t, err, helpers.ErrInvalidResetToken)
+
+	_, err = helpers.RedeemPasswordResetToken("not a token")
+	assert.ErrorIs(t, err, helpers.ErrInvalidResetToken)
+}
+
+func TestPasswordResetTokenReplaced(t *testing.T) {
+	user := insertTestUser(t, "USER")
+	ip := "reset-" + user.User_id
+
+	first, err := helpers.CreatePasswordResetToken(user.User_id, ip)
+	assert.NoError(t, err)
+	second, err := helpers.CreatePasswordResetToken(user.User_id, ip)
+	assert.NoError(t, err)
+
+	// Only the newest link works
+	_, err = helpers.RedeemPasswordResetToken(first)
+	assert.ErrorIs(t, err, helpers.ErrInvalidResetToken)
+	_, err = helpers.RedeemPasswordResetToken(second)
+	assert.NoError(t, err)
+}
+
+func TestPasswordResetTokenExpires(t *testing.T) {
+	ttl := helpers.PASSWORD_RESET_TTL
+	helpers.PASSWORD_RESET_TTL = -time.Second
+	t.Cleanup(func() { helpers.PASSWORD_RESET_TTL = ttl })
+
+	user := insertTestUser(t, "USER")
+	token, err := helpers.CreatePasswordResetToken(user.User_id, "reset-"+user.User_id)
+	assert.NoError(t, err)
+
+	_, err = helpers.RedeemPasswordResetToken(token)
+	assert.ErrorIs(t, err, helpers.ErrInvalidResetToken)
+}
+
+func TestPasswordResetRetryAfter(t *testing.T) {
+	user := insertTestUser(t, "USER")
+	ip := "reset-" + user.User_id
+
+	wait, err := helpers.PasswordResetRetryAfter(user.User_id, ip)
+	assert.NoError(t, err)
+	assert.Zero(t, wait, "The first reset email should go out right away")
+
+	_, err = helpers.CreatePasswordResetToken(user.User_id, ip)
+	assert.NoError(t, err)
+
+	wait, err = helpers.PasswordResetRetryAfter(user.User_id, ip)
+	assert.NoError(t, err)
+	assert.Greater(t, wait, time.Duration(0), "Another email to the account should wait")
+
+	// Other accounts asked for from the same IP only count towards its hourly limit
+	other := insertTestUser(t, "USER")
+	wait, err = helpers.PasswordResetRetryAfter(other.User_id, ip)
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestPasswordResetRetryAfterExpiredResets(t *testing.T) {
+	ttl := helpers.PASSWORD_RESET_TTL
+	helpers.PASSWORD_RESET_TTL = -time.Second
+	t.Cleanup(func() { helpers.PASSWORD_RESET_TTL = ttl })
+
+	user := insertTestUser(t, "USER")
+	ip := "reset-" + user.User_id
+	for i := 0; i < 20; i++ {
+		_, err := helpers.CreatePasswordResetToken(user.User_id, ip)
+		assert.NoError(t, err)
+	}
+
+	// The resets are past their TTL and purged, the hour they count towards is not over
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := database.OpenCollection(database.Client, "password_reset").DeleteMany(ctx, bson.M{"user_id": user.User_id})
+	assert.NoError(t, err)
+
+	wait, err := helpers.PasswordResetRetryAfter(user.User_id, ip)
+	assert.NoError(t, err)
+	assert.Greater(t, wait, 55*time.Minute, "The account's hourly limit should still hold")
+
+	other := insertTestUser(t, "USER")
+	wait, err = helpers.PasswordResetRetryAfter(other.User_id, ip)
+	assert.NoError(t, err)
+	assert.Greater(t, wait, 55*time.Minute, "The IP's hourly limit should still hold")
+}
+
+func TestForgotPasswordIgnoresEmailCase(t *testing.T) {
+	mailer := withRecordedMail(t)
+	user := insertTestUser(t, "USER")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	routes.AuthRoutes(router)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// httptest requests come from 192.0.2.1, which the IP throttle counts
+		database.OpenCollection(database.Client, "email_send").DeleteMany(ctx, bson.M{"key": "192.0.2.1"})
+	})
+
+	// Signup treats addresses that only differ in case as the same one
+	resp := serveJSON(t, router, "POST", "/users/forgot-password", "", map[string]string{"email": strings.ToUpper(*user.Email)})
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	assert.NotEmpty(t, mailedToken(t, mailer, *user.Email), "The account should get a reset link")
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"shive/helpers"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// authorizeContext is the context of a request from a caller with role.
+func authorizeContext(uid string, role string, mfa bool) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/movies", nil)
+	c.Set("uid", uid)
+	c.Set("user_type", role)
+	c.Set("mfa", mfa)
+	return c
+}
+
+// testRoleName is a custom role name no other test uses.
+func testRoleName() string {
+	return "TEST_" + strings.ToUpper(primitive.NewObjectID().Hex())
+}
+
+func TestSeedRolePolicies(t *testing.T) {
+	requireDatabase(t)
+
+	// Seeding is safe to repeat on every start
+	assert.NoError(t, helpers.SeedRolePolicies())
+	assert.NoError(t, helpers.SeedRolePolicies())
+
+	policies, err := helpers.ListRolePolicies()
+	assert.NoError(t, err)
+
+	seeded := map[string]bool{}
+	for _, policy := range policies {
+		if policy.Built_in {
+			seeded[policy.Role] = true
+		}
+	}
+	for _, role := range []string{"ADMIN", "USER", "MODERATOR", "CURATOR"} {
+		assert.True(t, seeded[role], "%s should be a built-in role", role)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	requireDatabase(t)
+	assert.NoError(t, helpers.SeedRolePolicies())
+
+	requireMfa := helpers.REQUIRE_ADMIN_2FA
+	helpers.REQUIRE_ADMIN_2FA = true
+	t.Cleanup(func() { helpers.REQUIRE_ADMIN_2FA = requireMfa })
+
+	tests := []struct {
+		name        string
+		role        string
+		mfa         bool
+		permissions []string
+		wantStatus  int
+	}{
+		{name: "granted", role: "USER", permissions: []string{helpers.PermReviewCreate}},
+		{name: "any of several", role: "USER", permissions: []string{helpers.PermReviewModerate, helpers.PermReviewDelete}},
+		{name: "every permission", role: "ADMIN", mfa: true, permissions: []string{helpers.PermAuditRead}},
+		{name: "lacking", role: "USER", permissions: []string{helpers.PermMovieCreate}, wantStatus: http.StatusForbidden},
+		{name: "unknown role", role: "NOBODY", permissions: []string{helpers.PermReviewCreate}, wantStatus: http.StatusForbidden},
+		{name: "admin without a second factor", role: "ADMIN", permissions: []string{helpers.PermAuditRead}, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid := primitive.NewObjectID().Hex()
+			err := helpers.Authorize(authorizeContext(uid, tt.role, tt.mfa), tt.permissions...)
+			if tt.wantStatus == 0 {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, tt.wantStatus, helpers.AuthorizeStatus(err))
+			}
+
+			// Every decision is logged
+			decisions, err := helpers.ListPermissionDecisions(helpers.PermissionDecisionFilter{Uid: uid, Limit: 10})
+			assert.NoError(t, err)
+			if assert.Len(t, decisions, 1) {
+				assert.Equal(t, tt.wantStatus == 0, decisions[0].Allowed)
+				assert.Equal(t, tt.permissions, decisions[0].Permissions)
+			}
+		})
+	}
+}
+
+func TestSaveRolePolicy(t *testing.T) {
+	requireDatabase(t)
+	assert.NoError(t, helpers.SeedRolePolicies())
+
+	role := testRoleName()
+	t.Cleanup(func() { helpers.DeleteRolePolicy(role) })
+
+	policy, created, err := helpers.SaveRolePolicy(role, "Test role", []string{helpers.PermMovieCreate}, "tester", "ADMIN")
+	if assert.NoError(t, err) {
+		assert.True(t, created)
+		assert.False(t, policy.Built_in)
+	}
+
+	// The new role applies right away
+	assert.NoError(t, helpers.Authorize(authorizeContext("tester", role, false), helpers.PermMovieCreate))
+
+	// Nobody grants what they don't have, or edits a role above their own
+	_, _, err = helpers.SaveRolePolicy(role, "Test role", []string{helpers.PermMovieCreate, helpers.PermUserRole}, "tester", "CURATOR")
+	assert.ErrorIs(t, err, helpers.ErrOutranked)
+	_, _, err = helpers.SaveRolePolicy("ADMIN", "Admins", []string{helpers.PermPolicyManage}, "tester", "CURATOR")
+	assert.ErrorIs(t, err, helpers.ErrOutranked)
+
+	_, _, err = helpers.SaveRolePolicy(role, "Test role", []string{"movie:launch"}, "tester", "ADMIN")
+	assert.ErrorIs(t, err, helpers.ErrUnknownPermission)
+	_, _, err = helpers.SaveRolePolicy("ADMIN", "Admins", []string{helpers.PermMovieCreate}, "tester", "ADMIN")
+	assert.ErrorIs(t, err, helpers.ErrPolicyLockout)
+
+	policy, created, err = helpers.SaveRolePolicy(role, "Edited", []string{helpers.PermMovieUpdate}, "tester", "CURATOR")
+	if assert.NoError(t, err) {
+		assert.False(t, created)
+		assert.Equal(t, []string{helpers.PermMovieUpdate}, policy.Permissions)
+	}
+
+	assert.ErrorIs(t, helpers.DeleteRolePolicy("USER"), helpers.ErrBuiltInRole)
+	assert.NoError(t, helpers.DeleteRolePolicy(role))
+	assert.ErrorIs(t, helpers.DeleteRolePolicy(role), helpers.ErrUnknownRole)
+}
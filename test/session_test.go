@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"shive/helpers"
+	"shive/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var testClient = helpers.SessionClient{User_agent: "test", Ip: "127.0.0.1"}
+
+// signInTestUser issues and registers a token pair for user from client, as
+// logging in does.
+func signInTestUser(t *testing.T, user *models.User, client helpers.SessionClient) (*helpers.JwtSignedDetails, string, string) {
+	t.Helper()
+
+	token, refreshToken, err := helpers.GenerateAllTokens(*user.Email, *user.Name, *user.Username, *user.User_type, user.User_id, user.Token_version, false)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = helpers.UpdateTokens(token, refreshToken, user.User_id, client)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	claims, _ := helpers.ValidateToken(token)
+	return claims, token, refreshToken
+}
+
+func TestRevokeSession(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	user := insertTestUser(t, "USER")
+	laptop := helpers.SessionClient{User_agent: "laptop", Ip: "10.0.0.1"}
+	phone := helpers.SessionClient{User_agent: "phone", Ip: "10.0.0.2"}
+
+	laptopClaims, laptopToken, laptopRefresh := signInTestUser(t, &user, laptop)
+	phoneClaims, _, phoneRefresh := signInTestUser(t, &user, phone)
+
+	sessions, err := helpers.ListSessions(user.User_id)
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 2) {
+		// Most recently used first
+		assert.Equal(t, phoneClaims.Family_id, sessions[0].Session_id)
+		assert.Equal(t, "phone", sessions[0].User_agent)
+		assert.Equal(t, laptopClaims.Family_id, sessions[1].Session_id)
+	}
+
+	// Sessions of other users can't be revoked
+	other := insertTestUser(t, "USER")
+	assert.ErrorIs(t, helpers.RevokeSession(other.User_id, laptopClaims.Family_id), mongo.ErrNoDocuments)
+
+	assert.NoError(t, helpers.RevokeSession(user.User_id, laptopClaims.Family_id))
+	assert.ErrorIs(t, helpers.RevokeSession(user.User_id, laptopClaims.Family_id), mongo.ErrNoDocuments, "A session can only be revoked once")
+
+	// The revoked device is signed out, the other one isn't
+	assert.ErrorIs(t, helpers.TouchSession(laptopClaims.Family_id, laptop), helpers.ErrTokenRevoked)
+	assert.NoError(t, helpers.TouchSession(phoneClaims.Family_id, phone))
+
+	_, _, err = helpers.RotateRefreshToken(laptopRefresh, laptop)
+	assert.ErrorIs(t, err, helpers.ErrInvalidRefreshToken)
+	_, _, err = helpers.RotateRefreshToken(phoneRefresh, phone)
+	assert.NoError(t, err)
+
+	sessions, err = helpers.ListSessions(user.User_id)
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, phoneClaims.Family_id, sessions[0].Session_id, "Refreshing should keep the session")
+	}
+
+	req := httptest.NewRequest("GET", "/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+laptopToken)
+	resp := httptest.NewRecorder()
+	whoAmI().ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code, "Access tokens of a revoked session should stop working")
+}
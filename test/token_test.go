@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"shive/helpers"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateAllTokens(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+
+	token, refreshToken, err := helpers.GenerateAllTokens("ada@example.com", "Ada", "ada", "USER", "u1", 3, true)
+	assert.NoError(t, err)
+
+	claims, msg := helpers.ValidateToken(token)
+	if assert.NotNil(t, claims, msg) {
+		assert.Equal(t, "u1", claims.Uid)
+		assert.Equal(t, "USER", claims.User_type)
+		assert.Equal(t, helpers.AccessTokenType, claims.Token_type)
+		assert.Equal(t, 3, claims.Token_version)
+		assert.True(t, claims.Mfa)
+	}
+
+	refreshClaims, msg := helpers.ValidateToken(refreshToken)
+	if assert.NotNil(t, refreshClaims, msg) {
+		assert.Equal(t, helpers.RefreshTokenType, refreshClaims.Token_type)
+		assert.Equal(t, claims.Family_id, refreshClaims.Family_id, "Both tokens should start the same family")
+		assert.Empty(t, refreshClaims.User_type, "Refresh tokens should not carry a role")
+	}
+}
+
+func TestGenerateAllTokensWithoutKey(t *testing.T) {
+	withSecretKey(t, "")
+
+	// Signing fails with an error the handlers answer with a 500, rather than a panic
+	token, refreshToken, err := helpers.GenerateAllTokens("ada@example.com", "Ada", "ada", "USER", "u1", 0, false)
+	assert.ErrorIs(t, err, helpers.ErrNoSecretKey)
+	assert.Empty(t, token)
+	assert.Empty(t, refreshToken)
+}
+
+func TestRevokeToken(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	user := insertTestUser(t, "USER")
+	client := helpers.SessionClient{User_agent: "test", Ip: "127.0.0.1"}
+
+	token, refreshToken, err := helpers.GenerateAllTokens(*user.Email, *user.Name, *user.Username, "USER", user.User_id, 0, false)
+	assert.NoError(t, err)
+	_, err = helpers.UpdateTokens(token, refreshToken, user.User_id, client)
+	assert.NoError(t, err)
+
+	claims, _ := helpers.ValidateToken(token)
+	_, err = helpers.CheckTokenRevocation(claims)
+	assert.NoError(t, err, "A fresh token should be accepted")
+
+	// Logging out revokes the access token and the refresh token issued with it
+	assert.NoError(t, helpers.RevokeToken(claims.Id, claims.Family_id, user.User_id, claims.ExpiresAt))
+	_, err = helpers.CheckTokenRevocation(claims)
+	assert.ErrorIs(t, err, helpers.ErrTokenRevoked)
+
+	_, _, err = helpers.RotateRefreshToken(refreshToken, client)
+	assert.ErrorIs(t, err, helpers.ErrInvalidRefreshToken)
+}
+
+func TestRevokeAllUserTokens(t *testing.T) {
+	withSecretKey(t, "test-secret-key")
+	user := insertTestUser(t, "USER")
+	client := helpers.SessionClient{User_agent: "test", Ip: "127.0.0.1"}
+
+	token, refreshToken, err := helpers.GenerateAllTokens(*user.Email, *user.Name, *user.Username, "USER", user.User_id, 0, false)
+	assert.NoError(t, err)
+	_, err = helpers.UpdateTokens(token, refreshToken, user.User_id, client)
+	assert.NoError(t, err)
+
+	assert.NoError(t, helpers.RevokeAllUserTokens(user.User_id))
+
+	// Tokens of the previous version stop working everywhere
+	claims, _ := helpers.ValidateToken(token)
+	_, err = helpers.CheckTokenRevocation(claims)
+	assert.ErrorIs(t, err, helpers.ErrTokenRevoked)
+
+	_, _, err = helpers.RotateRefreshToken(refreshToken, client)
+	assert.ErrorIs(t, err, helpers.ErrInvalidRefreshToken)
+
+	// New logins carry the new version
+	assert.Equal(t, 1, findTestUser(t, user.User_id).Token_version)
+}
@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"shive/helpers"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The SHA1 secret of the RFC 6238 test vectors
+var rfc6238Key = []byte("12345678901234567890")
+
+func TestTotpCode(t *testing.T) {
+	// RFC 6238 appendix B, cut to the last 6 digits the API uses
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		t.Run(time.Unix(tt.unix, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			assert.Equal(t, tt.want, helpers.TotpCode(rfc6238Key, time.Unix(tt.unix, 0)))
+		})
+	}
+}
+
+func TestMatchTotpCode(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / 30
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOk   bool
+	}{
+		{name: "current code", code: "050471", wantStep: step, wantOk: true},
+		{name: "with spaces", code: "050 471", wantStep: step, wantOk: true},
+		{name: "previous period", code: helpers.TotpCode(rfc6238Key, now.Add(-30*time.Second)), wantStep: step - 1, wantOk: true},
+		{name: "next period", code: helpers.TotpCode(rfc6238Key, now.Add(30*time.Second)), wantStep: step + 1, wantOk: true},
+		{name: "two periods ago", code: helpers.TotpCode(rfc6238Key, now.Add(-60*time.Second))},
+		{name: "two periods ahead", code: helpers.TotpCode(rfc6238Key, now.Add(60*time.Second))},
+		{name: "already used", code: "050471", lastStep: step},
+		{name: "newer code after an older one was used", code: "050471", lastStep: step - 1, wantStep: step, wantOk: true},
+		{name: "wrong code", code: "000000"},
+		{name: "too short", code: "50471"},
+		{name: "8 digits", code: "14050471"},
+		{name: "empty", code: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := helpers.MatchTotpCode(rfc6238Key, tt.code, tt.lastStep, now)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.wantStep, gotStep)
+		})
+	}
+}
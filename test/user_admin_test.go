@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"shive/helpers"
+	"shive/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAccountRestriction(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+
+	tests := []struct {
+		name string
+		user models.User
+		want error
+	}{
+		{name: "active", user: models.User{}},
+		{name: "suspended", user: models.User{Suspended_until: &later}, want: helpers.ErrAccountSuspended},
+		{name: "suspension ends at its time", user: models.User{Suspended_until: &now}},
+		{name: "suspension over", user: models.User{Suspended_until: &earlier}},
+		{name: "banned", user: models.User{Banned: true}, want: helpers.ErrAccountBanned},
+		{name: "ban outweighs a suspension", user: models.User{Banned: true, Suspended_until: &later}, want: helpers.ErrAccountBanned},
+		{name: "ban outlives an old suspension", user: models.User{Banned: true, Suspended_until: &earlier}, want: helpers.ErrAccountBanned},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, helpers.AccountRestriction(&tt.user, now))
+		})
+	}
+}
+
+func TestPermissionsCover(t *testing.T) {
+	moderator := []string{helpers.PermReviewModerate, helpers.PermUserRead, helpers.PermUserSuspend}
+
+	tests := []struct {
+		name    string
+		granted []string
+		wanted  []string
+		want    bool
+	}{
+		{name: "nothing wanted", granted: nil, wanted: nil, want: true},
+		{name: "same permissions", granted: moderator, wanted: moderator, want: true},
+		{name: "fewer permissions", granted: moderator, wanted: []string{helpers.PermUserRead}, want: true},
+		{name: "missing a permission", granted: moderator, wanted: []string{helpers.PermUserRead, helpers.PermUserRole}, want: false},
+		{name: "every permission covers the rest", granted: []string{helpers.PermAll}, wanted: moderator, want: true},
+		{name: "every permission covers itself", granted: []string{helpers.PermAll}, wanted: []string{helpers.PermAll}, want: true},
+		{name: "only every permission covers it", granted: moderator, wanted: []string{helpers.PermAll}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, helpers.PermissionsCover(tt.granted, tt.wanted))
+		})
+	}
+}
+
+func TestOidcSyncedRole(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     string
+		groupsRole  string
+		want        string
+		wantChanged bool
+	}{
+		{name: "joins the admin groups", current: "USER", groupsRole: "ADMIN", want: "ADMIN", wantChanged: true},
+		{name: "leaves the admin groups", current: "ADMIN", groupsRole: "USER", want: "USER", wantChanged: true},
+		{name: "stays an admin", current: "ADMIN", groupsRole: "ADMIN", want: "ADMIN"},
+		{name: "stays a user", current: "USER", groupsRole: "USER", want: "USER"},
+		{name: "no role yet", current: "", groupsRole: "USER", want: "USER", wantChanged: true},
+		{name: "custom role is kept", current: "MODERATOR", groupsRole: "USER", want: "MODERATOR"},
+		{name: "custom role is kept in the admin groups", current: "CURATOR", groupsRole: "ADMIN", want: "CURATOR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, changed := helpers.OidcSyncedRole(tt.current, tt.groupsRole)
+			assert.Equal(t, tt.want, role)
+			assert.Equal(t, tt.wantChanged, changed)
+		})
+	}
+}
+
+func TestRoleCovers(t *testing.T) {
+	policies := map[string]models.RolePolicy{
+		"ADMIN":     {Role: "ADMIN", Permissions: []string{helpers.PermAll}},
+		"MODERATOR": {Role: "MODERATOR", Permissions: []string{helpers.PermReviewModerate, helpers.PermUserRead, helpers.PermUserSuspend}},
+		"USER":      {Role: "USER", Permissions: []string{helpers.PermReviewCreate}},
+		"SUPPORT":   {Role: "SUPPORT", Permissions: []string{helpers.PermUserRead}},
+	}
+
+	tests := []struct {
+		role  string
+		other string
+		want  bool
+	}{
+		{role: "ADMIN", other: "MODERATOR", want: true},
+		{role: "ADMIN", other: "ADMIN", want: true},
+		{role: "MODERATOR", other: "ADMIN", want: false},
+		{role: "MODERATOR", other: "SUPPORT", want: true},
+		{role: "MODERATOR", other: "USER", want: false},
+		{role: "SUPPORT", other: "MODERATOR", want: false},
+		// A role without a policy grants nothing
+		{role: "MODERATOR", other: "DELETED", want: true},
+		{role: "DELETED", other: "USER", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.role+" over "+tt.other, func(t *testing.T) {
+			assert.Equal(t, tt.want, helpers.RoleCovers(policies, tt.role, tt.other))
+		})
+	}
+}
+
+func TestVerifyRolePolicyEdit(t *testing.T) {
+	policies := map[string]models.RolePolicy{
+		"ADMIN":   {Role: "ADMIN", Permissions: []string{helpers.PermAll}},
+		"MANAGER": {Role: "MANAGER", Permissions: []string{helpers.PermPolicyManage, helpers.PermMovieCreate, helpers.PermUserRead}},
+		"CURATOR": {Role: "CURATOR", Permissions: []string{helpers.PermMovieCreate}},
+	}
+
+	tests := []struct {
+		name        string
+		actorRole   string
+		role        string
+		permissions []string
+		want        error
+	}{
+		{name: "admin grants everything", actorRole: "ADMIN", role: "MANAGER", permissions: []string{helpers.PermAll}},
+		{name: "grants permissions it has", actorRole: "MANAGER", role: "CURATOR", permissions: []string{helpers.PermMovieCreate, helpers.PermUserRead}},
+		{name: "creates a role within its permissions", actorRole: "MANAGER", role: "EDITOR", permissions: []string{helpers.PermMovieCreate}},
+		{name: "takes permissions away from its own role", actorRole: "MANAGER", role: "MANAGER", permissions: []string{helpers.PermPolicyManage}},
+		{name: "grants a permission it lacks", actorRole: "MANAGER", role: "CURATOR", permissions: []string{helpers.PermUserRole}, want: helpers.ErrOutranked},
+		{name: "grants every permission", actorRole: "MANAGER", role: "CURATOR", permissions: []string{helpers.PermAll}, want: helpers.ErrOutranked},
+		{name: "grants its own role more", actorRole: "MANAGER", role: "MANAGER", permissions: []string{helpers.PermPolicyManage, helpers.PermAll}, want: helpers.ErrOutranked},
+		{name: "edits a role above it", actorRole: "MANAGER", role: "ADMIN", permissions: []string{helpers.PermPolicyManage}, want: helpers.ErrOutranked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, helpers.VerifyRolePolicyEdit(policies, tt.actorRole, tt.role, tt.permissions))
+		})
+	}
+}
+
+func TestReinstateUser(t *testing.T) {
+	requireDatabase(t)
+	assert.NoError(t, helpers.SeedRolePolicies())
+
+	admin := insertTestUser(t, "ADMIN")
+	bannedAdmin := insertTestUser(t, "ADMIN")
+	moderator := insertTestUser(t, "MODERATOR")
+	bannedUser := insertTestUser(t, "USER")
+	updateTestUser(t, bannedAdmin.User_id, bson.M{"banned": true})
+	updateTestUser(t, bannedUser.User_id, bson.M{"banned": true})
+	updateTestUser(t, moderator.User_id, bson.M{"banned": true})
+
+	_, err := helpers.ReinstateUser(bannedAdmin.User_id, moderator.User_id, "MODERATOR", "")
+	assert.Equal(t, helpers.ErrOutranked, err)
+	assert.True(t, findTestUser(t, bannedAdmin.User_id).Banned, "a MODERATOR can't lift an ADMIN's ban")
+
+	_, err = helpers.ReinstateUser(moderator.User_id, moderator.User_id, "MODERATOR", "")
+	assert.Equal(t, helpers.ErrSelfAdminAction, err)
+	assert.True(t, findTestUser(t, moderator.User_id).Banned, "nobody can lift their own ban")
+
+	user, err := helpers.ReinstateUser(bannedUser.User_id, admin.User_id, "ADMIN", "appeal")
+	assert.NoError(t, err)
+	assert.False(t, user.Banned)
+
+	_, err = helpers.ReinstateUser(bannedUser.User_id, admin.User_id, "ADMIN", "")
+	assert.Equal(t, helpers.ErrNotSuspended, err)
+}